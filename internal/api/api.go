@@ -0,0 +1,308 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Serves status and control of a bridge group over HTTP
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/logging"
+	"github.com/sfiera/multitalk/internal/tcp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+type (
+	server struct {
+		listen net.Listener
+	}
+
+	handler struct {
+		ctx    context.Context
+		log    *zap.Logger
+		grp    *bridge.Group
+		levels *logging.Levels
+	}
+
+	member struct {
+		ID         int        `json:"id"`
+		Kind       string     `json:"kind"`
+		Addr       string     `json:"addr"`
+		Since      time.Time  `json:"since"`
+		Uptime     string     `json:"uptime"`
+		PacketsIn  uint64     `json:"packetsIn"`
+		BytesIn    uint64     `json:"bytesIn"`
+		PacketsOut uint64     `json:"packetsOut"`
+		BytesOut   uint64     `json:"bytesOut"`
+		Duplicates uint64     `json:"duplicates"`
+		Nodes      []ddp.Node `json:"nodes,omitempty"`
+
+		QuarantinedUntil *time.Time `json:"quarantinedUntil,omitempty"`
+		RedundantUntil   *time.Time `json:"redundantUntil,omitempty"`
+	}
+
+	node struct {
+		Member int      `json:"member"`
+		Node   ddp.Node `json:"node"`
+	}
+
+	addr struct {
+		Member   int       `json:"member"`
+		Addr     string    `json:"addr"`
+		Hardware string    `json:"hardware,omitempty"`
+		Side     string    `json:"side"`
+		LastSeen time.Time `json:"lastSeen"`
+	}
+
+	addRequest struct {
+		Kind string `json:"kind"`
+		Addr string `json:"addr"`
+	}
+
+	levelRequest struct {
+		Bridge string `json:"bridge"`
+		Level  string `json:"level"`
+	}
+)
+
+// Kinds of members that can be added and removed through the API.
+// Others, such as connections accepted by a --tcp-server, are left
+// alone, since they could not be added back.
+var clients = map[string]func(addr string) (bridge.ExtBridge, error){
+	"tcp-client":  tcp.TCPClient,
+	"qemu-client": tcp.QEMUClient,
+}
+
+func HTTPServer(listen string) (*server, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %s", listen, err.Error())
+	}
+	return &server{l}, nil
+}
+
+// Serve handles HTTP requests for grp until ctx is done:
+//
+//	GET    /members       list members, with counters
+//	POST   /members       add a TCP client: {"kind": "tcp-client", "addr": "host:port"}
+//	                      or a QEMU client: {"kind": "qemu-client", "addr": "host:port"}
+//	DELETE /members/{id}  remove a TCP or QEMU client
+//	GET    /nodes         list LocalTalk nodes proxied by each member
+//	GET    /addrs         list addresses learned by each member, and when
+//	GET    /metrics       Prometheus metrics
+//	GET    /log/level     list log levels, by bridge ("" is the default)
+//	PUT    /log/level     set a log level: {"bridge": "multicast", "level": "debug"}
+//	                      or return a bridge to the default: {"bridge": "multicast"}
+//
+// There is no authentication: anyone who can connect can add and remove
+// members. Listen only on localhost, or on another trusted network.
+func (s *server) Serve(ctx context.Context, log *zap.Logger, grp *bridge.Group, levels *logging.Levels) {
+	log = log.With(zap.String("api", "http"), zap.Stringer("addr", s.listen.Addr()))
+	mux := newHandler(ctx, log, grp, levels)
+
+	go func() {
+		<-ctx.Done()
+		s.listen.Close()
+	}()
+	go func() {
+		err := http.Serve(s.listen, mux)
+		if ctx.Err() == nil {
+			log.With(zap.Error(err)).Error("serve failed")
+		}
+	}()
+}
+
+func newHandler(ctx context.Context, log *zap.Logger, grp *bridge.Group, levels *logging.Levels) http.Handler {
+	h := &handler{ctx, log, grp, levels}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/members", h.members)
+	mux.HandleFunc("/members/", h.member)
+	mux.HandleFunc("/nodes", h.nodes)
+	mux.HandleFunc("/addrs", h.addrs)
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/log/level", h.logLevel)
+	return mux
+}
+
+func (h *handler) members(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		ms := []member{}
+		for _, m := range h.grp.Members() {
+			var quarantined, redundant *time.Time
+			if time.Now().Before(m.QuarantinedUntil) {
+				quarantined = &m.QuarantinedUntil
+			}
+			if time.Now().Before(m.RedundantUntil) {
+				redundant = &m.RedundantUntil
+			}
+			ms = append(ms, member{
+				ID:         m.ID,
+				Kind:       m.Kind,
+				Addr:       m.Addr,
+				Since:      m.Since,
+				Uptime:     time.Since(m.Since).Round(time.Second).String(),
+				PacketsIn:  m.PacketsIn,
+				BytesIn:    m.BytesIn,
+				PacketsOut: m.PacketsOut,
+				BytesOut:   m.BytesOut,
+				Duplicates: m.Duplicates,
+				Nodes:      m.Nodes,
+
+				QuarantinedUntil: quarantined,
+				RedundantUntil:   redundant,
+			})
+		}
+		reply(w, http.StatusOK, ms)
+
+	case http.MethodPost:
+		req := addRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dial, ok := clients[req.Kind]
+		if !ok {
+			http.Error(w, fmt.Sprintf("cannot add %q", req.Kind), http.StatusBadRequest)
+			return
+		}
+		c, err := dial(req.Addr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		id := h.grp.Add(h.ctx, h.log, req.Kind, req.Addr, c)
+		h.log.With(zap.Int("id", id), zap.String("addr", req.Addr)).Info("added member")
+		reply(w, http.StatusCreated, map[string]int{"id": id})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handler) member(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/members/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	} else if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	for _, m := range h.grp.Members() {
+		if m.ID != id {
+			continue
+		} else if clients[m.Kind] == nil {
+			http.Error(w, fmt.Sprintf("cannot remove %q", m.Kind), http.StatusBadRequest)
+			return
+		} else if h.grp.Remove(id) {
+			h.log.With(zap.Int("id", id), zap.String("addr", m.Addr)).Info("removed member")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+func (h *handler) nodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	nodes := []node{}
+	for _, m := range h.grp.Members() {
+		for _, n := range m.Nodes {
+			nodes = append(nodes, node{m.ID, n})
+		}
+	}
+	reply(w, http.StatusOK, nodes)
+}
+
+func (h *handler) addrs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	addrs := []addr{}
+	for _, m := range h.grp.Members() {
+		for _, a := range m.Addrs {
+			addrs = append(addrs, addr{m.ID, a.Addr, a.Hardware, a.Side, a.LastSeen})
+		}
+	}
+	reply(w, http.StatusOK, addrs)
+}
+
+func (h *handler) logLevel(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, http.StatusOK, h.levels.Map())
+
+	case http.MethodPut:
+		req := levelRequest{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Level == "" && req.Bridge != "" {
+			h.levels.Unset(req.Bridge)
+		} else {
+			lvl := zapcore.InfoLevel
+			err = lvl.UnmarshalText([]byte(req.Level))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			h.levels.Set(req.Bridge, lvl)
+		}
+		h.log.With(zap.Stringer("levels", h.levels)).Info("set log level")
+		reply(w, http.StatusOK, h.levels.Map())
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/logging"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// A member that sends nothing, and proxies some nodes.
+type fakeBridge struct {
+	nodes []ddp.Node
+}
+
+func (f *fakeBridge) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	sendCh := make(chan ethertalk.Packet)
+	recvCh := make(chan ethertalk.Packet)
+	go func() {
+		for range sendCh {
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		close(recvCh)
+	}()
+	return sendCh, recvCh
+}
+
+func (f *fakeBridge) Nodes() []ddp.Node {
+	return f.nodes
+}
+
+// Serves the API for a group, which has members of the given kinds.
+func startAPI(t *testing.T, kinds ...string) (*httptest.Server, *bridge.Group) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	grp := bridge.NewGroup(zap.NewNop())
+	go grp.Run()
+	for i, kind := range kinds {
+		grp.Add(ctx, zap.NewNop(), kind, fmt.Sprintf("addr%d", i+1), &fakeBridge{nodes: []ddp.Node{ddp.Node(i + 1)}})
+		for len(grp.Members()) <= i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	srv := httptest.NewServer(newHandler(ctx, zap.NewNop(), grp, logging.NewLevels(zap.InfoLevel)))
+	t.Cleanup(srv.Close)
+	return srv, grp
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rsp.Body.Close()
+	buf := bytes.Buffer{}
+	_, _ = buf.ReadFrom(rsp.Body)
+	return rsp.StatusCode, buf.String()
+}
+
+func kinds(grp *bridge.Group) []string {
+	ks := []string{}
+	for _, m := range grp.Members() {
+		ks = append(ks, m.Kind)
+	}
+	return ks
+}
+
+func TestList(t *testing.T) {
+	assert := assert.New(t)
+	srv, _ := startAPI(t, "tcp-server", "serial")
+
+	status, body := do(t, http.MethodGet, srv.URL+"/members", "")
+	assert.Equal(http.StatusOK, status)
+	ms := []member{}
+	assert.NoError(json.Unmarshal([]byte(body), &ms))
+	if assert.Len(ms, 2) {
+		assert.Equal(1, ms[0].ID)
+		assert.Equal("tcp-server", ms[0].Kind)
+		assert.Equal("addr1", ms[0].Addr)
+		assert.Equal("serial", ms[1].Kind)
+		assert.Equal([]ddp.Node{2}, ms[1].Nodes)
+	}
+
+	status, body = do(t, http.MethodGet, srv.URL+"/nodes", "")
+	assert.Equal(http.StatusOK, status)
+	assert.JSONEq(`[{"member": 1, "node": 1}, {"member": 2, "node": 2}]`, body)
+
+	status, body = do(t, http.MethodGet, srv.URL+"/addrs", "")
+	assert.Equal(http.StatusOK, status)
+	assert.JSONEq(`[]`, body)
+
+	status, _ = do(t, http.MethodPut, srv.URL+"/nodes", "")
+	assert.Equal(http.StatusMethodNotAllowed, status)
+}
+
+func TestAddRemove(t *testing.T) {
+	assert := assert.New(t)
+	srv, grp := startAPI(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	for _, kind := range []string{"tcp-client", "qemu-client"} {
+		status, body := do(t, http.MethodPost, srv.URL+"/members",
+			fmt.Sprintf(`{"kind": %q, "addr": %q}`, kind, l.Addr().String()))
+		assert.Equal(http.StatusCreated, status, body)
+		rsp := map[string]int{}
+		assert.NoError(json.Unmarshal([]byte(body), &rsp))
+		assert.Eventually(func() bool {
+			return len(kinds(grp)) == 1
+		}, time.Second, time.Millisecond)
+		assert.Equal([]string{kind}, kinds(grp))
+
+		status, _ = do(t, http.MethodDelete, fmt.Sprintf("%s/members/%d", srv.URL, rsp["id"]), "")
+		assert.Equal(http.StatusNoContent, status)
+		assert.Equal([]string{}, kinds(grp))
+
+		status, _ = do(t, http.MethodDelete, fmt.Sprintf("%s/members/%d", srv.URL, rsp["id"]), "")
+		assert.Equal(http.StatusNotFound, status)
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	cases := []struct {
+		name   string
+		method string
+		body   string
+		status int
+	}{
+		{"json", http.MethodPost, `{"kind": `, http.StatusBadRequest},
+		{"server", http.MethodPost, `{"kind": "tcp-server", "addr": ":9000"}`, http.StatusBadRequest},
+		{"serial", http.MethodPost, `{"kind": "serial", "addr": "/dev/ttyUSB0"}`, http.StatusBadRequest},
+		{"refused", http.MethodPost, fmt.Sprintf(`{"kind": "tcp-client", "addr": %q}`, closed), http.StatusBadGateway},
+		{"method", http.MethodPut, `{"kind": "tcp-client", "addr": "localhost:9000"}`, http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, grp := startAPI(t)
+			status, body := do(t, c.method, srv.URL+"/members", c.body)
+			assert.Equal(t, c.status, status, body)
+			assert.Equal(t, []string{}, kinds(grp))
+		})
+	}
+}
+
+func TestRemoveErrors(t *testing.T) {
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		status int
+	}{
+		{"not-number", http.MethodDelete, "/members/one", http.StatusNotFound},
+		{"unknown", http.MethodDelete, "/members/99", http.StatusNotFound},
+		{"accepted", http.MethodDelete, "/members/1", http.StatusBadRequest},
+		{"serial", http.MethodDelete, "/members/2", http.StatusBadRequest},
+		{"method", http.MethodGet, "/members/1", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv, grp := startAPI(t, "tcp-server", "serial")
+			status, body := do(t, c.method, srv.URL+c.path, "")
+			assert.Equal(t, c.status, status, body)
+			assert.Equal(t, []string{"tcp-server", "serial"}, kinds(grp))
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	assert := assert.New(t)
+	srv, _ := startAPI(t)
+
+	status, body := do(t, http.MethodPut, srv.URL+"/log/level", `{"bridge": "multicast", "level": "debug"}`)
+	assert.Equal(http.StatusOK, status)
+	assert.JSONEq(`{"": "info", "multicast": "debug"}`, body)
+
+	status, _ = do(t, http.MethodPut, srv.URL+"/log/level", `{"bridge": "multicast", "level": "loud"}`)
+	assert.Equal(http.StatusBadRequest, status)
+
+	status, body = do(t, http.MethodPut, srv.URL+"/log/level", `{"bridge": "multicast"}`)
+	assert.Equal(http.StatusOK, status)
+	assert.JSONEq(`{"": "info"}`, body)
+}
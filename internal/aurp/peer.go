@@ -0,0 +1,634 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package aurp
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/aarp"
+	"github.com/sfiera/multitalk/pkg/aurp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+const (
+	// How often to resend Open-Req, until the peer answers.
+	openInterval = 10 * time.Second
+	// How often to tickle an open connection.
+	tickleInterval = 30 * time.Second
+	// How long an open connection may be silent before it is reset.
+	tickleTimeout = 90 * time.Second
+
+	// DDP packets are dropped after this many hops.
+	maxHops = 15
+
+	// How often to broadcast routes learned from the peer with RTMP.
+	rtmpInterval = 10 * time.Second
+)
+
+// Options configures an AURP peer.
+type Options struct {
+	// Networks on this side of the tunnel, advertised to the peer.
+	Networks []aurp.NetworkTuple
+	// Zone of the advertised networks.
+	Zone string
+	// Networks to which the peer’s networks are remapped, if they
+	// conflict with local networks or other peers. If empty,
+	// conflicting networks are ignored.
+	Remap ddp.NetworkRange
+	// Addresses of this router on the local side, from which routes
+	// learned from the peer are announced with RTMP and ZIP. Its
+	// network should be one of Networks. If its node is 0, routes are
+	// not announced. If its hardware address is zero, one is made up
+	// from the local IP address of the tunnel.
+	Router aarp.AddrPair
+}
+
+type (
+	peer struct {
+		t             *Transport
+		remote        *net.UDPAddr
+		local, peerDI aurp.DomainID
+		opts          Options
+		inCh          chan aurp.Packet
+		replyCh       chan ethertalk.Packet // to the group, from transmit
+		log           *zap.Logger
+
+		// Maps addresses on the local side to hardware addresses,
+		// for packets from the tunnel.
+		resolver *aarp.Resolver
+		ctx      context.Context
+
+		// State of the connection on which we receive routes.
+		open      bool
+		recvConn  uint16
+		lastHeard time.Time
+
+		// State of the connection on which we send routes.
+		sendConn uint16
+		sendSeq  uint16
+
+		routes map[ddp.Network]*route // by network on the peer’s side; guarded by t.routesMu
+	}
+
+	// A route is a network on the far side of the tunnel.
+	route struct {
+		remote   ddp.NetworkRange // as numbered by the peer
+		local    ddp.NetworkRange // as numbered on this side
+		extended bool
+		distance uint8
+		zones    []string
+		since    time.Time
+	}
+)
+
+func newPeer(t *Transport, remote *net.UDPAddr, local aurp.DomainID, opts Options) *peer {
+	p := &peer{
+		t:       t,
+		remote:  remote,
+		local:   local,
+		peerDI:  aurp.IPDomainID(remote.IP),
+		opts:    opts,
+		inCh:    make(chan aurp.Packet, 16),
+		replyCh: make(chan ethertalk.Packet, 16),
+		ctx:     context.Background(),
+		log:     zap.NewNop(),
+		routes:  map[ddp.Network]*route{},
+	}
+	p.resolver = aarp.NewResolver(p.sendAARP)
+	return p
+}
+
+// Called by the transport. Drops the packet if the peer is backed up.
+func (p *peer) deliver(packet aurp.Packet) {
+	select {
+	case p.inCh <- packet:
+	default:
+		metrics.Drops.WithLabelValues("aurp", "full").Inc()
+	}
+}
+
+func (p *peer) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	p.ctx = ctx
+	p.log = log.With(zap.Stringer("remoteAddr", p.remote))
+	sendCh := make(chan ethertalk.Packet)
+	recvCh := make(chan ethertalk.Packet)
+	go p.run(ctx, recvCh)
+	go p.transmit(sendCh)
+	return sendCh, recvCh
+}
+
+// Addrs returns the networks learned from the peer.
+// Remapped networks show the peer’s numbering as Hardware.
+func (p *peer) Addrs() []bridge.LearnedAddr {
+	p.t.routesMu.Lock()
+	defer p.t.routesMu.Unlock()
+	var addrs []bridge.LearnedAddr
+	for _, r := range p.routes {
+		addr := bridge.LearnedAddr{
+			Addr:     r.local.String(),
+			Side:     "aurp",
+			LastSeen: r.since,
+		}
+		if r.local != r.remote {
+			addr.Hardware = r.remote.String()
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool { return addrs[i].Addr < addrs[j].Addr })
+	return addrs
+}
+
+// Tunnels packets from the group, and answers those for this router.
+// Separate from run, so that the group can always send to the peer,
+// even while run waits for the group to take a packet from the tunnel.
+func (p *peer) transmit(sendCh <-chan ethertalk.Packet) {
+	for packet := range sendCh {
+		switch packet.SNAPProto {
+		case ethertalk.AARPProto:
+			p.handleAARP(packet)
+		case ethertalk.AppleTalkProto:
+			d := ddp.ExtPacket{}
+			err := ddp.ExtUnmarshal(packet.Payload, &d)
+			if err != nil {
+				metrics.UnmarshalFailures.WithLabelValues("aurp", "ddp").Inc()
+				continue
+			}
+			if p.isLocal(d.SrcNet) {
+				p.resolver.Glean(ddp.Addr{Network: d.SrcNet, Node: d.SrcNode}, packet.Src)
+			}
+			p.answer(packet, d)
+			p.tunnel(d)
+		}
+	}
+}
+
+// Runs the AURP connections, and passes on packets from the tunnel.
+func (p *peer) run(ctx context.Context, recvCh chan<- ethertalk.Packet) {
+	defer close(recvCh)
+	defer p.t.removePeer(p)
+	ticker := time.NewTicker(openInterval)
+	defer ticker.Stop()
+	rtmpTicker := time.NewTicker(rtmpInterval)
+	defer rtmpTicker.Stop()
+	p.reset()
+	p.sendOpenReq()
+	lastTickle := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			if p.open {
+				p.sendCommand(p.recvConn, 0, aurp.CommandRD, 0, nil)
+			}
+			if p.sendConn != 0 {
+				p.sendCommand(p.sendConn, 0, aurp.CommandRD, 0, nil)
+			}
+			return
+
+		case packet := <-p.replyCh:
+			select {
+			case recvCh <- packet:
+			case <-ctx.Done():
+			}
+
+		case <-rtmpTicker.C:
+			p.resolver.Expire()
+			if pak := p.rtmpData(); pak != nil {
+				select {
+				case recvCh <- *pak:
+				case <-ctx.Done():
+				}
+			}
+
+		case packet := <-p.inCh:
+			p.lastHeard = time.Now()
+			switch packet.Type {
+			case aurp.TypeAppleTalk:
+				p.untunnel(ctx, packet, recvCh)
+			case aurp.TypeAURP:
+				p.handle(packet)
+			}
+
+		case now := <-ticker.C:
+			if !p.open {
+				p.sendOpenReq()
+			} else if now.Sub(p.lastHeard) > tickleTimeout {
+				p.log.Warn("peer timed out")
+				p.reset()
+				p.sendOpenReq()
+			} else if now.Sub(lastTickle) >= tickleInterval {
+				p.sendCommand(p.recvConn, 0, aurp.CommandTickle, 0, nil)
+				lastTickle = now
+			}
+		}
+	}
+}
+
+// Forgets all routes, and starts a new connection.
+func (p *peer) reset() {
+	p.open = false
+	p.recvConn = uint16(rand.Intn(0xffff)) + 1
+	p.t.routesMu.Lock()
+	p.routes = map[ddp.Network]*route{}
+	p.t.routesMu.Unlock()
+}
+
+func (p *peer) sendOpenReq() {
+	p.sendCommand(p.recvConn, 0, aurp.CommandOpenReq, 0, aurp.MarshalOpenReq(aurp.OpenReq{Version: 1}))
+}
+
+func (p *peer) sendCommand(conn, seq uint16, cmd aurp.Command, flags aurp.Flags, data []byte) {
+	p.send(aurp.Packet{
+		DomainHeader: aurp.DomainHeader{Dst: p.peerDI, Src: p.local, Type: aurp.TypeAURP},
+		Header:       aurp.Header{ConnID: conn, Seq: seq, Command: cmd, Flags: flags},
+		Data:         data,
+	})
+}
+
+func (p *peer) send(packet aurp.Packet) {
+	err := p.t.send(p.remote, packet)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("send failed")
+	}
+}
+
+func (p *peer) handle(packet aurp.Packet) {
+	h := packet.Header
+	switch h.Command {
+	case aurp.CommandOpenReq:
+		req := aurp.OpenReq{}
+		err := aurp.UnmarshalOpenReq(packet.Data, &req)
+		if err != nil {
+			p.log.With(zap.Error(err)).Error("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues("aurp", "open-req").Inc()
+			return
+		}
+		p.sendConn = h.ConnID
+		p.sendSeq = 0
+		rsp := aurp.OpenRsp{Timeout: int16(tickleTimeout / time.Second)}
+		p.sendCommand(p.sendConn, 0, aurp.CommandOpenRsp, 0, aurp.MarshalOpenRsp(rsp))
+		p.log.Info("peer connected", zap.Uint16("version", req.Version))
+
+	case aurp.CommandOpenRsp:
+		if p.open || h.ConnID != p.recvConn {
+			return
+		}
+		rsp := aurp.OpenRsp{}
+		err := aurp.UnmarshalOpenRsp(packet.Data, &rsp)
+		if err != nil {
+			p.log.With(zap.Error(err)).Error("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues("aurp", "open-rsp").Inc()
+			return
+		} else if rsp.Timeout < 0 {
+			p.log.Warn("peer refused connection", zap.Int16("error", rsp.Timeout))
+			return
+		}
+		p.open = true
+		p.log.Info("connected")
+		p.sendCommand(p.recvConn, 0, aurp.CommandRIReq, aurp.FlagSendZoneInfo, nil)
+
+	case aurp.CommandRIReq:
+		if p.sendConn == 0 || h.ConnID != p.sendConn {
+			metrics.Drops.WithLabelValues("aurp", "conn").Inc()
+			return
+		}
+		p.sendSeq++
+		p.sendCommand(p.sendConn, p.sendSeq, aurp.CommandRIRsp, aurp.FlagLast,
+			aurp.MarshalTuples(p.opts.Networks))
+		if h.Flags&aurp.FlagSendZoneInfo != 0 {
+			p.sendZones(p.localNetworks())
+		}
+
+	case aurp.CommandRIRsp, aurp.CommandRIUpd:
+		if h.ConnID != p.recvConn {
+			return
+		}
+		var events []aurp.Event
+		if h.Command == aurp.CommandRIRsp {
+			tuples, err := aurp.UnmarshalTuples(packet.Data)
+			if err != nil {
+				p.log.With(zap.Error(err)).Error("unmarshal failed")
+				metrics.UnmarshalFailures.WithLabelValues("aurp", "ri-rsp").Inc()
+				return
+			}
+			for _, t := range tuples {
+				events = append(events, aurp.Event{Code: aurp.EventNetworkAdded, NetworkTuple: t})
+			}
+		} else {
+			var err error
+			events, err = aurp.UnmarshalEvents(packet.Data)
+			if err != nil {
+				p.log.With(zap.Error(err)).Error("unmarshal failed")
+				metrics.UnmarshalFailures.WithLabelValues("aurp", "ri-upd").Inc()
+				return
+			}
+		}
+		p.sendCommand(p.recvConn, h.Seq, aurp.CommandRIAck, 0, nil)
+		if nets := p.applyEvents(events); len(nets) > 0 {
+			p.sendCommand(p.recvConn, 0, aurp.CommandZReq, 0, aurp.MarshalZIReq(nets))
+		}
+
+	case aurp.CommandRD:
+		// Either connection may be closed by the peer.
+		if p.open && h.ConnID == p.recvConn {
+			p.log.Info("peer disconnected")
+			p.reset()
+			p.sendOpenReq()
+		} else if p.sendConn != 0 && h.ConnID == p.sendConn {
+			p.log.Info("peer closed connection")
+			p.sendConn = 0
+		} else {
+			metrics.Drops.WithLabelValues("aurp", "conn").Inc()
+		}
+
+	case aurp.CommandZReq:
+		nets, err := aurp.UnmarshalZIReq(packet.Data)
+		if err != nil {
+			p.log.With(zap.Error(err)).Error("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues("aurp", "zi-req").Inc()
+			return
+		}
+		p.sendZones(nets)
+
+	case aurp.CommandZRsp:
+		_, tuples, err := aurp.UnmarshalZIRsp(packet.Data)
+		if err != nil {
+			p.log.With(zap.Error(err)).Error("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues("aurp", "zi-rsp").Inc()
+			return
+		}
+		p.applyZones(tuples)
+
+	case aurp.CommandTickle:
+		p.sendCommand(h.ConnID, 0, aurp.CommandTickleAck, 0, nil)
+
+	case aurp.CommandRIAck, aurp.CommandTickleAck:
+		// Nothing to do, besides having heard from the peer.
+	}
+}
+
+// Returns the first network of each advertised network range.
+func (p *peer) localNetworks() []ddp.Network {
+	var nets []ddp.Network
+	for _, t := range p.opts.Networks {
+		nets = append(nets, t.Range.First)
+	}
+	return nets
+}
+
+// Sends the zone of those requested networks which are advertised.
+// Non-extended and extended networks are answered separately.
+func (p *peer) sendZones(nets []ddp.Network) {
+	var short, ext []aurp.ZoneTuple
+	for _, net := range nets {
+		for _, t := range p.opts.Networks {
+			if t.Range.First != net {
+				continue
+			}
+			zt := aurp.ZoneTuple{Network: net, Zone: p.opts.Zone}
+			if t.Extended {
+				ext = append(ext, zt)
+			} else {
+				short = append(short, zt)
+			}
+		}
+	}
+	if len(short) > 0 {
+		p.sendCommand(p.sendConn, 0, aurp.CommandZRsp, 0, aurp.MarshalZIRsp(aurp.SubcodeZIRsp, short))
+	}
+	if len(ext) > 0 {
+		p.sendCommand(p.sendConn, 0, aurp.CommandZRsp, 0, aurp.MarshalZIRsp(aurp.SubcodeExtZIRsp, ext))
+	}
+}
+
+// Updates routes, returning the networks whose zones should be requested.
+func (p *peer) applyEvents(events []aurp.Event) []ddp.Network {
+	p.t.routesMu.Lock()
+	defer p.t.routesMu.Unlock()
+	var nets []ddp.Network
+	for _, e := range events {
+		log := p.log.With(zap.Stringer("network", e.Range))
+		r := p.routes[e.Range.First]
+		switch e.Code {
+		case aurp.EventNetworkAdded:
+			if r != nil {
+				r.distance = e.Distance
+				continue
+			}
+			local, ok := p.allocate(e.Range)
+			if !ok {
+				log.Warn("network conflicts; ignoring")
+				metrics.Drops.WithLabelValues("aurp", "conflict").Inc()
+				continue
+			} else if local != e.Range {
+				log.Info("remapped network", zap.Stringer("local", local))
+			} else {
+				log.Debug("added network")
+			}
+			p.routes[e.Range.First] = &route{
+				remote:   e.Range,
+				local:    local,
+				extended: e.Extended,
+				distance: e.Distance,
+				since:    time.Now(),
+			}
+			nets = append(nets, e.Range.First)
+
+		case aurp.EventNetworkDeleted:
+			if r != nil {
+				delete(p.routes, e.Range.First)
+				log.Debug("deleted network")
+			}
+
+		case aurp.EventNetworkRouteChanged, aurp.EventNetworkDistanceChanged:
+			if r != nil {
+				r.distance = e.Distance
+			}
+
+		case aurp.EventZoneChanged:
+			if r != nil {
+				nets = append(nets, e.Range.First)
+			}
+		}
+	}
+	return nets
+}
+
+func (p *peer) applyZones(tuples []aurp.ZoneTuple) {
+	p.t.routesMu.Lock()
+	defer p.t.routesMu.Unlock()
+	seen := map[ddp.Network]bool{}
+	for _, zt := range tuples {
+		r := p.routes[zt.Network]
+		if r == nil {
+			continue
+		}
+		if !seen[zt.Network] {
+			r.zones = nil // replaced, not extended, by a new response
+			seen[zt.Network] = true
+		}
+		r.zones = append(r.zones, zt.Zone)
+	}
+}
+
+// Chooses where the peer’s network range rng appears on this side.
+// It keeps its own numbers, unless they conflict with the local
+// networks or a route from any peer. Otherwise, it is remapped into
+// the first free space of the remapping range, if any.
+// Called with routesMu held.
+func (p *peer) allocate(rng ddp.NetworkRange) (ddp.NetworkRange, bool) {
+	if !p.conflicts(rng) {
+		return rng, true
+	}
+	size := rng.Last - rng.First
+	pool := p.opts.Remap
+	if pool.First == 0 || size > pool.Last-pool.First {
+		return ddp.NetworkRange{}, false
+	}
+	for first := pool.First; first <= pool.Last-size; first++ {
+		local := ddp.NetworkRange{First: first, Last: first + size}
+		if !p.conflicts(local) {
+			return local, true
+		}
+		if first == pool.Last-size {
+			break // don’t wrap around
+		}
+	}
+	return ddp.NetworkRange{}, false
+}
+
+// Called with routesMu held.
+func (p *peer) conflicts(rng ddp.NetworkRange) bool {
+	for _, t := range p.opts.Networks {
+		if t.Range.Overlaps(rng) {
+			return true
+		}
+	}
+	for _, r := range p.routes {
+		if r.local.Overlaps(rng) {
+			return true
+		}
+	}
+	return p.t.conflicts(p, rng)
+}
+
+// Finds the route for a network, by its number on this side
+// (if local) or the peer’s side.
+func (p *peer) lookup(net ddp.Network, local bool) *route {
+	p.t.routesMu.Lock()
+	defer p.t.routesMu.Unlock()
+	for _, r := range p.routes {
+		if (local && r.local.Contains(net)) || (!local && r.remote.Contains(net)) {
+			return r
+		}
+	}
+	return nil
+}
+
+// Sends a DDP packet through the tunnel, if it is routed to the peer.
+// Routes are only known while the connection is open.
+func (p *peer) tunnel(d ddp.ExtPacket) {
+	r := p.lookup(d.DstNet, true)
+	if r == nil {
+		return // not routed through this peer
+	}
+	hops := (d.Size >> 10) & 0xf
+	if hops >= maxHops {
+		metrics.Drops.WithLabelValues("aurp", "hops").Inc()
+		return
+	}
+	d.Size = d.Size&^(0xf<<10) | (hops+1)<<10
+	d.DstNet = d.DstNet - r.local.First + r.remote.First
+
+	updateChecksum(&d)
+	data, err := ddp.ExtMarshal(d)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("marshal failed")
+		return
+	}
+	p.send(aurp.Packet{
+		DomainHeader: aurp.DomainHeader{Dst: p.peerDI, Src: p.local, Type: aurp.TypeAppleTalk},
+		Data:         data,
+	})
+}
+
+// Passes on a DDP packet from the tunnel, from this router. It is sent
+// to the hardware address of its destination, if known, and otherwise
+// broadcast while the address is resolved.
+func (p *peer) untunnel(ctx context.Context, packet aurp.Packet, recvCh chan<- ethertalk.Packet) {
+	d := ddp.ExtPacket{}
+	err := ddp.ExtUnmarshal(packet.Data, &d)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("unmarshal failed")
+		metrics.UnmarshalFailures.WithLabelValues("aurp", "ddp").Inc()
+		return
+	}
+	r := p.lookup(d.SrcNet, false)
+	if r == nil {
+		metrics.Drops.WithLabelValues("aurp", "route").Inc()
+		return
+	}
+	d.SrcNet = d.SrcNet - r.remote.First + r.local.First
+
+	updateChecksum(&d)
+	eth, err := ethertalk.AppleTalk(p.opts.Router.Hardware, d)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("marshal failed")
+		return
+	}
+	p.unicast(eth, ddp.Addr{Network: d.DstNet, Node: d.DstNode})
+	select {
+	case recvCh <- *eth:
+	case <-ctx.Done():
+	}
+}
+
+// Recalculates the checksum of a packet whose header was rewritten,
+// unless it had none.
+func updateChecksum(d *ddp.ExtPacket) {
+	if d.Cksum == 0 {
+		return
+	}
+	data, err := ddp.ExtMarshal(*d)
+	if err != nil {
+		return // reported when marshaled again
+	}
+	d.Cksum = ddp.Checksum(data)
+}
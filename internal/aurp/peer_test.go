@@ -0,0 +1,470 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package aurp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/pkg/aarp"
+	"github.com/sfiera/multitalk/pkg/aurp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/rtmp"
+	"github.com/sfiera/multitalk/pkg/zip"
+)
+
+// A router at the far end of a tunnel, driven by the test.
+type fakeRouter struct {
+	t    *testing.T
+	conn *net.UDPConn
+	to   *net.UDPAddr // the transport under test
+	di   aurp.DomainID
+}
+
+// Starts a peer with opts, tunneling to a fake router.
+func startPeer(t *testing.T, opts Options) (
+	f *fakeRouter,
+	b bridge.ExtBridge,
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	tr, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.Serve(ctx, zap.NewNop())
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	f = &fakeRouter{
+		t:    t,
+		conn: conn,
+		to:   tr.conn.LocalAddr().(*net.UDPAddr),
+		di:   aurp.IPDomainID(net.IPv4(127, 0, 0, 1)),
+	}
+
+	b, err = tr.Peer(conn.LocalAddr().String(), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, recv = b.Start(ctx, zap.NewNop())
+	return f, b, send, recv
+}
+
+func (f *fakeRouter) send(pak aurp.Packet) {
+	pak.DomainHeader.Dst, pak.DomainHeader.Src = f.di, f.di
+	data, err := aurp.Marshal(pak)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	_, err = f.conn.WriteToUDP(data, f.to)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+func (f *fakeRouter) command(conn, seq uint16, cmd aurp.Command, flags aurp.Flags, data []byte) {
+	f.send(aurp.Packet{
+		DomainHeader: aurp.DomainHeader{Type: aurp.TypeAURP},
+		Header:       aurp.Header{ConnID: conn, Seq: seq, Command: cmd, Flags: flags},
+		Data:         data,
+	})
+}
+
+// Sends a DDP packet through the tunnel.
+func (f *fakeRouter) tunnel(d ddp.ExtPacket) {
+	data, err := ddp.ExtMarshal(d)
+	if err != nil {
+		f.t.Fatal(err)
+	}
+	f.send(aurp.Packet{DomainHeader: aurp.DomainHeader{Type: aurp.TypeAppleTalk}, Data: data})
+}
+
+// Returns the next packet of type typ from the peer.
+func (f *fakeRouter) next(typ aurp.PacketType) aurp.Packet {
+	f.t.Helper()
+	buf := make([]byte, 4096)
+	for {
+		f.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, _, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			f.t.Fatal(err)
+		}
+		pak := aurp.Packet{}
+		if err := aurp.Unmarshal(buf[:n], &pak); err != nil {
+			f.t.Fatal(err)
+		} else if pak.Type == typ {
+			return pak
+		}
+	}
+}
+
+// Returns the next AURP command from the peer, which must be cmd.
+func (f *fakeRouter) expect(cmd aurp.Command) aurp.Packet {
+	f.t.Helper()
+	pak := f.next(aurp.TypeAURP)
+	if pak.Command != cmd {
+		f.t.Fatalf("got command %#x; want %#x", pak.Command, cmd)
+	}
+	return pak
+}
+
+// Returns the next tunneled DDP packet from the peer.
+func (f *fakeRouter) expectDDP() ddp.ExtPacket {
+	f.t.Helper()
+	pak := f.next(aurp.TypeAppleTalk)
+	d := ddp.ExtPacket{}
+	if err := ddp.ExtUnmarshal(pak.Data, &d); err != nil {
+		f.t.Fatal(err)
+	}
+	return d
+}
+
+// Accepts the peer’s connection, and sends it routes.
+// Returns the ID of the connection.
+func (f *fakeRouter) accept(routes []aurp.NetworkTuple) uint16 {
+	f.t.Helper()
+	conn := f.expect(aurp.CommandOpenReq).ConnID
+	f.command(conn, 0, aurp.CommandOpenRsp, 0, aurp.MarshalOpenRsp(aurp.OpenRsp{Timeout: 90}))
+	req := f.expect(aurp.CommandRIReq)
+	assert.Equal(f.t, conn, req.ConnID)
+	assert.Equal(f.t, aurp.FlagSendZoneInfo, req.Flags)
+	f.command(conn, 1, aurp.CommandRIRsp, aurp.FlagLast, aurp.MarshalTuples(routes))
+	assert.Equal(f.t, uint16(1), f.expect(aurp.CommandRIAck).Seq)
+	return conn
+}
+
+// Returns the learned networks, as shown by the API.
+func networks(b bridge.ExtBridge) map[string]string {
+	nets := map[string]string{}
+	for _, a := range b.(bridge.AddrTable).Addrs() {
+		nets[a.Addr] = a.Hardware
+	}
+	return nets
+}
+
+func ddpTo(dstNet ddp.Network, srcNet ddp.Network, data ...byte) ddp.ExtPacket {
+	return ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      uint16(13 + len(data)),
+			DstNet:    dstNet,
+			DstNode:   5,
+			DstSocket: 4,
+			SrcNet:    srcNet,
+			SrcNode:   7,
+			SrcSocket: 4,
+			Proto:     ddp.ProtoAEP,
+		},
+		Data: data,
+	}
+}
+
+func ethertalkTo(t *testing.T, d ddp.ExtPacket) ethertalk.Packet {
+	pak, err := ethertalk.AppleTalk(ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pak
+}
+
+func TestHandshake(t *testing.T) {
+	assert := assert.New(t)
+	local := []aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 10, Last: 10}}}
+	f, b, _, _ := startPeer(t, Options{Networks: local, Zone: "Here"})
+
+	// Our connection to the peer, on which it sends routes.
+	conn := f.accept([]aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 20, Last: 20}, Distance: 1}})
+	nets, err := aurp.UnmarshalZIReq(f.expect(aurp.CommandZReq).Data)
+	assert.NoError(err)
+	assert.Equal([]ddp.Network{20}, nets)
+	f.command(conn, 0, aurp.CommandZRsp, 0,
+		aurp.MarshalZIRsp(aurp.SubcodeZIRsp, []aurp.ZoneTuple{{Network: 20, Zone: "There"}}))
+	assert.Eventually(func() bool {
+		return len(networks(b)) == 1
+	}, time.Second, time.Millisecond)
+	assert.Equal(map[string]string{"20": ""}, networks(b))
+
+	// The peer’s connection to us, on which we send routes.
+	f.command(77, 0, aurp.CommandOpenReq, 0, aurp.MarshalOpenReq(aurp.OpenReq{Version: 1}))
+	assert.Equal(uint16(77), f.expect(aurp.CommandOpenRsp).ConnID)
+	f.command(77, 0, aurp.CommandRIReq, aurp.FlagSendZoneInfo, nil)
+	rsp := f.expect(aurp.CommandRIRsp)
+	assert.Equal(uint16(77), rsp.ConnID)
+	tuples, err := aurp.UnmarshalTuples(rsp.Data)
+	assert.NoError(err)
+	assert.Equal(local, tuples)
+	_, zones, err := aurp.UnmarshalZIRsp(f.expect(aurp.CommandZRsp).Data)
+	assert.NoError(err)
+	assert.Equal([]aurp.ZoneTuple{{Network: 10, Zone: "Here"}}, zones)
+
+	// Commands on unknown connections are ignored.
+	f.command(78, 0, aurp.CommandRIReq, 0, nil)
+	f.command(79, 0, aurp.CommandRD, 0, nil)
+	f.command(77, 0, aurp.CommandTickle, 0, nil)
+	f.expect(aurp.CommandTickleAck)
+	assert.Equal(map[string]string{"20": ""}, networks(b))
+
+	// Closing our connection forgets its routes, and reopens it.
+	f.command(conn, 0, aurp.CommandRD, 0, nil)
+	assert.NotEqual(conn, f.expect(aurp.CommandOpenReq).ConnID)
+	assert.Empty(networks(b))
+}
+
+func TestRemap(t *testing.T) {
+	assert := assert.New(t)
+	f, b, send, recv := startPeer(t, Options{
+		Networks: []aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 100, Last: 109}, Extended: true}},
+		Remap:    ddp.NetworkRange{First: 60000, Last: 60999},
+	})
+	f.accept([]aurp.NetworkTuple{
+		{Range: ddp.NetworkRange{First: 105, Last: 106}, Extended: true},
+		{Range: ddp.NetworkRange{First: 300, Last: 300}},
+	})
+	f.expect(aurp.CommandZReq)
+	assert.Equal(map[string]string{"60000-60001": "105-106", "300": ""}, networks(b))
+
+	// Into the tunnel, renumbered, with a hop counted. Packets to
+	// networks that are not routed through the peer are not sent.
+	send <- ethertalkTo(t, ddpTo(200, 100, 0x01))
+	send <- ethertalkTo(t, ddpTo(60001, 100, 0x02))
+	d := f.expectDDP()
+	assert.Equal(ddp.Network(106), d.DstNet)
+	assert.Equal(uint16(1), d.Size>>10&0xf)
+	assert.Equal([]byte{0x02}, d.Data)
+
+	// Out of the tunnel, renumbered.
+	f.tunnel(ddpTo(100, 105, 0x03))
+	pak := <-recv
+	d = ddp.ExtPacket{}
+	assert.NoError(ddp.ExtUnmarshal(pak.Payload, &d))
+	assert.Equal(ddp.Network(60000), d.SrcNet)
+	assert.Equal([]byte{0x03}, d.Data)
+}
+
+func TestBothWays(t *testing.T) {
+	assert := assert.New(t)
+	const n = 50
+	f, _, send, recv := startPeer(t, Options{
+		Networks: []aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 10, Last: 10}}},
+	})
+	f.accept([]aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 20, Last: 20}}})
+	f.expect(aurp.CommandZReq)
+
+	// While nobody takes packets from the tunnel, packets can still be
+	// sent into it, as the group does.
+	f.tunnel(ddpTo(10, 20, 0xff))
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < n; i++ {
+			send <- ethertalkTo(t, ddpTo(20, 10, byte(i)))
+		}
+	}()
+	for i := 0; i < n; i++ {
+		f.tunnel(ddpTo(10, 20, byte(i)))
+	}
+	select {
+	case <-sent:
+	case <-time.After(2 * time.Second):
+		t.Fatal("send blocked")
+	}
+	for i := 0; i < n; i++ {
+		assert.Equal([]byte{byte(i)}, f.expectDDP().Data)
+	}
+	select {
+	case <-recv:
+	case <-time.After(2 * time.Second):
+		t.Fatal("recv blocked")
+	}
+}
+
+// Returns the DDP packet in pak, which must be from the router.
+func fromRouter(t *testing.T, pak ethertalk.Packet, hw ethernet.Addr) ddp.ExtPacket {
+	t.Helper()
+	assert.Equal(t, hw, pak.Src)
+	d := ddp.ExtPacket{}
+	if err := ddp.ExtUnmarshal(pak.Payload, &d); err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestAnnounce(t *testing.T) {
+	assert := assert.New(t)
+	routerHW := ethernet.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	macHW := ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}
+	mac := ddp.Addr{Network: 1000, Node: 7}
+	me := ddp.Addr{Network: 1000, Node: 253}
+	cable := ddp.NetworkRange{First: 1000, Last: 1009}
+	f, b, send, recv := startPeer(t, Options{
+		Networks: []aurp.NetworkTuple{{Range: cable, Extended: true}},
+		Router:   aarp.AddrPair{Hardware: routerHW, Proto: me},
+	})
+	conn := f.accept([]aurp.NetworkTuple{
+		{Range: ddp.NetworkRange{First: 20, Last: 20}, Distance: 1},
+		{Range: ddp.NetworkRange{First: 300, Last: 301}, Extended: true, Distance: 2},
+	})
+	f.expect(aurp.CommandZReq)
+	f.command(conn, 0, aurp.CommandZRsp, 0, aurp.MarshalZIRsp(aurp.SubcodeZIRsp,
+		[]aurp.ZoneTuple{{Network: 20, Zone: "There"}}))
+	f.command(conn, 0, aurp.CommandZRsp, 0, aurp.MarshalZIRsp(aurp.SubcodeExtZIRsp,
+		[]aurp.ZoneTuple{{Network: 300, Zone: "Far"}, {Network: 300, Zone: "Away"}}))
+	f.command(conn, 0, aurp.CommandTickle, 0, nil)
+	f.expect(aurp.CommandTickleAck) // so the zones have been applied
+
+	request := func(socket ddp.Socket, proto uint8, data ...byte) {
+		d := ddpTo(0, 1000, data...)
+		d.DstNode, d.DstSocket, d.SrcSocket, d.Proto = 255, socket, 253, proto
+		send <- ethertalkTo(t, d)
+	}
+
+	// An RTMP Request is answered with the router’s address.
+	request(rtmp.Socket, ddp.ProtoRTMPReq, byte(rtmp.FunctionRequest))
+	pak := <-recv
+	assert.Equal(macHW, pak.Dst)
+	d := fromRouter(t, pak, routerHW)
+	assert.Equal(me, ddp.Addr{Network: d.SrcNet, Node: d.SrcNode})
+	assert.Equal(mac, ddp.Addr{Network: d.DstNet, Node: d.DstNode})
+	assert.Equal(ddp.Socket(253), d.DstSocket)
+	r := rtmp.Packet{}
+	assert.NoError(rtmp.Unmarshal(d.Data, &r))
+	assert.Equal(rtmp.Packet{
+		Network:  1000,
+		Node:     253,
+		Extended: true,
+		Tuples:   []rtmp.Tuple{{Range: cable, Extended: true}},
+	}, r)
+
+	// Routes learned from the peer are announced one hop further away.
+	routes := []rtmp.Tuple{
+		{Range: cable, Extended: true},
+		{Range: ddp.NetworkRange{First: 20, Last: 20}, Distance: 2},
+		{Range: ddp.NetworkRange{First: 300, Last: 301}, Extended: true, Distance: 3},
+	}
+	request(rtmp.Socket, ddp.ProtoRTMPReq, byte(rtmp.FunctionRDRFull))
+	r = rtmp.Packet{}
+	assert.NoError(rtmp.Unmarshal(fromRouter(t, <-recv, routerHW).Data, &r))
+	assert.Equal(routes, r.Tuples)
+	data := b.(*peer).rtmpData()
+	if assert.NotNil(data) {
+		assert.Equal(ethertalk.AppleTalkBroadcast, data.Dst)
+		d = fromRouter(t, *data, routerHW)
+		assert.Equal(ddp.Node(255), d.DstNode)
+		assert.Equal(rtmp.Socket, d.DstSocket)
+		r = rtmp.Packet{}
+		assert.NoError(rtmp.Unmarshal(d.Data, &r))
+		assert.Equal(routes, r.Tuples)
+	}
+
+	// ZIP Queries are answered for routed networks.
+	query, err := zip.MarshalQuery([]ddp.Network{20, 300, 40})
+	assert.NoError(err)
+	request(zip.Socket, ddp.ProtoZIP, query...)
+	fn, tuples, err := zip.UnmarshalReply(fromRouter(t, <-recv, routerHW).Data)
+	assert.NoError(err)
+	assert.Equal(zip.FunctionReply, fn)
+	assert.Equal([]zip.Tuple{{Network: 20, Zone: "There"}}, tuples)
+	fn, tuples, err = zip.UnmarshalReply(fromRouter(t, <-recv, routerHW).Data)
+	assert.NoError(err)
+	assert.Equal(zip.FunctionExtReply, fn)
+	assert.Equal([]zip.Tuple{{Network: 300, Zone: "Far"}, {Network: 300, Zone: "Away"}}, tuples)
+
+	// The router’s address is defended.
+	probe, err := ethertalk.AARP(macHW, aarp.Probe(macHW, me))
+	assert.NoError(err)
+	send <- *probe
+	pak = <-recv
+	assert.Equal(macHW, pak.Dst)
+	a := aarp.Packet{}
+	assert.NoError(aarp.Unmarshal(pak.Payload, &a))
+	assert.Equal(aarp.Response(aarp.AddrPair{Hardware: routerHW, Proto: me},
+		aarp.AddrPair{Hardware: macHW, Proto: me}), a)
+}
+
+func TestUntunnelAddresses(t *testing.T) {
+	assert := assert.New(t)
+	routerHW := ethernet.Addr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	macHW := ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}
+	me := aarp.AddrPair{Hardware: routerHW, Proto: ddp.Addr{Network: 10, Node: 253}}
+	f, b, send, recv := startPeer(t, Options{
+		Networks: []aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 10, Last: 10}}},
+		Router:   me,
+	})
+	f.accept([]aurp.NetworkTuple{{Range: ddp.NetworkRange{First: 20, Last: 20}}})
+	f.expect(aurp.CommandZReq)
+
+	// From the router, to a node whose hardware address is known from
+	// its traffic.
+	send <- ethertalkTo(t, ddpTo(20, 10, 0x01))
+	f.expectDDP()
+	d := ddpTo(10, 20, 0x02)
+	d.DstNode = 7
+	f.tunnel(d)
+	pak := <-recv
+	assert.Equal(routerHW, pak.Src)
+	assert.Equal(macHW, pak.Dst)
+
+	// To an unknown node, broadcast while it is resolved.
+	d = ddpTo(10, 20, 0x03)
+	d.DstNode = 6
+	f.tunnel(d)
+	paks := []ethertalk.Packet{<-recv, <-recv}
+	if paks[0].SNAPProto == ethertalk.AARPProto {
+		paks[0], paks[1] = paks[1], paks[0] // sent concurrently
+	}
+	assert.Equal(routerHW, paks[0].Src)
+	assert.Equal(ethertalk.AppleTalkBroadcast, paks[0].Dst)
+	a := aarp.Packet{}
+	assert.NoError(aarp.Unmarshal(paks[1].Payload, &a))
+	assert.Equal(aarp.Request(me, ddp.Addr{Network: 10, Node: 6}), a)
+
+	hw6 := ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x06}
+	resp, err := ethertalk.AARP(hw6, aarp.Response(
+		aarp.AddrPair{Hardware: hw6, Proto: ddp.Addr{Network: 10, Node: 6}}, me))
+	assert.NoError(err)
+	send <- *resp
+	assert.Eventually(func() bool {
+		_, ok := b.(*peer).resolver.Lookup(ddp.Addr{Network: 10, Node: 6})
+		return ok
+	}, time.Second, time.Millisecond)
+	f.tunnel(d)
+	assert.Equal(hw6, (<-recv).Dst)
+}
@@ -0,0 +1,307 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package aurp
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/aarp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/rtmp"
+	"github.com/sfiera/multitalk/pkg/zip"
+)
+
+// Returns a locally-administered hardware address for this end of a
+// tunnel from ip, for when none is configured.
+func hardwareFor(ip []byte) ethernet.Addr {
+	hw := ethernet.Addr{0x02, 0x00}
+	copy(hw[2:], ip)
+	return hw
+}
+
+// Returns true if net is on the local side, where it can be reached
+// without a router.
+func (p *peer) isLocal(net ddp.Network) bool {
+	for _, t := range p.opts.Networks {
+		if t.Range.Contains(net) {
+			return true
+		}
+	}
+	return ddp.StartupRange.Contains(net)
+}
+
+// Queues a packet for the group. Drops it if the group is backed up.
+func (p *peer) reply(packet *ethertalk.Packet) {
+	select {
+	case p.replyCh <- *packet:
+	default:
+		metrics.Drops.WithLabelValues("aurp", "full").Inc()
+	}
+}
+
+// Sends an AARP request from the resolver to the local side.
+func (p *peer) sendAARP(pak aarp.Packet) error {
+	out, err := ethertalk.AARP(p.opts.Router.Hardware, pak)
+	if err != nil {
+		return err
+	}
+	select {
+	case p.replyCh <- *out:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// Addresses out to the hardware address for dst, if known.
+// Otherwise, it remains broadcast, and if dst is on the local side,
+// it is resolved in the background, to be known next time.
+func (p *peer) unicast(out *ethertalk.Packet, dst ddp.Addr) {
+	if dst.Node == 255 || !p.isLocal(dst.Network) {
+		return
+	} else if hw, ok := p.resolver.Lookup(dst); ok {
+		out.Dst = hw
+		return
+	} else if p.opts.Router.Proto.Node == 0 || p.resolver.Pending(dst) {
+		return // no address to ask from, or already asking
+	}
+	go func() {
+		_, err := p.resolver.Resolve(p.ctx, p.opts.Router, dst)
+		if err != nil && p.ctx.Err() == nil {
+			p.log.With(zap.Error(err)).Debug("resolve failed",
+				zap.Uint16("network", uint16(dst.Network)), zap.Uint8("node", uint8(dst.Node)))
+		}
+	}()
+}
+
+// Learns hardware addresses from AARP, and defends this router’s address.
+func (p *peer) handleAARP(packet ethertalk.Packet) {
+	a := aarp.Packet{}
+	err := aarp.Unmarshal(packet.Payload, &a)
+	if err != nil {
+		return
+	}
+	p.resolver.Handle(a)
+	me := p.opts.Router
+	if me.Proto.Node == 0 || a.Dst.Proto != me.Proto {
+		return
+	} else if a.Opcode != aarp.RequestOp && a.Opcode != aarp.ProbeOp {
+		return
+	}
+	resp, err := ethertalk.AARP(me.Hardware, aarp.Response(me, a.Src))
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("marshal failed")
+		return
+	}
+	resp.Dst = packet.Src
+	p.reply(resp)
+}
+
+// Answers RTMP and ZIP requests to this router, or broadcast to routers.
+func (p *peer) answer(packet ethertalk.Packet, d ddp.ExtPacket) {
+	me := p.opts.Router.Proto
+	if me.Node == 0 || len(d.Data) == 0 {
+		return
+	} else if d.DstNode == 255 {
+		if d.DstNet != 0 && !p.isLocal(d.DstNet) {
+			return
+		}
+	} else if d.DstNet != me.Network || d.DstNode != me.Node {
+		return
+	}
+
+	src := ddp.Addr{Network: d.SrcNet, Node: d.SrcNode}
+	switch {
+	case d.DstSocket == rtmp.Socket && d.Proto == ddp.ProtoRTMPReq:
+		fn := rtmp.Function(d.Data[0])
+		if fn != rtmp.FunctionRequest && fn != rtmp.FunctionRDRSplit && fn != rtmp.FunctionRDRFull {
+			return
+		}
+		// A Response has no routes; the requester only wants a router.
+		data, err := rtmp.Marshal(p.rtmpPacket(fn != rtmp.FunctionRequest))
+		if err != nil {
+			p.log.With(zap.Error(err)).Error("marshal failed")
+			return
+		}
+		p.replyTo(packet.Src, src, d.SrcSocket, rtmp.Socket, ddp.ProtoRTMPResp, data)
+
+	case d.DstSocket == zip.Socket && d.Proto == ddp.ProtoZIP:
+		if zip.Function(d.Data[0]) != zip.FunctionQuery {
+			return // such as GetNetInfo, which is for the local network
+		}
+		nets, err := zip.UnmarshalQuery(d.Data)
+		if err != nil {
+			metrics.UnmarshalFailures.WithLabelValues("aurp", "zip").Inc()
+			return
+		}
+		for _, r := range p.zipReplies(nets) {
+			p.replyTo(packet.Src, src, d.SrcSocket, zip.Socket, ddp.ProtoZIP, r)
+		}
+	}
+}
+
+// Queues a DDP packet from this router to dst, at hardware address hw.
+func (p *peer) replyTo(hw ethernet.Addr, dst ddp.Addr, dstSocket, srcSocket ddp.Socket, proto uint8, data []byte) {
+	out, err := p.fromRouter(dst, dstSocket, srcSocket, proto, data)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("marshal failed")
+		return
+	}
+	out.Dst = hw
+	p.reply(out)
+}
+
+// Returns a DDP packet from this router to dst, broadcast.
+func (p *peer) fromRouter(dst ddp.Addr, dstSocket, srcSocket ddp.Socket, proto uint8, data []byte) (*ethertalk.Packet, error) {
+	me := p.opts.Router
+	return ethertalk.AppleTalk(me.Hardware, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      uint16(13 + len(data)),
+			DstNet:    dst.Network,
+			DstNode:   dst.Node,
+			DstSocket: dstSocket,
+			SrcNet:    me.Proto.Network,
+			SrcNode:   me.Proto.Node,
+			SrcSocket: srcSocket,
+			Proto:     proto,
+		},
+		Data: data,
+	})
+}
+
+// Returns an RTMP packet from this router, with the routes learned from
+// the peer if withRoutes is set.
+func (p *peer) rtmpPacket(withRoutes bool) rtmp.Packet {
+	me := p.opts.Router.Proto
+	pak := rtmp.Packet{Network: me.Network, Node: me.Node}
+	for _, t := range p.opts.Networks {
+		if t.Extended && t.Range.Contains(me.Network) {
+			pak.Extended = true
+			pak.Tuples = append(pak.Tuples, rtmp.Tuple{Range: t.Range, Extended: true})
+			break
+		}
+	}
+	if !withRoutes {
+		return pak
+	}
+	p.t.routesMu.Lock()
+	defer p.t.routesMu.Unlock()
+	for _, r := range p.sortedRoutes() {
+		if r.distance+1 > maxHops {
+			continue
+		}
+		pak.Tuples = append(pak.Tuples, rtmp.Tuple{
+			Range:    r.local,
+			Extended: r.extended,
+			Distance: r.distance + 1,
+		})
+	}
+	return pak
+}
+
+// Returns an RTMP Data packet to broadcast on the local side,
+// or nil if there are no routes to announce.
+func (p *peer) rtmpData() *ethertalk.Packet {
+	if p.opts.Router.Proto.Node == 0 {
+		return nil
+	}
+	pak := p.rtmpPacket(true)
+	if len(pak.Tuples) == 0 || (pak.Extended && len(pak.Tuples) == 1) {
+		return nil
+	}
+	data, err := rtmp.Marshal(pak)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("marshal failed")
+		return nil
+	}
+	out, err := p.fromRouter(ddp.Addr{Node: 255}, rtmp.Socket, rtmp.Socket, ddp.ProtoRTMPResp, data)
+	if err != nil {
+		p.log.With(zap.Error(err)).Error("marshal failed")
+		return nil
+	}
+	return out
+}
+
+// Returns ZIP replies with the zones of those networks in nets which
+// are routed to the peer: one Reply for all non-extended networks, and
+// one Extended Reply for each extended network.
+func (p *peer) zipReplies(nets []ddp.Network) [][]byte {
+	p.t.routesMu.Lock()
+	var short []zip.Tuple
+	var ext [][]zip.Tuple
+	for _, net := range nets {
+		for _, r := range p.sortedRoutes() {
+			if r.local.First != net || len(r.zones) == 0 {
+				continue
+			}
+			var tuples []zip.Tuple
+			for _, z := range r.zones {
+				tuples = append(tuples, zip.Tuple{Network: net, Zone: z})
+			}
+			if r.extended {
+				ext = append(ext, tuples)
+			} else {
+				short = append(short, tuples...)
+			}
+		}
+	}
+	p.t.routesMu.Unlock()
+
+	var replies [][]byte
+	add := func(fn zip.Function, tuples []zip.Tuple) {
+		data, err := zip.MarshalReply(fn, tuples)
+		if err != nil {
+			p.log.With(zap.Error(err)).Error("marshal failed")
+			return
+		}
+		replies = append(replies, data)
+	}
+	if len(short) > 0 {
+		add(zip.FunctionReply, short)
+	}
+	for _, tuples := range ext {
+		add(zip.FunctionExtReply, tuples)
+	}
+	return replies
+}
+
+// Returns the routes in order of their local network numbers.
+// Called with routesMu held.
+func (p *peer) sortedRoutes() []*route {
+	routes := make([]*route, 0, len(p.routes))
+	for _, r := range p.routes {
+		routes = append(routes, r)
+	}
+	sort.Slice(routes, func(i, j int) bool { return routes[i].local.First < routes[j].local.First })
+	return routes
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Tunnels AppleTalk to AURP peers over UDP
+package aurp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/aurp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+)
+
+// A Transport is the UDP socket shared by all AURP peers.
+type Transport struct {
+	conn *net.UDPConn
+
+	peers   map[string]*peer // by remote address
+	peersMu sync.Mutex
+
+	// Guards the routes of all peers, so that networks remapped
+	// from one peer don’t conflict with those of another.
+	routesMu sync.Mutex
+}
+
+// Listen opens the UDP socket for AURP, normally on port 387, which
+// other routers send to. Binding to it needs privileges.
+func Listen(addr string) (*Transport, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %s", addr, err.Error())
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if errors.Is(err, os.ErrPermission) && udpAddr.Port < 1024 {
+		return nil, fmt.Errorf("listen %s: %s (port %d is privileged; run as root, "+
+			"or listen on another port, if peers send to it)", addr, err.Error(), udpAddr.Port)
+	} else if err != nil {
+		return nil, fmt.Errorf("listen %s: %s", addr, err.Error())
+	}
+	return &Transport{
+		conn:  conn,
+		peers: map[string]*peer{},
+	}, nil
+}
+
+// Peer returns a bridge that tunnels to the AURP router at remote.
+// Packets from remote are not received until the bridge is started.
+func (t *Transport) Peer(remote string, opts Options) (bridge.ExtBridge, error) {
+	addr, err := net.ResolveUDPAddr("udp4", withPort(remote))
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %s", remote, err.Error())
+	}
+	local, err := localIP(addr)
+	if err != nil {
+		return nil, fmt.Errorf("route to %s: %s", remote, err.Error())
+	}
+
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if _, ok := t.peers[addr.String()]; ok {
+		return nil, fmt.Errorf("duplicate peer %s", remote)
+	}
+	if opts.Router.Hardware == (ethernet.Addr{}) {
+		opts.Router.Hardware = hardwareFor(local.To4())
+	}
+	p := newPeer(t, addr, aurp.IPDomainID(local), opts)
+	t.peers[addr.String()] = p
+	return p, nil
+}
+
+// Serve reads packets from the socket and hands them to their peers.
+func (t *Transport) Serve(ctx context.Context, log *zap.Logger) {
+	log = log.With(zap.String("bridge", "aurp"))
+	go func() {
+		<-ctx.Done()
+		t.conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, addr, err := t.conn.ReadFromUDP(buf)
+			if ctx.Err() != nil {
+				return
+			} else if err != nil {
+				log.With(zap.Error(err)).Error("recv failed")
+				continue
+			}
+
+			t.peersMu.Lock()
+			p := t.peers[addr.String()]
+			t.peersMu.Unlock()
+			if p == nil {
+				log.Debug("packet from unknown peer", zap.Stringer("remoteAddr", addr))
+				metrics.Drops.WithLabelValues("aurp", "peer").Inc()
+				continue
+			}
+
+			packet := aurp.Packet{}
+			err = aurp.Unmarshal(buf[:n], &packet)
+			if err != nil {
+				log.With(zap.Error(err)).Error("unmarshal failed")
+				metrics.UnmarshalFailures.WithLabelValues("aurp", "aurp").Inc()
+				continue
+			}
+			p.deliver(packet)
+		}
+	}()
+}
+
+func (t *Transport) send(addr *net.UDPAddr, packet aurp.Packet) error {
+	data, err := aurp.Marshal(packet)
+	if err != nil {
+		return err
+	}
+	_, err = t.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (t *Transport) removePeer(p *peer) {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	if t.peers[p.remote.String()] == p {
+		delete(t.peers, p.remote.String())
+	}
+}
+
+// Returns true if rng overlaps a route learned from any peer but p.
+// Called with routesMu held.
+func (t *Transport) conflicts(p *peer, rng ddp.NetworkRange) bool {
+	t.peersMu.Lock()
+	defer t.peersMu.Unlock()
+	for _, other := range t.peers {
+		if other == p {
+			continue
+		}
+		for _, r := range other.routes {
+			if r.local.Overlaps(rng) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Adds the AURP port to addr, if it has none.
+func withPort(addr string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(addr, fmt.Sprint(aurp.Port))
+}
+
+// Returns the local IP address used to reach addr, which identifies
+// this end of the tunnel. No packets are sent.
+func localIP(addr *net.UDPAddr) (net.IP, error) {
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
@@ -31,10 +31,15 @@ package bridge
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/sfiera/multitalk/internal/metrics"
 	"github.com/sfiera/multitalk/pkg/aarp"
 	"github.com/sfiera/multitalk/pkg/ddp"
 	"github.com/sfiera/multitalk/pkg/ethertalk"
@@ -59,6 +64,17 @@ type (
 		)
 	}
 
+	// A ProxyBridge is a Bridge that can itself answer on behalf of nodes
+	// on the far side of the bridge, such as LLAP ENQ and RTS frames.
+	//
+	// SetRemoteNodes must not block.
+	ProxyBridge interface {
+		Bridge
+		SetRemoteNodes(nodes []ddp.Node)
+	}
+
+	// An ExtBridge is a member of a Group. The log passed to Start
+	// already names the bridge, by the kind given to Group.Add.
 	ExtBridge interface {
 		Start(ctx context.Context, log *zap.Logger) (
 			send chan<- ethertalk.Packet,
@@ -66,29 +82,162 @@ type (
 		)
 	}
 
+	// A NodeTable is an ExtBridge that proxies for LocalTalk nodes,
+	// such as one returned by Extend.
+	NodeTable interface {
+		Nodes() []ddp.Node
+	}
+
 	Group struct {
-		log    *zap.Logger
-		recvCh chan func(*Group)
-		sendCh []chan<- ethertalk.Packet
+		log     *zap.Logger
+		recvCh  chan func(*Group)
+		members []*member
+		nextID  int64
+		filters []Rule
+		limits  []RateLimit
+		storm   StormOptions
+		loops   *loopDetector // nil if loop detection is off
+		dedupe  *deduper      // nil if duplicates are not dropped
+	}
+
+	member struct {
+		Member
+		bridge ExtBridge
+		send   chan<- ethertalk.Packet
+		cancel context.CancelFunc
+
+		buckets map[string]*tokenBucket // by class
+		storm   stormDetector
+		redund  redundancy
+	}
+
+	// A Member is a snapshot of a bridge that belongs to a Group.
+	Member struct {
+		ID    int
+		Kind  string
+		Addr  string
+		Since time.Time
+		Nodes []ddp.Node    // set if the bridge is a NodeTable
+		Addrs []LearnedAddr // set if the bridge is an AddrTable
+
+		PacketsIn, BytesIn   uint64
+		PacketsOut, BytesOut uint64
+		Duplicates           uint64
+
+		QuarantinedUntil time.Time // set while quarantined for a storm
+		RedundantUntil   time.Time // set while disabled as a redundant link
 	}
 )
 
 func NewGroup(log *zap.Logger) *Group {
 	return &Group{
-		log,
-		make(chan func(*Group)),
-		nil,
+		log:    log,
+		recvCh: make(chan func(*Group)),
 	}
 }
 
-func (g *Group) Add(send chan<- ethertalk.Packet, recv <-chan ethertalk.Packet) {
+// Add starts b and repeats its packets to the rest of the group.
+//
+// kind and addr describe the bridge in status reports.
+// Returns an ID which can be passed to Remove.
+func (g *Group) Add(ctx context.Context, log *zap.Logger, kind, addr string, b ExtBridge) int {
+	ctx, cancel := context.WithCancel(ctx)
+	send, recv := b.Start(ctx, log.With(zap.String("bridge", kind)))
+	m := &member{
+		Member: Member{
+			ID:    int(atomic.AddInt64(&g.nextID, 1)),
+			Kind:  kind,
+			Addr:  addr,
+			Since: time.Now(),
+		},
+		bridge: b,
+		send:   send,
+		cancel: cancel,
+	}
 	go func() {
-		g.recvCh <- add(send)
+		g.recvCh <- add(m)
 		for pak := range recv {
-			g.recvCh <- broadcast(pak, send)
+			g.recvCh <- broadcast(pak, m)
 		}
-		g.recvCh <- remove(send)
+		g.recvCh <- remove(m)
 	}()
+	return m.ID
+}
+
+// Remove stops the member with the given ID.
+// Returns false if there is no such member.
+func (g *Group) Remove(id int) bool {
+	found := make(chan bool)
+	g.recvCh <- func(g *Group) {
+		for _, m := range g.members {
+			if m.ID == id {
+				remove(m)(g)
+				found <- true
+				return
+			}
+		}
+		found <- false
+	}
+	return <-found
+}
+
+// Members returns a snapshot of the current members of the group.
+func (g *Group) Members() []Member {
+	members := make(chan []Member)
+	g.recvCh <- func(g *Group) {
+		var ms []Member
+		for _, m := range g.members {
+			snap := m.Member
+			if nt, ok := m.bridge.(NodeTable); ok {
+				snap.Nodes = nt.Nodes()
+			}
+			if at, ok := m.bridge.(AddrTable); ok {
+				snap.Addrs = at.Addrs()
+			}
+			snap.QuarantinedUntil = m.storm.until
+			snap.RedundantUntil = m.redund.until
+			ms = append(ms, snap)
+		}
+		members <- ms
+	}
+	return <-members
+}
+
+// SetFilters sets the rules that filter packets entering and leaving
+// the group. It must be called before Run.
+func (g *Group) SetFilters(rules []Rule) {
+	g.filters = rules
+}
+
+// SetRateLimits sets the limits on packets that the group sends to
+// its members. It must be called before Run.
+func (g *Group) SetRateLimits(limits []RateLimit) {
+	g.limits = limits
+}
+
+// SetStormProtection sets when members are quarantined for sending
+// broadcast storms. It must be called before Run.
+func (g *Group) SetStormProtection(opts StormOptions) {
+	g.storm = opts
+}
+
+// SetLoopDetection sets how long frames are remembered, to detect
+// frames that have gone around a loop. A window of 0 disables loop
+// detection. It must be called before Run.
+func (g *Group) SetLoopDetection(window time.Duration) {
+	g.loops = nil
+	if window > 0 {
+		g.loops = newLoopDetector(window)
+	}
+}
+
+// SetDedupe sets how long frames are remembered, to drop repeats of
+// them. A window of 0 disables this. It must be called before Run.
+func (g *Group) SetDedupe(window time.Duration) {
+	g.dedupe = nil
+	if window > 0 {
+		g.dedupe = newDeduper(window)
+	}
 }
 
 func (g *Group) Run() {
@@ -97,76 +246,185 @@ func (g *Group) Run() {
 	}
 }
 
-func broadcast(pak ethertalk.Packet, send chan<- ethertalk.Packet) func(g *Group) {
+func broadcast(pak ethertalk.Packet, from *member) func(g *Group) {
 	return func(g *Group) {
+		if from.send == nil {
+			return // removed, but not yet stopped
+		}
+		proto := "unknown"
 		switch pak.SNAPProto {
 		case ethertalk.AARPProto:
-			g.logAARPPacket(pak)
+			proto = g.logAARPPacket(pak, from)
 		case ethertalk.AppleTalkProto:
-			g.logAppleTalkPacket(pak)
+			proto = g.logAppleTalkPacket(pak, from)
+		}
+		size := uint64(binary.Size(pak.EthHeader) + int(pak.Size))
+		from.PacketsIn++
+		from.BytesIn += size
+		metrics.PacketsIn.WithLabelValues(from.Kind, proto).Inc()
+		metrics.BytesIn.WithLabelValues(from.Kind, proto).Add(float64(size))
+
+		now := time.Now()
+		if !g.checkLoop(pak, from, now) {
+			metrics.Drops.WithLabelValues(from.Kind, "loop").Inc()
+			return
+		} else if g.dedupe != nil && g.dedupe.duplicate(pak, now) {
+			from.Duplicates++
+			metrics.Drops.WithLabelValues(from.Kind, "duplicate").Inc()
+			return
+		} else if !g.checkStorm(pak, from, now) {
+			metrics.Drops.WithLabelValues(from.Kind, "quarantine").Inc()
+			return
+		}
+
+		var f *frame
+		if len(g.filters) > 0 || len(g.limits) > 0 {
+			f = decodeFrame(pak)
+		}
+		if len(g.filters) > 0 && !filter(g.filters, f, from, true) {
+			metrics.Drops.WithLabelValues(from.Kind, "filter").Inc()
+			return
 		}
-		for _, sendCh := range g.sendCh {
-			if sendCh != send {
-				sendCh <- pak
+		class := ""
+		if len(g.limits) > 0 {
+			class = classify(pak, f)
+		}
+		for _, m := range g.members {
+			if m != from && !m.redund.disabled(now) {
+				if len(g.filters) > 0 && !filter(g.filters, f, m, false) {
+					metrics.Drops.WithLabelValues(m.Kind, "filter").Inc()
+					continue
+				}
+				if b := m.buckets[class]; b != nil && !b.allow(now) {
+					metrics.Drops.WithLabelValues(m.Kind, "rate-limit").Inc()
+					continue
+				}
+				m.PacketsOut++
+				m.BytesOut += size
+				metrics.PacketsOut.WithLabelValues(m.Kind, proto).Inc()
+				metrics.BytesOut.WithLabelValues(m.Kind, proto).Add(float64(size))
+				m.send <- pak
 			}
 		}
 	}
 }
 
-func add(send chan<- ethertalk.Packet) func(g *Group) {
+// Returns false if from is quarantined, counting its broadcasts and
+// quarantining it if they exceed the storm threshold.
+func (g *Group) checkStorm(pak ethertalk.Packet, from *member, now time.Time) bool {
+	if g.storm.Threshold == 0 {
+		return true
+	}
+	log := g.log.With(
+		zap.String("kind", from.Kind),
+		zap.String("addr", from.Addr),
+		zap.Int("id", from.ID),
+	)
+	if from.storm.quarantined(now) {
+		return false
+	} else if !from.storm.until.IsZero() {
+		log.Warn("storm quarantine lifted")
+		from.storm.until = time.Time{}
+	}
+	if pak.Dst[0]&0x01 == 0 {
+		return true // unicast
+	}
+	if from.storm.observe(now, g.storm) {
+		log.With(
+			zap.Int("threshold", g.storm.Threshold),
+			zap.Duration("quarantine", g.storm.Quarantine),
+		).Error("broadcast storm; quarantining member")
+		metrics.Quarantines.WithLabelValues(from.Kind).Inc()
+		return false
+	}
+	return true
+}
+
+// Returns false if pak has gone around a loop, disabling from if it is
+// a redundant link, and enabling it again if it is not.
+func (g *Group) checkLoop(pak ethertalk.Packet, from *member, now time.Time) bool {
+	if g.loops == nil {
+		return true
+	}
+	log := g.log.With(
+		zap.String("kind", from.Kind),
+		zap.String("addr", from.Addr),
+		zap.Int("id", from.ID),
+	)
+	looped := g.loops.looped(fingerprintOf(pak), from, now)
+	if !looped && !from.redund.until.IsZero() {
+		log.Info("enabling redundant link")
+		from.redund.until = time.Time{}
+	}
+	if from.redund.observe(looped, now) {
+		log.With(zap.Duration("hold", redundantHold)).Warn("loop detected; disabling redundant link")
+		metrics.RedundantLinks.WithLabelValues(from.Kind).Inc()
+	}
+	return !looped
+}
+
+func add(m *member) func(g *Group) {
 	return func(g *Group) {
-		g.sendCh = append(g.sendCh, send)
+		m.buckets = buckets(g.limits, m)
+		g.members = append(g.members, m)
+		metrics.Members.WithLabelValues(m.Kind).Inc()
 	}
 }
 
-func remove(send chan<- ethertalk.Packet) func(g *Group) {
+func remove(m *member) func(g *Group) {
 	return func(g *Group) {
-		var newCh []chan<- ethertalk.Packet
-		for _, ch := range g.sendCh {
-			if ch != send {
-				newCh = append(newCh, ch)
+		if m.send == nil {
+			return // already removed
+		}
+		var newMembers []*member
+		for _, other := range g.members {
+			if other != m {
+				newMembers = append(newMembers, other)
 			}
 		}
-		g.sendCh = newCh
-		close(send)
+		g.members = newMembers
+		if g.loops != nil {
+			g.loops.forget(m)
+		}
+		metrics.Members.WithLabelValues(m.Kind).Dec()
+		m.cancel()
+		close(m.send)
+		m.send = nil
 	}
 }
 
-func (g *Group) logAARPPacket(packet ethertalk.Packet) {
-	log := g.log.With(zap.String("protocol", "aarp"))
+// Logs an AARP packet from a member, returning its protocol for metrics.
+// It is logged as part of the member’s bridge, for per-bridge levels.
+func (g *Group) logAARPPacket(packet ethertalk.Packet, from *member) string {
+	log := g.log.With(zap.String("bridge", from.Kind), zap.String("protocol", "aarp"))
 	a := aarp.Packet{}
 	err := aarp.Unmarshal(packet.Payload, &a)
 	if err != nil {
 		log.With(zap.Error(err)).Error("unmarshal failed")
-		return
+		metrics.UnmarshalFailures.WithLabelValues(from.Kind, "aarp").Inc()
+		return "aarp"
 	}
+	metrics.AARPOps.WithLabelValues(aarpOpName(a.Opcode)).Inc()
 
 	if ce := log.Check(zap.DebugLevel, "packet"); ce != nil {
 		ce.Write(
 			zap.String("dst", fmt.Sprintf("%d.%d", a.Dst.Proto.Network, a.Dst.Proto.Node)),
 			zap.String("src", fmt.Sprintf("%d.%d", a.Src.Proto.Network, a.Src.Proto.Node)),
+			zap.String("op", aarpOpName(a.Opcode)),
 		)
-
-		switch a.Opcode {
-		case aarp.RequestOp:
-			ce.Write(zap.String("op", "request"))
-		case aarp.ResponseOp:
-			ce.Write(zap.String("op", "response"))
-		case aarp.ProbeOp:
-			ce.Write(zap.String("op", "probe"))
-		default:
-			ce.Write(zap.Uint16("op", uint16(a.Opcode)))
-		}
 	}
+	return "aarp"
 }
 
-func (g *Group) logAppleTalkPacket(packet ethertalk.Packet) {
-	log := g.log.With(zap.String("protocol", "ddp"))
+// Logs a DDP packet from a member, returning its protocol for metrics.
+func (g *Group) logAppleTalkPacket(packet ethertalk.Packet, from *member) string {
+	log := g.log.With(zap.String("bridge", from.Kind), zap.String("protocol", "ddp"))
 	d := ddp.ExtPacket{}
 	err := ddp.ExtUnmarshal(packet.Payload, &d)
 	if err != nil {
 		log.With(zap.Error(err)).Error("unmarshal failed")
-		return
+		metrics.UnmarshalFailures.WithLabelValues(from.Kind, "ddp").Inc()
+		return "ddp"
 	}
 
 	if ce := log.Check(zap.DebugLevel, "packet"); ce != nil {
@@ -178,26 +436,44 @@ func (g *Group) logAppleTalkPacket(packet ethertalk.Packet) {
 			zap.String("data", hex(d.Data)),
 		)
 	}
+	return ddpProtoName(d.Proto)
+}
+
+func aarpOpName(op aarp.Opcode) string {
+	switch op {
+	case aarp.RequestOp:
+		return "request"
+	case aarp.ResponseOp:
+		return "response"
+	case aarp.ProbeOp:
+		return "probe"
+	default:
+		return strconv.Itoa(int(op))
+	}
 }
 
 func ddpProto(key string, val uint8) zap.Field {
+	return zap.String(key, ddpProtoName(val))
+}
+
+func ddpProtoName(val uint8) string {
 	switch val {
 	case ddp.ProtoRTMPResp:
-		return zap.String("proto", "rtmp/resp")
+		return "rtmp/resp"
 	case ddp.ProtoNBP:
-		return zap.String("proto", "nbp")
+		return "nbp"
 	case ddp.ProtoATP:
-		return zap.String("proto", "atp")
+		return "atp"
 	case ddp.ProtoAEP:
-		return zap.String("proto", "aep")
+		return "aep"
 	case ddp.ProtoRTMPReq:
-		return zap.String("proto", "rtmp/req")
+		return "rtmp/req"
 	case ddp.ProtoZIP:
-		return zap.String("proto", "zip")
+		return "zip"
 	case ddp.ProtoADSP:
-		return zap.String("proto", "adsp")
+		return "adsp"
 	default:
-		return zap.Uint8("proto", val)
+		return strconv.Itoa(int(val))
 	}
 }
 
@@ -0,0 +1,167 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/sfiera/multitalk/internal/logging"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// A member whose packets are sent and received by the test.
+type fakeBridge struct {
+	in  chan ethertalk.Packet // to the group
+	out chan ethertalk.Packet // from the group
+}
+
+func (f *fakeBridge) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	return f.out, f.in
+}
+
+// Starts a group with a fake member of each kind, waiting until all
+// have been added.
+func startGroup(t *testing.T, g *Group, kinds ...string) []*fakeBridge {
+	go g.Run()
+	var fakes []*fakeBridge
+	for _, kind := range kinds {
+		f := &fakeBridge{make(chan ethertalk.Packet), make(chan ethertalk.Packet, 100)}
+		g.Add(context.Background(), zap.NewNop(), kind, kind, f)
+		fakes = append(fakes, f)
+	}
+	for len(g.Members()) < len(kinds) {
+		time.Sleep(time.Millisecond)
+	}
+	return fakes
+}
+
+// Returns an NBP packet from a node, with some data.
+func nbpPacket(t *testing.T, src ethernet.Addr, node ddp.Node, data ...byte) ethertalk.Packet {
+	p, err := ethertalk.AppleTalk(src, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      uint16(13 + len(data)),
+			DstNode:   0xff,
+			DstSocket: 2,
+			SrcNode:   node,
+			SrcSocket: 2,
+			Proto:     ddp.ProtoNBP,
+		},
+		Data: data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *p
+}
+
+// Returns the packets that f receives within a short time.
+func received(f *fakeBridge) []ethertalk.Packet {
+	var paks []ethertalk.Packet
+	for {
+		select {
+		case pak := <-f.out:
+			paks = append(paks, pak)
+		case <-time.After(20 * time.Millisecond):
+			return paks
+		}
+	}
+}
+
+func TestPacketLogLevels(t *testing.T) {
+	assert := assert.New(t)
+	core, logs := observer.New(zap.DebugLevel)
+	levels := logging.NewLevels(zap.InfoLevel)
+	levels.Set("multicast", zap.DebugLevel)
+
+	g := NewGroup(levels.Wrap(zap.New(core)))
+	fakes := startGroup(t, g, "multicast", "serial")
+	fakes[0].in <- nbpPacket(t, ethernet.Addr{0x08, 0, 0x07, 0, 0, 1}, 1, 0x21)
+	fakes[1].in <- nbpPacket(t, ethernet.Addr{0x08, 0, 0x07, 0, 0, 2}, 2, 0x21)
+	assert.Len(received(fakes[1]), 1)
+	assert.Len(received(fakes[0]), 1)
+
+	// Only the packet from the multicast member is logged.
+	entries := logs.FilterMessage("packet").All()
+	if assert.Len(entries, 1) {
+		assert.Equal([]string{"multicast"}, bridgeFields(entries[0]))
+		ctx := entries[0].ContextMap()
+		assert.Equal("nbp", ctx["proto"])
+		assert.Equal("0.1.2", ctx["src"])
+	}
+}
+
+// Returns the values of all bridge fields in a log entry. ContextMap
+// would hide duplicates.
+func bridgeFields(e observer.LoggedEntry) []string {
+	var values []string
+	for _, f := range e.Context {
+		if f.Key == "bridge" {
+			values = append(values, f.String)
+		}
+	}
+	return values
+}
+
+// A member that logs when it starts.
+type loggingBridge struct {
+	fakeBridge
+}
+
+func (l *loggingBridge) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	log.Info("started")
+	return l.fakeBridge.Start(ctx, log)
+}
+
+func TestBridgeLogField(t *testing.T) {
+	assert := assert.New(t)
+	core, logs := observer.New(zap.DebugLevel)
+	log := zap.New(core)
+	g := NewGroup(log)
+	go g.Run()
+
+	l := &loggingBridge{fakeBridge{make(chan ethertalk.Packet), make(chan ethertalk.Packet, 1)}}
+	g.Add(context.Background(), log, "tcp-client", "hub:9000", l)
+	entries := logs.FilterMessage("started").All()
+	if assert.Len(entries, 1) {
+		assert.Equal([]string{"tcp-client"}, bridgeFields(entries[0]))
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+type (
+	// Remembers recent frames, to drop repeats of them, such as from
+	// two LToU interfaces on the same LAN. As with loops, frames are
+	// compared by destination, protocol and payload, but not source.
+	// Frames are checked for loops first, so repeats through another
+	// member only reach the deduper if loop detection is off.
+	deduper struct {
+		window    time.Duration
+		seen      map[fingerprint][]recentFrame
+		lastSweep time.Time
+	}
+
+	recentFrame struct {
+		pak ethertalk.Packet
+		at  time.Time
+	}
+)
+
+func newDeduper(window time.Duration) *deduper {
+	return &deduper{
+		window: window,
+		seen:   map[fingerprint][]recentFrame{},
+	}
+}
+
+// Returns true if an equal frame was seen within the window.
+func (d *deduper) duplicate(pak ethertalk.Packet, now time.Time) bool {
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, frames := range d.seen {
+			var recent []recentFrame
+			for _, f := range frames {
+				if now.Sub(f.at) < d.window {
+					recent = append(recent, f)
+				}
+			}
+			if len(recent) > 0 {
+				d.seen[k] = recent
+			} else {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+
+	h := fingerprintOf(pak)
+	for i, f := range d.seen[h] {
+		if !sameFrame(f.pak, pak) {
+			continue
+		} else if now.Sub(f.at) < d.window {
+			return true
+		}
+		d.seen[h][i].at = now
+		return false
+	}
+	d.seen[h] = append(d.seen[h], recentFrame{pak, now})
+	return false
+}
+
+// Returns true if a and b have the same destination, protocol and
+// payload.
+func sameFrame(a, b ethertalk.Packet) bool {
+	return a.Dst == b.Dst && a.SNAPProto == b.SNAPProto && bytes.Equal(a.Payload, b.Payload)
+}
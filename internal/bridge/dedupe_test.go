@@ -0,0 +1,122 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/pkg/ethernet"
+)
+
+func TestDeduper(t *testing.T) {
+	assert := assert.New(t)
+	d := newDeduper(50 * time.Millisecond)
+	now := time.Unix(1000, 0)
+
+	assert.False(d.duplicate(loopFrame(t, 1), now))
+	assert.True(d.duplicate(loopFrame(t, 1), now.Add(10*time.Millisecond)))
+	assert.False(d.duplicate(loopFrame(t, 2), now.Add(10*time.Millisecond)))
+
+	// Repeats from another source are still duplicates.
+	resourced := loopFrame(t, 1)
+	resourced.Src = ethernet.Addr{0x08, 0x00, 0x07, 0x04, 0x05, 0x06}
+	assert.True(d.duplicate(resourced, now.Add(20*time.Millisecond)))
+
+	// But not repeats to another destination.
+	unicast := loopFrame(t, 1)
+	unicast.Dst = ethernet.Addr{0x08, 0x00, 0x07, 0x04, 0x05, 0x06}
+	assert.False(d.duplicate(unicast, now.Add(20*time.Millisecond)))
+
+	// Repeats after the window get through, and start a new one.
+	now = now.Add(200 * time.Millisecond)
+	assert.False(d.duplicate(loopFrame(t, 1), now))
+	assert.True(d.duplicate(loopFrame(t, 1), now.Add(49*time.Millisecond)))
+	assert.False(d.duplicate(loopFrame(t, 1), now.Add(50*time.Millisecond)))
+
+	// Old frames are swept.
+	d.duplicate(loopFrame(t, 3), now.Add(time.Second))
+	assert.Len(d.seen, 1)
+}
+
+func TestDedupeGroup(t *testing.T) {
+	assert := assert.New(t)
+	g := NewGroup(zap.NewNop())
+	g.SetDedupe(time.Second)
+	fakes := startGroup(t, g, "ethertalk", "multicast", "serial")
+
+	// Two members deliver the same frame, one re-sourced; only the
+	// first is forwarded.
+	fakes[0].in <- loopFrame(t, 1)
+	assert.Len(received(fakes[2]), 1)
+	resourced := loopFrame(t, 1)
+	resourced.Src = ethernet.Addr{0x08, 0x00, 0x07, 0x04, 0x05, 0x06}
+	fakes[1].in <- resourced
+	assert.Empty(received(fakes[0]))
+	assert.Empty(received(fakes[2]))
+	for _, m := range g.Members() {
+		assert.Equal(m.Kind == "multicast", m.Duplicates == 1, m.Kind)
+	}
+}
+
+func TestLoopsBeforeDedupe(t *testing.T) {
+	assert := assert.New(t)
+	g := NewGroup(zap.NewNop())
+	g.SetDedupe(time.Second)
+	g.SetLoopDetection(time.Second)
+	fakes := startGroup(t, g, "ethertalk", "tcp-client", "serial")
+	eth, tcp, serial := fakes[0], fakes[1], fakes[2]
+
+	// Frames sent back around a loop are dropped as loops, not
+	// duplicates, so the link they came back through is disabled.
+	for i := 0; i < redundantLoops; i++ {
+		eth.in <- loopFrame(t, i)
+		assert.Len(received(tcp), 1)
+		assert.Len(received(serial), 1)
+		tcp.in <- loopFrame(t, i)
+		assert.Empty(received(eth))
+		assert.Empty(received(serial))
+	}
+	for _, m := range g.Members() {
+		assert.Equal(m.Kind == "tcp-client", !m.RedundantUntil.IsZero(), m.Kind)
+		assert.Zero(m.Duplicates, m.Kind)
+	}
+	eth.in <- loopFrame(t, 100)
+	assert.Empty(received(tcp))
+	assert.Len(received(serial), 1)
+
+	// Repeats through the same member are still duplicates.
+	eth.in <- loopFrame(t, 100)
+	assert.Empty(received(serial))
+	for _, m := range g.Members() {
+		assert.Equal(m.Kind == "ethertalk", m.Duplicates == 1, m.Kind)
+	}
+}
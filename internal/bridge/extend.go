@@ -29,9 +29,11 @@ package bridge
 
 import (
 	"context"
-	"sync"
 	"fmt"
+	"sync"
+	"time"
 
+	"github.com/sfiera/multitalk/internal/metrics"
 	"github.com/sfiera/multitalk/pkg/aarp"
 	"github.com/sfiera/multitalk/pkg/ddp"
 	"github.com/sfiera/multitalk/pkg/ethernet"
@@ -40,29 +42,84 @@ import (
 	"go.uber.org/zap"
 )
 
-type router struct {
-	network ddp.Network
+type (
+	router struct {
+		network ddp.Network      // of the LocalTalk side
+		cable   ddp.NetworkRange // of the EtherTalk side
 
-	nodes   map[ddp.Node]bool
-	nodesMu sync.Mutex
+		nodes   *AgingTable[ddp.Node] // nodes seen on the LocalTalk side
+		remote  *AgingTable[ddp.Node] // nodes seen on the EtherTalk side
+		nodesMu sync.Mutex
+		occ     *Occupancy
 
-	eth ethernet.Addr
+		// Maps addresses on the EtherTalk side to hardware addresses.
+		resolver *aarp.Resolver
+		aarpCh   chan<- ethertalk.Packet // for resolver requests, set by Start
 
-	bridge Bridge
-}
+		eth  ethernet.Addr
+		kind string // of the group member, for metrics
+		ctx  context.Context
+		log  *zap.Logger
+
+		bridge Bridge
+	}
+
+	// RouterOptions configures a router created by Extend.
+	RouterOptions struct {
+		// The network for nodes on the LocalTalk side, which is
+		// non-extended.
+		Network ddp.Network
+
+		// The network range of the EtherTalk side, for Phase 2.
+		// Nodes in the startup range are also accepted there.
+		// If zero, it is the same network as the LocalTalk side.
+		CableRange ddp.NetworkRange
+
+		// Routers that share an Occupancy answer ENQs for node IDs in
+		// use on each other’s LocalTalk side. If nil, only nodes seen
+		// on the EtherTalk side are defended.
+		Occupancy *Occupancy
+
+		// How long to remember nodes that have not been heard from.
+		// If 0, nodes are remembered forever.
+		TTL time.Duration
+
+		// The kind of group member that the router is added as,
+		// such as "serial", for metrics. If empty, it is "router".
+		Kind string
+	}
+)
 
 // Extend converts a Bridge into an ExtBridge.
 //
-// The provided network is assumed to be the network for nodes on that bridge.
-//
 // TODO: implement router features, so that nodes on the network
 // are properly aware of the network topology.
-func Extend(b Bridge, network ddp.Network, hwAddr []byte) ExtBridge {
+func Extend(b Bridge, hwAddr []byte, opts RouterOptions) ExtBridge {
+	occ := opts.Occupancy
+	if occ == nil {
+		occ = NewOccupancy()
+	}
+	cable := opts.CableRange
+	if cable == (ddp.NetworkRange{}) {
+		cable = ddp.NetworkRange{First: opts.Network, Last: opts.Network}
+	}
+	kind := opts.Kind
+	if kind == "" {
+		kind = "router"
+	}
 	r := router{
-		network: network,
-		nodes:   map[ddp.Node]bool{},
+		network: opts.Network,
+		cable:   cable,
+		nodes:   NewAgingTable[ddp.Node](opts.TTL),
+		remote:  NewAgingTable[ddp.Node](opts.TTL),
+		occ:     occ,
+		kind:    kind,
+		ctx:     context.Background(),
+		log:     zap.NewNop(),
 		bridge:  b,
 	}
+	r.resolver = aarp.NewResolver(r.sendAARP)
+	r.resolver.TTL = opts.TTL
 	copy(r.eth[:], hwAddr)
 	return &r
 }
@@ -71,10 +128,15 @@ func (r *router) Start(ctx context.Context, log *zap.Logger) (
 	send chan<- ethertalk.Packet,
 	recv <-chan ethertalk.Packet,
 ) {
+	r.ctx = ctx
+	r.log = log
+	r.occ.join(r)
+	go r.expire(ctx)
 	sendLLAPOutCh, recvLLAPInCh := r.bridge.Start(ctx, log)
 	sendELAPInCh, sendELAPOutCh := pipe(make(chan ethertalk.Packet))
 	recvELAPInCh, recvELAPOutCh := pipe(make(chan ethertalk.Packet))
-	go r.translateCapture(ctx, log, recvLLAPInCh, recvELAPOutCh)
+	r.aarpCh = recvELAPOutCh
+	go r.translateCapture(ctx, log, recvLLAPInCh, recvELAPOutCh, sendLLAPOutCh)
 	go r.translateTransmit(ctx, log, sendELAPInCh, sendLLAPOutCh, recvELAPOutCh)
 	return sendELAPOutCh, recvELAPInCh
 }
@@ -93,6 +155,7 @@ func (r *router) translateTransmit(
 			continue
 		} else if llap == nil {
 			log.Error(fmt.Sprintf("convert failed: err %v", err))
+			metrics.Drops.WithLabelValues(r.kind, "convert").Inc()
 			continue
 		}
 		llapCh <- *llap
@@ -118,10 +181,78 @@ func (r *router) elapToLLAP(packet ethertalk.Packet) (
 	}
 }
 
+// Returns true if net is the network of the LocalTalk side.
 func (r *router) isLocal(net ddp.Network) bool {
 	return net == 0 || net == r.network
 }
 
+// Returns true if nodes on net can be reached directly on the EtherTalk
+// side, without a router.
+func (r *router) onCable(net ddp.Network) bool {
+	return r.isLocal(net) || r.cable.Contains(net) || ddp.StartupRange.Contains(net)
+}
+
+// Returns the full address of a node, filling in this network if needed.
+func (r *router) addr(net ddp.Network, node ddp.Node) ddp.Addr {
+	if net == 0 {
+		net = r.network
+	}
+	return ddp.Addr{Network: net, Node: node}
+}
+
+// Sends an AARP request from the resolver to the EtherTalk side.
+func (r *router) sendAARP(pak aarp.Packet) error {
+	out, err := ethertalk.AARP(r.eth, pak)
+	if err != nil {
+		return err
+	}
+	select {
+	case r.aarpCh <- *out:
+		return nil
+	case <-r.ctx.Done():
+		return r.ctx.Err()
+	}
+}
+
+// Records that addr is at hw, if it is on the cable.
+// Returns true if it answered one of the resolver’s requests.
+func (r *router) learnHardware(addr ddp.Addr, hw ethernet.Addr) bool {
+	if !r.onCable(addr.Network) || addr.Node == 0 || addr.Node == 255 {
+		return false
+	}
+	return r.resolver.Glean(r.addr(addr.Network, addr.Node), hw)
+}
+
+// Addresses out to the hardware address for dst, if known.
+// Otherwise, it remains broadcast, and if dst is on the cable,
+// it is resolved in the background, to be known next time.
+func (r *router) unicast(out *ethertalk.Packet, src, dst ddp.Addr) {
+	if dst.Node == 255 {
+		return // LLAP broadcast
+	}
+	dst = r.addr(dst.Network, dst.Node)
+	if hw, ok := r.resolver.Lookup(dst); ok {
+		out.Dst = hw
+		return
+	} else if !r.onCable(dst.Network) || r.eth == (ethernet.Addr{}) {
+		return // can’t receive a response
+	} else if r.resolver.Pending(dst) {
+		return
+	}
+
+	// Ask on behalf of the sender, which is on this side.
+	go func() {
+		_, err := r.resolver.Resolve(r.ctx, aarp.AddrPair{
+			Hardware: r.eth,
+			Proto:    r.addr(src.Network, src.Node),
+		}, dst)
+		if err != nil && r.ctx.Err() == nil {
+			r.log.With(zap.Error(err)).Debug("resolve failed",
+				zap.Uint8("node", uint8(dst.Node)))
+		}
+	}()
+}
+
 func (r *router) elapToLLAPDDP(packet ethertalk.Packet) (*llap.Packet, error) {
 	ext := ddp.ExtPacket{}
 	err := ddp.ExtUnmarshal(packet.Payload, &ext)
@@ -129,6 +260,11 @@ func (r *router) elapToLLAPDDP(packet ethertalk.Packet) (*llap.Packet, error) {
 		return nil, err
 	}
 
+	if r.isLocal(ext.SrcNet) {
+		r.markRemoteNode(ext.SrcNode)
+	}
+	r.learnHardware(r.addr(ext.SrcNet, ext.SrcNode), packet.Src)
+
 	if r.isLocal(ext.SrcNet) && r.isLocal(ext.DstNet) {
 		short := ddp.ExtToShort(ext)
 		result, err := llap.AppleTalk(ext.DstNode, ext.SrcNode, short)
@@ -155,20 +291,42 @@ func (r *router) elapToLLAPAARP(packet ethertalk.Packet) (
 		return nil, nil
 	}
 
-	if !r.isLocal(a.Src.Proto.Network) || !r.isLocal(a.Dst.Proto.Network) {
+	if !r.onCable(a.Src.Proto.Network) || !r.onCable(a.Dst.Proto.Network) {
 		return nil, nil
 	}
 
+	// Only addresses on the LocalTalk side’s network can conflict
+	// with LocalTalk node IDs; others are on the cable, but elsewhere.
+	local := r.isLocal(a.Src.Proto.Network) && r.isLocal(a.Dst.Proto.Network)
+	if a.Opcode != aarp.ProbeOp && r.isLocal(a.Src.Proto.Network) {
+		// Probes are tentative, but other senders own their address.
+		r.markRemoteNode(a.Src.Proto.Node)
+	}
+
 	switch a.Opcode {
 	case aarp.ProbeOp:
 		// “Is this AppleTalk node ID in use by anyone?”
+		if !local {
+			return nil, nil
+		}
 		return llap.Enq(a.Dst.Proto.Node, a.Src.Proto.Node), nil
 
 	case aarp.ResponseOp:
+		if r.learnHardware(a.Src.Proto, a.Src.Hardware) && a.Dst.Hardware == r.eth {
+			// The answer to this router’s own request.
+			return nil, nil
+		} else if !local {
+			return nil, nil
+		}
 		// “Yes, sorry, I’m already using that node ID.”
 		return llap.Ack(a.Dst.Proto.Node, a.Src.Proto.Node), nil
 
 	case aarp.RequestOp:
+		r.learnHardware(a.Src.Proto, a.Src.Hardware)
+		if !r.isLocal(a.Dst.Proto.Network) {
+			return nil, nil
+		}
+
 		// Request to map an AppleTalk address to a hardware address (MAC).
 		// Don’t translate to UDP, since there’s no corresponding request.
 		// Check if the target machine is one that has broadcast UDP packets.
@@ -194,13 +352,166 @@ func (r *router) elapToLLAPAARP(packet ethertalk.Packet) (
 func (r *router) isProxyForNode(node ddp.Node) bool {
 	r.nodesMu.Lock()
 	defer r.nodesMu.Unlock()
-	return r.nodes[node]
+	return r.nodes.Has(node)
 }
 
+// Records that node was heard from on the LocalTalk side. If it was
+// last heard from on the EtherTalk side, it has moved (or there are two
+// nodes with the same ID); either way, the latest sighting wins.
 func (r *router) markProxyForNode(node ddp.Node) {
+	r.nodesMu.Lock()
+	if !r.nodes.Touch(node) {
+		r.nodesMu.Unlock()
+		return
+	}
+	log := r.log.With(zap.Uint8("node", uint8(node)))
+	if r.remote.Remove(node) {
+		log.Warn("node moved to LocalTalk side")
+		r.resolver.Forget(ddp.Addr{Network: r.network, Node: node})
+	} else {
+		log.Debug("learned LocalTalk node")
+	}
+	r.updateRemoteNodes()
+	r.nodesMu.Unlock()
+	notify(r.occ.claim(r, node))
+}
+
+// Returns true if node is in use elsewhere on the network,
+// so an ENQ for it from the LocalTalk side should be answered.
+func (r *router) isOccupied(node ddp.Node) bool {
 	r.nodesMu.Lock()
 	defer r.nodesMu.Unlock()
-	r.nodes[node] = true
+	if r.nodes.Has(node) {
+		return false // on this side; it can answer for itself
+	}
+	return r.remote.Has(node) || r.occ.claimedByOther(r, node)
+}
+
+// Tells routers that the nodes claimed by their peers have changed.
+func notify(routers []*router) {
+	for _, r := range routers {
+		r.nodesMu.Lock()
+		r.updateRemoteNodes()
+		r.nodesMu.Unlock()
+	}
+}
+
+// Records that node was heard from on the EtherTalk side.
+func (r *router) markRemoteNode(node ddp.Node) {
+	if node == 0 || node == 255 {
+		return
+	}
+	r.nodesMu.Lock()
+	if !r.remote.Touch(node) {
+		r.nodesMu.Unlock()
+		return
+	}
+	log := r.log.With(zap.Uint8("node", uint8(node)))
+	moved := r.nodes.Remove(node)
+	if moved {
+		log.Warn("node moved to EtherTalk side")
+	} else {
+		log.Debug("learned EtherTalk node")
+	}
+	r.updateRemoteNodes()
+	r.nodesMu.Unlock()
+	if moved {
+		notify(r.occ.release(r, node))
+	}
+}
+
+// Periodically forgets nodes that have not been heard from.
+func (r *router) expire(ctx context.Context) {
+	ticker := time.NewTicker(r.nodes.SweepInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, e := range r.resolver.Expire() {
+			r.log.Debug("expired hardware address", zap.Uint8("node", uint8(e.Proto.Node)))
+		}
+
+		r.nodesMu.Lock()
+		local := r.nodes.Expire()
+		remote := r.remote.Expire()
+		for _, node := range local {
+			r.log.Debug("expired LocalTalk node", zap.Uint8("node", uint8(node)))
+		}
+		for _, node := range remote {
+			r.log.Debug("expired EtherTalk node", zap.Uint8("node", uint8(node)))
+		}
+		if len(local)+len(remote) > 0 {
+			r.updateRemoteNodes()
+		}
+		r.nodesMu.Unlock()
+		for _, node := range local {
+			notify(r.occ.release(r, node))
+		}
+	}
+}
+
+// Tells the bridge which nodes it should answer for, if it can.
+// Called with nodesMu held, so that updates are applied in order.
+func (r *router) updateRemoteNodes() {
+	pb, ok := r.bridge.(ProxyBridge)
+	if !ok {
+		return
+	}
+	set := map[ddp.Node]bool{}
+	for _, node := range r.remote.Keys(nodeLess) {
+		set[node] = true
+	}
+	for _, node := range r.occ.others(r) {
+		set[node] = true
+	}
+	var nodes []ddp.Node
+	for node := 0; node < 256; node++ {
+		if set[ddp.Node(node)] && !r.nodes.Has(ddp.Node(node)) {
+			nodes = append(nodes, ddp.Node(node))
+		}
+	}
+	pb.SetRemoteNodes(nodes)
+}
+
+func nodeLess(a, b ddp.Node) bool { return a < b }
+
+// Nodes returns the LocalTalk nodes that r is proxying for.
+func (r *router) Nodes() []ddp.Node {
+	r.nodesMu.Lock()
+	defer r.nodesMu.Unlock()
+	return r.nodes.Keys(nodeLess)
+}
+
+// Addrs returns the nodes that r has learned on either side.
+func (r *router) Addrs() []LearnedAddr {
+	r.nodesMu.Lock()
+	defer r.nodesMu.Unlock()
+	var addrs []LearnedAddr
+	for _, t := range []struct {
+		side  string
+		table *AgingTable[ddp.Node]
+	}{{"localtalk", r.nodes}, {"ethertalk", r.remote}} {
+		for _, node := range t.table.Keys(nodeLess) {
+			addrs = append(addrs, LearnedAddr{
+				Addr:     fmt.Sprintf("%d.%d", r.network, node),
+				Side:     t.side,
+				LastSeen: t.table.LastSeen(node),
+			})
+		}
+	}
+	for _, e := range r.resolver.Entries() {
+		addrs = append(addrs, LearnedAddr{
+			Addr:     fmt.Sprintf("%d.%d", e.Proto.Network, e.Proto.Node),
+			Hardware: e.Hardware.String(),
+			Side:     "aarp",
+			LastSeen: e.LastSeen,
+		})
+	}
+	return addrs
 }
 
 func (r *router) translateCapture(
@@ -208,13 +519,50 @@ func (r *router) translateCapture(
 	log *zap.Logger,
 	llapCh <-chan llap.Packet,
 	elapCh chan<- ethertalk.Packet,
+	respCh chan<- llap.Packet,
 ) {
+	defer func() { notify(r.occ.leave(r)) }()
 	for packet := range llapCh {
+		switch packet.Kind {
+		case llap.TypeRTS, llap.TypeCTS:
+			// Handshakes for a single transmission on the LocalTalk
+			// side, which mean nothing on the other side of the bridge.
+			metrics.Drops.WithLabelValues(r.kind, llapControlName(packet.Kind)).Inc()
+			continue
+		case llap.TypeEnq:
+			// “Is this node ID in use by anyone?” If it’s in use on
+			// another segment, say so on its behalf.
+			if r.isOccupied(packet.DstNode) {
+				log.Debug("answered ENQ", zap.Uint8("node", uint8(packet.DstNode)))
+				respCh <- *llap.Ack(packet.SrcNode, packet.DstNode)
+				continue
+			}
+		}
 		conv := r.llapToELAP(packet)
-		if conv != nil {
+		if conv == nil {
+			metrics.Drops.WithLabelValues(r.kind, "convert").Inc()
+			continue
+		}
+		if packet.Kind != llap.TypeEnq {
+			// ENQs are tentative, but other senders own their address.
 			r.markProxyForNode(packet.SrcNode)
-			elapCh <- *conv
 		}
+		elapCh <- *conv
+	}
+}
+
+func llapControlName(kind llap.Type) string {
+	switch kind {
+	case llap.TypeEnq:
+		return "enq"
+	case llap.TypeAck:
+		return "ack"
+	case llap.TypeRTS:
+		return "rts"
+	case llap.TypeCTS:
+		return "cts"
+	default:
+		return fmt.Sprintf("%02x", uint8(kind))
 	}
 }
 
@@ -245,6 +593,7 @@ func (r *router) llapToELAPDDP(packet llap.Packet) *ethertalk.Packet {
 	if err != nil {
 		return nil
 	}
+	r.unicast(out, r.addr(ext.SrcNet, ext.SrcNode), r.addr(ext.DstNet, ext.DstNode))
 	return out
 }
 
@@ -258,6 +607,7 @@ func (r *router) llapToELAPExtDDP(packet llap.Packet) *ethertalk.Packet {
 	if err != nil {
 		return nil
 	}
+	r.unicast(out, r.addr(d.SrcNet, d.SrcNode), r.addr(d.DstNet, d.DstNode))
 	return out
 }
 
@@ -0,0 +1,353 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sfiera/multitalk/pkg/aarp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/llap"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// A fakeLLAP is a LocalTalk bridge, which records the nodes that it
+// was asked to answer for.
+type fakeLLAP struct {
+	in  chan llap.Packet // to the router
+	out chan llap.Packet // from the router
+
+	mu    sync.Mutex
+	nodes []ddp.Node
+}
+
+func (f *fakeLLAP) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- llap.Packet,
+	recv <-chan llap.Packet,
+) {
+	return f.out, f.in
+}
+
+func (f *fakeLLAP) SetRemoteNodes(nodes []ddp.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nodes = nodes
+}
+
+func (f *fakeLLAP) remoteNodes() []ddp.Node {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nodes
+}
+
+// A routerTest is a started router with a fake LocalTalk side.
+type routerTest struct {
+	r    *router
+	llap *fakeLLAP
+	send chan<- ethertalk.Packet // EtherTalk side, to the router
+	recv <-chan ethertalk.Packet // EtherTalk side, from the router
+}
+
+var routerHW = ethernet.Addr{0x08, 0x00, 0x07, 0xaa, 0xbb, 0xcc}
+
+func startRouter(t *testing.T, opts RouterOptions) *routerTest {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	f := &fakeLLAP{make(chan llap.Packet), make(chan llap.Packet, 100), sync.Mutex{}, nil}
+	r := Extend(f, routerHW[:], opts).(*router)
+	send, recv := r.Start(ctx, zap.NewNop())
+	return &routerTest{r, f, send, recv}
+}
+
+// Returns the packets sent to the EtherTalk side, until there are none.
+func (rt *routerTest) etherTalk() []ethertalk.Packet {
+	var paks []ethertalk.Packet
+	for {
+		select {
+		case pak := <-rt.recv:
+			paks = append(paks, pak)
+		case <-time.After(20 * time.Millisecond):
+			return paks
+		}
+	}
+}
+
+// Returns the packets sent to the LocalTalk side, until there are none.
+func (rt *routerTest) localTalk() []llap.Packet {
+	var paks []llap.Packet
+	for {
+		select {
+		case pak := <-rt.llap.out:
+			paks = append(paks, pak)
+		case <-time.After(20 * time.Millisecond):
+			return paks
+		}
+	}
+}
+
+// Returns a DDP packet from src to dst, from hw on the EtherTalk side.
+func etherDDP(t *testing.T, hw ethernet.Addr, src, dst ddp.Addr) ethertalk.Packet {
+	pak, err := ethertalk.AppleTalk(hw, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      14,
+			DstNet:    dst.Network,
+			DstNode:   dst.Node,
+			DstSocket: 4,
+			SrcNet:    src.Network,
+			SrcNode:   src.Node,
+			SrcSocket: 4,
+			Proto:     ddp.ProtoAEP,
+		},
+		Data: []byte{0x01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pak
+}
+
+// Returns a short DDP packet from src to dst on the LocalTalk side.
+func localDDP(t *testing.T, src, dst ddp.Node) llap.Packet {
+	pak, err := llap.AppleTalk(dst, src, ddp.Packet{
+		Header: ddp.Header{Size: 6, DstSocket: 4, SrcSocket: 4, Proto: ddp.ProtoAEP},
+		Data:   []byte{0x01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pak
+}
+
+func TestOccupancy(t *testing.T) {
+	assert := assert.New(t)
+	occ := NewOccupancy()
+	a := Extend(&fakeLLAP{}, nil, RouterOptions{Network: 5, Occupancy: occ}).(*router)
+	b := Extend(&fakeLLAP{}, nil, RouterOptions{Network: 5, Occupancy: occ}).(*router)
+	c := Extend(&fakeLLAP{}, nil, RouterOptions{Network: 6, Occupancy: occ}).(*router)
+	for _, r := range []*router{a, b, c} {
+		occ.join(r)
+	}
+
+	// Claims are told to the other routers on the same network, once.
+	assert.Equal([]*router{b}, occ.claim(a, 1))
+	assert.Nil(occ.claim(a, 1))
+	assert.True(occ.claimedByOther(b, 1))
+	assert.False(occ.claimedByOther(a, 1))
+	assert.False(occ.claimedByOther(c, 1))
+	assert.Equal([]ddp.Node{1}, occ.others(b))
+	assert.Nil(occ.others(a))
+	assert.Nil(occ.others(c))
+
+	// The latest claim wins, and only the owner can release it.
+	assert.Equal([]*router{a}, occ.claim(b, 1))
+	assert.Nil(occ.release(a, 1))
+	assert.True(occ.claimedByOther(a, 1))
+	assert.Equal([]*router{a}, occ.release(b, 1))
+	assert.False(occ.claimedByOther(a, 1))
+
+	// Leaving releases all claims.
+	occ.claim(a, 2)
+	occ.claim(a, 3)
+	assert.Equal([]*router{b}, occ.leave(a))
+	assert.Nil(occ.others(b))
+}
+
+func TestRouterEnq(t *testing.T) {
+	assert := assert.New(t)
+	occ := NewOccupancy()
+	a := startRouter(t, RouterOptions{Network: 5, Occupancy: occ})
+	b := startRouter(t, RouterOptions{Network: 5, Occupancy: occ})
+
+	// A node on b’s LocalTalk side is defended on a’s.
+	b.llap.in <- localDDP(t, 0x40, 0xff)
+	assert.Len(b.etherTalk(), 1)
+	assert.Eventually(func() bool {
+		nodes := a.llap.remoteNodes()
+		return len(nodes) == 1 && nodes[0] == 0x40
+	}, time.Second, time.Millisecond)
+	a.llap.in <- *llap.Enq(0x40, 0x40)
+	assert.Equal([]llap.Packet{*llap.Ack(0x40, 0x40)}, a.localTalk())
+	assert.Empty(a.etherTalk())
+
+	// So is a node heard from on the EtherTalk side.
+	a.send <- etherDDP(t, ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x50},
+		ddp.Addr{Network: 5, Node: 0x50}, ddp.Addr{Network: 5, Node: 0xff})
+	assert.Len(a.localTalk(), 1)
+	a.llap.in <- *llap.Enq(0x50, 0x50)
+	assert.Equal([]llap.Packet{*llap.Ack(0x50, 0x50)}, a.localTalk())
+	assert.Empty(a.etherTalk())
+
+	// An unused node ID is probed for on the EtherTalk side.
+	a.llap.in <- *llap.Enq(0x60, 0x60)
+	assert.Empty(a.localTalk())
+	probes := a.etherTalk()
+	if assert.Len(probes, 1) {
+		p := aarp.Packet{}
+		assert.NoError(aarp.Unmarshal(probes[0].Payload, &p))
+		assert.Equal(aarp.Probe(routerHW, ddp.Addr{Network: 5, Node: 0x60}), p)
+	}
+
+	// A node on a’s own side can answer for itself.
+	a.llap.in <- localDDP(t, 0x40, 0xff)
+	assert.Len(a.etherTalk(), 1)
+	a.llap.in <- *llap.Enq(0x40, 0x40)
+	assert.Empty(a.localTalk())
+	assert.Len(a.etherTalk(), 1)
+}
+
+func TestRouterUnicast(t *testing.T) {
+	assert := assert.New(t)
+	rt := startRouter(t, RouterOptions{Network: 5})
+	hw := ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x50}
+
+	// The hardware address of a node is learned from its traffic.
+	rt.send <- etherDDP(t, hw, ddp.Addr{Network: 5, Node: 0x50}, ddp.Addr{Network: 5, Node: 0xff})
+	assert.Len(rt.localTalk(), 1)
+	rt.llap.in <- localDDP(t, 0x10, 0x50)
+	paks := rt.etherTalk()
+	if assert.Len(paks, 1) {
+		assert.Equal(hw, paks[0].Dst)
+		assert.Equal(routerHW, paks[0].Src)
+	}
+
+	// Broadcasts stay broadcast.
+	rt.llap.in <- localDDP(t, 0x10, 0xff)
+	paks = rt.etherTalk()
+	if assert.Len(paks, 1) {
+		assert.Equal(ethertalk.AppleTalkBroadcast, paks[0].Dst)
+	}
+
+	// Packets to an unknown node are broadcast, while it is resolved.
+	rt.llap.in <- localDDP(t, 0x10, 0x60)
+	paks = rt.etherTalk()
+	if assert.Len(paks, 2) {
+		if paks[0].SNAPProto == ethertalk.AARPProto {
+			paks[0], paks[1] = paks[1], paks[0] // sent concurrently
+		}
+		assert.Equal(ethertalk.AppleTalkBroadcast, paks[0].Dst)
+		req := aarp.Packet{}
+		assert.NoError(aarp.Unmarshal(paks[1].Payload, &req))
+		assert.Equal(aarp.Request(aarp.AddrPair{
+			Hardware: routerHW,
+			Proto:    ddp.Addr{Network: 5, Node: 0x10},
+		}, ddp.Addr{Network: 5, Node: 0x60}), req)
+	}
+	hw60 := ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x60}
+	resp, err := ethertalk.AARP(hw60, aarp.Response(
+		aarp.AddrPair{Hardware: hw60, Proto: ddp.Addr{Network: 5, Node: 0x60}},
+		aarp.AddrPair{Hardware: routerHW, Proto: ddp.Addr{Network: 5, Node: 0x10}},
+	))
+	assert.NoError(err)
+	rt.send <- *resp
+	assert.Empty(rt.localTalk())
+	rt.llap.in <- localDDP(t, 0x10, 0x60)
+	paks = rt.etherTalk()
+	if assert.Len(paks, 1) {
+		assert.Equal(hw60, paks[0].Dst)
+	}
+}
+
+func TestRouterRanges(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		opts    RouterOptions
+		net     ddp.Network
+		local   bool
+		onCable bool
+	}{
+		{"same-network", RouterOptions{Network: 5}, 5, true, true},
+		{"same-network-zero", RouterOptions{Network: 5}, 0, true, true},
+		{"same-network-other", RouterOptions{Network: 5}, 6, false, false},
+		{"same-network-startup", RouterOptions{Network: 5}, 0xff00, false, true},
+		{"extended-local", RouterOptions{Network: 1010, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 1010, true, true},
+		{"extended-first", RouterOptions{Network: 1010, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 1000, false, true},
+		{"extended-last", RouterOptions{Network: 1010, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 1009, false, true},
+		{"extended-below", RouterOptions{Network: 1010, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 999, false, false},
+		{"extended-startup", RouterOptions{Network: 1010, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 0xfffe, false, true},
+		{"extended-broadcast", RouterOptions{Network: 1010, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 0xffff, false, false},
+		{"overlapping-local", RouterOptions{Network: 1005, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 1005, true, true},
+		{"overlapping-cable", RouterOptions{Network: 1005, CableRange: ddp.NetworkRange{First: 1000, Last: 1009}}, 1006, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			r := Extend(&fakeLLAP{}, nil, tt.opts).(*router)
+			assert.Equal(tt.local, r.isLocal(tt.net))
+			assert.Equal(tt.onCable, r.onCable(tt.net))
+		})
+	}
+}
+
+// Probes and DDP packets from the EtherTalk side reach the LocalTalk
+// side, and defend node IDs there, only if they are on its network.
+func TestRouterRangeTraffic(t *testing.T) {
+	cable := ddp.NetworkRange{First: 1000, Last: 1009}
+	hw := ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x50}
+	for _, tt := range []struct {
+		name     string
+		opts     RouterOptions
+		src      ddp.Network
+		wantENQ  bool // for a probe from src
+		wantDDP  llap.Type
+		wantNode bool // defended on the LocalTalk side
+	}{
+		{"local", RouterOptions{Network: 1010, CableRange: cable}, 1010, true, llap.TypeDDP, true},
+		{"cable", RouterOptions{Network: 1010, CableRange: cable}, 1003, false, llap.TypeExtDDP, false},
+		{"startup", RouterOptions{Network: 1010, CableRange: cable}, 0xff00, false, llap.TypeExtDDP, false},
+		{"overlapping", RouterOptions{Network: 1005, CableRange: cable}, 1005, true, llap.TypeDDP, true},
+		{"bridged", RouterOptions{Network: 5}, 5, true, llap.TypeDDP, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			rt := startRouter(t, tt.opts)
+			src := ddp.Addr{Network: tt.src, Node: 0x50}
+
+			probe, err := ethertalk.AARP(hw, aarp.Probe(hw, src))
+			assert.NoError(err)
+			rt.send <- *probe
+			if tt.wantENQ {
+				assert.Equal([]llap.Packet{*llap.Enq(0x50, 0x50)}, rt.localTalk())
+			} else {
+				assert.Empty(rt.localTalk())
+			}
+
+			rt.send <- etherDDP(t, hw, src, ddp.Addr{Network: tt.opts.Network, Node: 0x10})
+			paks := rt.localTalk()
+			if assert.Len(paks, 1) {
+				assert.Equal(tt.wantDDP, paks[0].Kind)
+			}
+			nodes := rt.llap.remoteNodes()
+			assert.Equal(tt.wantNode, len(nodes) == 1 && nodes[0] == 0x50)
+		})
+	}
+}
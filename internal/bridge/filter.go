@@ -0,0 +1,383 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/aarp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/nbp"
+)
+
+type (
+	// A Rule allows or denies packets entering or leaving the group
+	// through some members. Rules are written as:
+	//
+	//	allow|deny in|out|both MEMBER [KEY=VALUE...]
+	//
+	// MEMBER is "*", a kind such as "tcp-client", or kind:addr, such as
+	// "tcp-client:hub.example.com:9000". A packet matches if every key
+	// matches; a comma-separated value matches any of its alternatives.
+	// Values containing spaces may be quoted. The keys are:
+	//
+	//	proto                   aarp or ddp
+	//	aarp-op                 request, response or probe
+	//	src-net, dst-net        network or range, such as 1000-1009
+	//	src-node, dst-node      node or range, such as 128-254
+	//	src-socket, dst-socket  socket or range
+	//	ddp-type                DDP type, such as nbp or adsp, or number
+	//	nbp-op                  brrq, lookup, reply or fwdreq
+	//	nbp-object, nbp-type, nbp-zone
+	//	                        NBP name, ignoring case
+	Rule struct {
+		Text    string
+		Allow   bool
+		In, Out bool
+		Member  string
+		matches []matcher
+	}
+
+	// Decoded layers of a packet, to match rules against.
+	frame struct {
+		aarp *aarp.Packet
+		ddp  *ddp.ExtPacket
+		nbp  *nbp.Packet
+	}
+
+	matcher func(f *frame) bool
+)
+
+// ParseRule parses a rule, as described by Rule.
+func ParseRule(text string) (Rule, error) {
+	fields, err := splitFields(text)
+	if err != nil {
+		return Rule{}, fmt.Errorf("parse rule %q: %s", text, err.Error())
+	} else if len(fields) < 3 {
+		return Rule{}, fmt.Errorf("parse rule %q: want action, direction and member", text)
+	}
+	r := Rule{Text: text, Member: fields[2]}
+
+	switch fields[0] {
+	case "allow":
+		r.Allow = true
+	case "deny":
+	default:
+		return Rule{}, fmt.Errorf("parse rule %q: unknown action %q", text, fields[0])
+	}
+
+	switch fields[1] {
+	case "in":
+		r.In = true
+	case "out":
+		r.Out = true
+	case "both":
+		r.In, r.Out = true, true
+	default:
+		return Rule{}, fmt.Errorf("parse rule %q: unknown direction %q", text, fields[1])
+	}
+
+	for _, field := range fields[3:] {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return Rule{}, fmt.Errorf("parse rule %q: want key=value, not %q", text, field)
+		}
+		m, err := parseMatch(key, strings.Split(value, ","))
+		if err != nil {
+			return Rule{}, fmt.Errorf("parse rule %q: %s: %s", text, key, err.Error())
+		}
+		r.matches = append(r.matches, m)
+	}
+	return r, nil
+}
+
+// Splits text on spaces, except within double quotes.
+func splitFields(text string) ([]string, error) {
+	var fields []string
+	field, inField, quoted := strings.Builder{}, false, false
+	for _, c := range text {
+		switch {
+		case c == '"':
+			quoted, inField = !quoted, true
+		case c == ' ' || c == '\t':
+			if quoted {
+				field.WriteRune(c)
+			} else if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(c)
+			inField = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated quote")
+	} else if inField {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func parseMatch(key string, values []string) (matcher, error) {
+	switch key {
+	case "proto":
+		for _, v := range values {
+			if v != "aarp" && v != "ddp" {
+				return nil, fmt.Errorf("unknown protocol %q", v)
+			}
+		}
+		return func(f *frame) bool {
+			return (f.aarp != nil && contains(values, "aarp")) ||
+				(f.ddp != nil && contains(values, "ddp"))
+		}, nil
+
+	case "aarp-op":
+		ops, err := parseNames(values, map[string]int{
+			"request":  int(aarp.RequestOp),
+			"response": int(aarp.ResponseOp),
+			"probe":    int(aarp.ProbeOp),
+		}, 0xffff)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) bool {
+			return f.aarp != nil && ops[int(f.aarp.Opcode)]
+		}, nil
+
+	case "src-net", "dst-net":
+		var ranges []ddp.NetworkRange
+		for _, v := range values {
+			r, err := ddp.ParseNetworkRange(v)
+			if err != nil {
+				return nil, err
+			}
+			ranges = append(ranges, r)
+		}
+		src := key == "src-net"
+		return func(f *frame) bool {
+			if f.ddp == nil {
+				return false
+			}
+			net := f.ddp.DstNet
+			if src {
+				net = f.ddp.SrcNet
+			}
+			for _, r := range ranges {
+				if r.Contains(net) {
+					return true
+				}
+			}
+			return false
+		}, nil
+
+	case "src-node", "dst-node", "src-socket", "dst-socket":
+		ns, err := parseRanges(values, 0xff)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) bool {
+			if f.ddp == nil {
+				return false
+			}
+			switch key {
+			case "src-node":
+				return ns[int(f.ddp.SrcNode)]
+			case "dst-node":
+				return ns[int(f.ddp.DstNode)]
+			case "src-socket":
+				return ns[int(f.ddp.SrcSocket)]
+			default:
+				return ns[int(f.ddp.DstSocket)]
+			}
+		}, nil
+
+	case "ddp-type":
+		types := map[string]int{}
+		for t := 0; t <= 0xff; t++ {
+			types[ddpProtoName(uint8(t))] = t
+		}
+		ts, err := parseNames(values, types, 0xff)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) bool {
+			return f.ddp != nil && ts[int(f.ddp.Proto)]
+		}, nil
+
+	case "nbp-op":
+		ops, err := parseNames(values, map[string]int{
+			"brrq":   int(nbp.FunctionBrRq),
+			"lookup": int(nbp.FunctionLkUp),
+			"reply":  int(nbp.FunctionLkUpReply),
+			"fwdreq": int(nbp.FunctionFwdReq),
+		}, 0x0f)
+		if err != nil {
+			return nil, err
+		}
+		return func(f *frame) bool {
+			return f.nbp != nil && ops[int(f.nbp.Function)]
+		}, nil
+
+	case "nbp-object", "nbp-type", "nbp-zone":
+		return func(f *frame) bool {
+			if f.nbp == nil {
+				return false
+			}
+			for _, t := range f.nbp.Tuples {
+				name := t.Zone
+				switch key {
+				case "nbp-object":
+					name = t.Object
+				case "nbp-type":
+					name = t.Type
+				}
+				for _, v := range values {
+					if strings.EqualFold(name, v) {
+						return true
+					}
+				}
+			}
+			return false
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown key")
+}
+
+// Parses names, or numbers up to max, into a set of numbers.
+func parseNames(values []string, names map[string]int, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, v := range values {
+		if n, ok := names[v]; ok {
+			set[n] = true
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > max {
+			return nil, fmt.Errorf("unknown value %q", v)
+		}
+		set[n] = true
+	}
+	return set, nil
+}
+
+// Parses numbers or ranges of them, such as 128-254, into a set.
+func parseRanges(values []string, max int) (map[int]bool, error) {
+	set := map[int]bool{}
+	for _, v := range values {
+		first, last, ok := strings.Cut(v, "-")
+		if !ok {
+			last = first
+		}
+		f, err1 := strconv.Atoi(first)
+		l, err2 := strconv.Atoi(last)
+		if err1 != nil || err2 != nil || f < 0 || f > l || l > max {
+			return nil, fmt.Errorf("invalid range %q", v)
+		}
+		for n := f; n <= l; n++ {
+			set[n] = true
+		}
+	}
+	return set, nil
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the rule applies to m.
+func (r *Rule) appliesTo(m *member) bool {
+	return memberMatches(r.Member, m)
+}
+
+// Returns true if pattern is "*", m's kind, or m's kind:addr.
+func memberMatches(pattern string, m *member) bool {
+	return pattern == "*" || pattern == m.Kind || pattern == m.Kind+":"+m.Addr
+}
+
+// Decodes the layers of a packet that rules can match.
+// Undecodable layers are left nil, and match no keys about them.
+func decodeFrame(pak ethertalk.Packet) *frame {
+	f := &frame{}
+	switch pak.SNAPProto {
+	case ethertalk.AARPProto:
+		a := aarp.Packet{}
+		if aarp.Unmarshal(pak.Payload, &a) == nil {
+			f.aarp = &a
+		}
+	case ethertalk.AppleTalkProto:
+		d := ddp.ExtPacket{}
+		if ddp.ExtUnmarshal(pak.Payload, &d) != nil {
+			break
+		}
+		f.ddp = &d
+		n := nbp.Packet{}
+		if d.Proto == ddp.ProtoNBP && nbp.Unmarshal(d.Data, &n) == nil {
+			f.nbp = &n
+		}
+	}
+	return f
+}
+
+// Returns false if the first rule that matches a packet passing through
+// m in the given direction denies it. Packets that match no rule are
+// allowed.
+func filter(rules []Rule, f *frame, m *member, in bool) bool {
+	direction := "out"
+	if in {
+		direction = "in"
+	}
+	for i := range rules {
+		r := &rules[i]
+		if (in && !r.In) || (!in && !r.Out) || !r.appliesTo(m) {
+			continue
+		}
+		matched := true
+		for _, match := range r.matches {
+			if !match(f) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			metrics.FilterMatches.WithLabelValues(r.Text, direction).Inc()
+			return r.Allow
+		}
+	}
+	return true
+}
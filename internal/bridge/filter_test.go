@@ -0,0 +1,340 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/pkg/aarp"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/nbp"
+)
+
+var testSrc = ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}
+
+// Returns a DDP packet from 10.20:30 to 40.50:60.
+func ddpFrame(t *testing.T, proto uint8, data []byte) ethertalk.Packet {
+	p, err := ethertalk.AppleTalk(testSrc, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      uint16(13 + len(data)),
+			DstNet:    40,
+			DstNode:   50,
+			DstSocket: 60,
+			SrcNet:    10,
+			SrcNode:   20,
+			SrcSocket: 30,
+			Proto:     proto,
+		},
+		Data: data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *p
+}
+
+func nbpFrame(t *testing.T, fn nbp.Function, e nbp.Entity) ethertalk.Packet {
+	data, err := nbp.Marshal(nbp.Packet{Function: fn, Tuples: []nbp.Tuple{{Entity: e}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ddpFrame(t, ddp.ProtoNBP, data)
+}
+
+func aarpFrame(t *testing.T, op aarp.Opcode) ethertalk.Packet {
+	pak := aarp.Request(aarp.AddrPair{Hardware: testSrc}, ddp.Addr{Network: 10, Node: 20})
+	pak.Opcode = op
+	p, err := ethertalk.AARP(testSrc, pak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *p
+}
+
+func TestParseRule(t *testing.T) {
+	cases := []struct {
+		name    string
+		text    string
+		want    Rule
+		matches int
+		err     string
+	}{{
+		name: "allow",
+		text: "allow in *",
+		want: Rule{Text: "allow in *", Allow: true, In: true, Member: "*"},
+	}, {
+		name: "deny",
+		text: "deny out tcp-client:hub.example.com:9000",
+		want: Rule{Text: "deny out tcp-client:hub.example.com:9000", Out: true, Member: "tcp-client:hub.example.com:9000"},
+	}, {
+		name:    "both",
+		text:    "deny\tboth  serial proto=ddp ddp-type=nbp,atp",
+		want:    Rule{Text: "deny\tboth  serial proto=ddp ddp-type=nbp,atp", In: true, Out: true, Member: "serial"},
+		matches: 2,
+	}, {
+		name:    "quoted",
+		text:    `deny in * nbp-object="Office Printer" nbp-type=LaserWriter`,
+		want:    Rule{Text: `deny in * nbp-object="Office Printer" nbp-type=LaserWriter`, In: true, Member: "*"},
+		matches: 2,
+	}, {
+		name:    "all-keys",
+		text:    "deny in * proto=aarp aarp-op=probe,3 src-net=1-9 dst-net=10 src-node=128-254 dst-node=255 src-socket=1 dst-socket=2-3 ddp-type=7 nbp-op=lookup,2 nbp-zone=Zone",
+		matches: 11,
+	}, {
+		name: "empty",
+		text: "",
+		err:  "want action, direction and member",
+	}, {
+		name: "no-member",
+		text: "allow in",
+		err:  "want action, direction and member",
+	}, {
+		name: "action",
+		text: "permit in *",
+		err:  `unknown action "permit"`,
+	}, {
+		name: "direction",
+		text: "allow sideways *",
+		err:  `unknown direction "sideways"`,
+	}, {
+		name: "no-value",
+		text: "allow in * proto",
+		err:  `want key=value, not "proto"`,
+	}, {
+		name: "key",
+		text: "allow in * color=red",
+		err:  "color: unknown key",
+	}, {
+		name: "proto",
+		text: "allow in * proto=ipx",
+		err:  `proto: unknown protocol "ipx"`,
+	}, {
+		name: "aarp-op",
+		text: "allow in * aarp-op=gleam",
+		err:  `aarp-op: unknown value "gleam"`,
+	}, {
+		name: "nbp-op",
+		text: "allow in * nbp-op=16",
+		err:  `nbp-op: unknown value "16"`,
+	}, {
+		name: "ddp-type",
+		text: "allow in * ddp-type=256",
+		err:  `ddp-type: unknown value "256"`,
+	}, {
+		name: "net",
+		text: "allow in * src-net=x",
+		err:  "src-net: ",
+	}, {
+		name: "node",
+		text: "allow in * dst-node=300",
+		err:  `dst-node: invalid range "300"`,
+	}, {
+		name: "reversed",
+		text: "allow in * src-socket=5-3",
+		err:  `src-socket: invalid range "5-3"`,
+	}, {
+		name: "unterminated",
+		text: `allow in * nbp-object="Office`,
+		err:  "unterminated quote",
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			r, err := ParseRule(c.text)
+			if c.err != "" {
+				if assert.Error(err) {
+					assert.Contains(err.Error(), c.err)
+				}
+				return
+			}
+			assert.NoError(err)
+			assert.Len(r.matches, c.matches)
+			if c.want.Text != "" {
+				r.matches = nil
+				assert.Equal(c.want, r)
+			}
+		})
+	}
+}
+
+func TestRuleMatches(t *testing.T) {
+	printer := nbp.Entity{Object: "Office Printer", Type: "LaserWriter", Zone: "*"}
+	cases := []struct {
+		name  string
+		match string
+		pak   ethertalk.Packet
+		want  bool
+	}{
+		{"proto-ddp", "proto=ddp", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"proto-aarp", "proto=aarp", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), false},
+		{"proto-any", "proto=aarp,ddp", aarpFrame(t, aarp.ProbeOp), true},
+		{"aarp-op", "aarp-op=probe", aarpFrame(t, aarp.ProbeOp), true},
+		{"aarp-op-other", "aarp-op=request,response", aarpFrame(t, aarp.ProbeOp), false},
+		{"aarp-op-ddp", "aarp-op=probe", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), false},
+		{"src-net", "src-net=5-15", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"dst-net", "dst-net=5-15", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), false},
+		{"src-node", "src-node=20", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"dst-node", "dst-node=1-49,51", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), false},
+		{"src-socket", "src-socket=30", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"dst-socket", "dst-socket=60-61", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"net-aarp", "src-net=1-65534", aarpFrame(t, aarp.RequestOp), false},
+		{"ddp-type", "ddp-type=atp", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"ddp-type-number", "ddp-type=3", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), true},
+		{"ddp-type-other", "ddp-type=nbp", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), false},
+		{"nbp-op", "nbp-op=lookup", nbpFrame(t, nbp.FunctionLkUp, printer), true},
+		{"nbp-op-other", "nbp-op=brrq,reply", nbpFrame(t, nbp.FunctionLkUp, printer), false},
+		{"nbp-op-atp", "nbp-op=lookup", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), false},
+		{"nbp-object", `nbp-object="office printer"`, nbpFrame(t, nbp.FunctionLkUp, printer), true},
+		{"nbp-type", "nbp-type=AFPServer,laserwriter", nbpFrame(t, nbp.FunctionLkUp, printer), true},
+		{"nbp-zone", "nbp-zone=Home", nbpFrame(t, nbp.FunctionLkUp, printer), false},
+		{"nbp-invalid", "nbp-op=lookup", ddpFrame(t, ddp.ProtoNBP, []byte{0x21}), false},
+		{"all", "proto=ddp ddp-type=nbp nbp-type=LaserWriter", nbpFrame(t, nbp.FunctionLkUp, printer), true},
+		{"not-all", "proto=ddp ddp-type=nbp nbp-zone=Home", nbpFrame(t, nbp.FunctionLkUp, printer), false},
+	}
+
+	m := &member{Member: Member{Kind: "serial"}}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := ParseRule("deny in * " + c.match)
+			if err != nil {
+				t.Fatal(err)
+			}
+			allowed := filter([]Rule{r}, decodeFrame(c.pak), m, true)
+			assert.Equal(t, c.want, !allowed)
+		})
+	}
+}
+
+func TestFilter(t *testing.T) {
+	rules := []Rule{}
+	for _, text := range []string{
+		"allow in tcp-client:hub.example.com:9000 nbp-op=lookup",
+		"deny in tcp-client nbp-op=lookup,reply",
+		"deny out serial ddp-type=nbp",
+		"deny both multicast",
+	} {
+		r, err := ParseRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+
+	hub := &member{Member: Member{Kind: "tcp-client", Addr: "hub.example.com:9000"}}
+	other := &member{Member: Member{Kind: "tcp-client", Addr: "other.example.com:9000"}}
+	serial := &member{Member: Member{Kind: "serial", Addr: "/dev/ttyUSB0"}}
+	multicast := &member{Member: Member{Kind: "multicast", Addr: "239.192.76.84:1954"}}
+	lookup := decodeFrame(nbpFrame(t, nbp.FunctionLkUp, nbp.Entity{Object: "=", Type: "=", Zone: "*"}))
+	reply := decodeFrame(nbpFrame(t, nbp.FunctionLkUpReply, nbp.Entity{Object: "Mac", Type: "AFPServer", Zone: "*"}))
+	atp := decodeFrame(ddpFrame(t, ddp.ProtoATP, []byte{0x01}))
+
+	cases := []struct {
+		name string
+		f    *frame
+		m    *member
+		in   bool
+		want bool
+	}{
+		{"first-match", lookup, hub, true, true},
+		{"second-match", reply, hub, true, false},
+		{"kind", lookup, other, true, false},
+		{"unmatched", atp, other, true, true},
+		{"out-only", lookup, serial, false, false},
+		{"out-only-in", lookup, serial, true, true},
+		{"in-only-out", reply, other, false, true},
+		{"both-in", atp, multicast, true, false},
+		{"both-out", atp, multicast, false, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, filter(rules, c.f, c.m, c.in))
+		})
+	}
+}
+
+func TestGroupFilters(t *testing.T) {
+	assert := assert.New(t)
+	g := NewGroup(zap.NewNop())
+	rules := []Rule{}
+	for _, text := range []string{
+		"deny in serial nbp-op=lookup",
+		"deny out multicast ddp-type=nbp",
+	} {
+		r, err := ParseRule(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rules = append(rules, r)
+	}
+	g.SetFilters(rules)
+	fakes := startGroup(t, g, "serial", "multicast", "ethertalk")
+	lookup := nbpFrame(t, nbp.FunctionLkUp, nbp.Entity{Object: "=", Type: "=", Zone: "*"})
+	reply := nbpFrame(t, nbp.FunctionLkUpReply, nbp.Entity{Object: "Mac", Type: "AFPServer", Zone: "*"})
+	atp := ddpFrame(t, ddp.ProtoATP, []byte{0x01})
+
+	// Denied on the way in, so no member receives it.
+	fakes[0].in <- lookup
+	assert.Empty(received(fakes[1]))
+	assert.Empty(received(fakes[2]))
+
+	// Denied on the way out, to the multicast member only.
+	fakes[0].in <- reply
+	assert.Empty(received(fakes[1]))
+	assert.Len(received(fakes[2]), 1)
+
+	fakes[0].in <- atp
+	assert.Len(received(fakes[1]), 1)
+	assert.Len(received(fakes[2]), 1)
+}
+
+func TestClassify(t *testing.T) {
+	unicast := ddpFrame(t, ddp.ProtoATP, []byte{0x01})
+	unicast.Dst = ethernet.Addr{0x08, 0x00, 0x07, 0x04, 0x05, 0x06}
+	cases := []struct {
+		name string
+		pak  ethertalk.Packet
+		want string
+	}{
+		{"aarp", aarpFrame(t, aarp.RequestOp), ClassAARP},
+		{"nbp-brrq", nbpFrame(t, nbp.FunctionBrRq, nbp.Entity{Object: "=", Type: "=", Zone: "Zone"}), ClassNBPBrRq},
+		{"nbp-lookup", nbpFrame(t, nbp.FunctionLkUp, nbp.Entity{Object: "=", Type: "=", Zone: "*"}), ClassBroadcast},
+		{"broadcast", ddpFrame(t, ddp.ProtoATP, []byte{0x01}), ClassBroadcast},
+		{"unicast", unicast, ClassUnicast},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, classify(c.pak, decodeFrame(c.pak)))
+		})
+	}
+}
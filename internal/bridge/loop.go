@@ -0,0 +1,148 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"time"
+
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// Loops, such as two instances connected by TCP that also share an
+// Ethernet, or three TCP peers in a triangle, are detected by
+// fingerprinting frames. A frame that enters the group through one
+// member and then again through another within the loop window has gone
+// around a loop, and is dropped.
+//
+// A member whose frames have all gone around loops is a redundant link,
+// and is disabled: the group stops sending to it, and drops its looped
+// frames. If it delivers a frame that no other member has, or after
+// redundantHold, it is enabled again.
+const (
+	// A member is redundant if it delivers at least this many looped
+	// frames, and no others, in a redundantWindow.
+	redundantLoops  = 10
+	redundantWindow = 10 * time.Second
+	redundantHold   = time.Minute
+)
+
+type (
+	fingerprint uint64
+
+	// Remembers which member each recent frame first entered through.
+	loopDetector struct {
+		window    time.Duration
+		seen      map[fingerprint]sighting
+		lastSweep time.Time
+	}
+
+	sighting struct {
+		from *member
+		at   time.Time
+	}
+
+	// Counts a member’s looped and unlooped frames.
+	redundancy struct {
+		windowStart    time.Time
+		loops, uniques int
+		until          time.Time // end of disablement, if any
+	}
+)
+
+func newLoopDetector(window time.Duration) *loopDetector {
+	return &loopDetector{
+		window: window,
+		seen:   map[fingerprint]sighting{},
+	}
+}
+
+// Returns the fingerprint of a frame. Frames are compared by their
+// destination, protocol and payload, so Phase 1 and Phase 2 framings of
+// the same frame have the same fingerprint, as do copies whose source
+// address was rewritten on the way around the loop.
+func fingerprintOf(pak ethertalk.Packet) fingerprint {
+	h := fnv.New64a()
+	h.Write(pak.Dst[:])
+	h.Write(pak.SNAPProto.OUI[:])
+	_ = binary.Write(h, binary.BigEndian, pak.SNAPProto.Proto)
+	h.Write(pak.Payload)
+	return fingerprint(h.Sum64())
+}
+
+// Returns true if a frame from m has already entered the group through
+// another member within the window.
+func (d *loopDetector) looped(fp fingerprint, m *member, now time.Time) bool {
+	if now.Sub(d.lastSweep) >= d.window {
+		for k, s := range d.seen {
+			if now.Sub(s.at) >= d.window {
+				delete(d.seen, k)
+			}
+		}
+		d.lastSweep = now
+	}
+	s, ok := d.seen[fp]
+	if ok && s.from != m && now.Sub(s.at) < d.window {
+		return true
+	}
+	d.seen[fp] = sighting{m, now}
+	return false
+}
+
+// Forgets the frames that entered through m, which has been removed, so
+// that they are not taken as loops if they arrive through another.
+func (d *loopDetector) forget(m *member) {
+	for k, s := range d.seen {
+		if s.from == m {
+			delete(d.seen, k)
+		}
+	}
+}
+
+// Counts a frame from a member, returning true if the member has just
+// become redundant.
+func (r *redundancy) observe(looped bool, now time.Time) bool {
+	if now.Sub(r.windowStart) >= redundantWindow {
+		r.windowStart, r.loops, r.uniques = now, 0, 0
+	}
+	if looped {
+		r.loops++
+	} else {
+		r.uniques++
+	}
+	if r.uniques == 0 && r.loops >= redundantLoops && !r.disabled(now) {
+		r.until = now.Add(redundantHold)
+		return true
+	}
+	return false
+}
+
+func (r *redundancy) disabled(now time.Time) bool {
+	return now.Before(r.until)
+}
@@ -0,0 +1,226 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// Returns the i'th of a series of distinct frames.
+func loopFrame(t *testing.T, i int) ethertalk.Packet {
+	return nbpPacket(t, testSrc, 1, byte(i>>8), byte(i))
+}
+
+func TestFingerprint(t *testing.T) {
+	assert := assert.New(t)
+	pak := loopFrame(t, 1)
+
+	// The source may be rewritten on the way around a loop.
+	resourced := loopFrame(t, 1)
+	resourced.Src = ethernet.Addr{0x08, 0x00, 0x07, 0x04, 0x05, 0x06}
+	assert.Equal(fingerprintOf(pak), fingerprintOf(resourced))
+
+	unicast := loopFrame(t, 1)
+	unicast.Dst = ethernet.Addr{0x08, 0x00, 0x07, 0x04, 0x05, 0x06}
+	assert.NotEqual(fingerprintOf(pak), fingerprintOf(unicast))
+	assert.NotEqual(fingerprintOf(pak), fingerprintOf(loopFrame(t, 2)))
+}
+
+func TestLoopDetector(t *testing.T) {
+	assert := assert.New(t)
+	d := newLoopDetector(2 * time.Second)
+	a := &member{send: make(chan ethertalk.Packet)}
+	b := &member{send: make(chan ethertalk.Packet)}
+	fp := fingerprintOf(loopFrame(t, 1))
+	now := time.Unix(1000, 0)
+
+	assert.False(d.looped(fp, a, now))
+	assert.True(d.looped(fp, b, now.Add(time.Second)))
+	// Repeats through the same member are not loops.
+	assert.False(d.looped(fp, a, now.Add(time.Second)))
+
+	// Nor are frames seen again after the window.
+	now = now.Add(3 * time.Second)
+	assert.False(d.looped(fp, b, now))
+	assert.True(d.looped(fp, a, now))
+
+	// Nor frames first seen through a member since removed.
+	assert.False(d.looped(fingerprintOf(loopFrame(t, 2)), b, now))
+	d.forget(b)
+	assert.False(d.looped(fingerprintOf(loopFrame(t, 2)), a, now))
+	assert.Len(d.seen, 1)
+	d.forget(a)
+	assert.Empty(d.seen)
+}
+
+func TestLoopTriangle(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		dedupe time.Duration
+	}{
+		{"loops", 0},
+		// Even if the deduper remembers frames for longer, it must not
+		// hide loops from the loop detector.
+		{"dedupe", 5 * time.Second},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			g := NewGroup(zap.NewNop())
+			g.SetLoopDetection(2 * time.Second)
+			g.SetDedupe(tt.dedupe)
+			fakes := startGroup(t, g, "ethertalk", "tcp-client", "tcp-server")
+			eth, left, right := fakes[0], fakes[1], fakes[2]
+
+			// A frame from the Ethernet goes to both peers, which are
+			// also connected to each other, and so each sends it back.
+			eth.in <- loopFrame(t, 1)
+			assert.Len(received(left), 1)
+			assert.Len(received(right), 1)
+			left.in <- loopFrame(t, 1)
+			right.in <- loopFrame(t, 1)
+			assert.Empty(received(eth))
+			assert.Empty(received(left))
+			assert.Empty(received(right))
+			for _, m := range g.Members() {
+				assert.Zero(m.Duplicates, m.Kind)
+			}
+		})
+	}
+}
+
+func TestLoopRemovedMember(t *testing.T) {
+	assert := assert.New(t)
+	g := NewGroup(zap.NewNop())
+	g.SetLoopDetection(2 * time.Second)
+	fakes := startGroup(t, g, "ethertalk", "tcp-client", "serial")
+	eth, tcp, serial := fakes[0], fakes[1], fakes[2]
+
+	// Once the member a frame entered through is removed, the frame
+	// is forwarded if it arrives through another.
+	eth.in <- loopFrame(t, 1)
+	assert.Len(received(tcp), 1)
+	assert.Len(received(serial), 1)
+	for _, m := range g.Members() {
+		if m.Kind == "ethertalk" {
+			assert.True(g.Remove(m.ID))
+		}
+	}
+	assert.Empty(g.loops.seen)
+	tcp.in <- loopFrame(t, 1)
+	assert.Len(received(serial), 1)
+}
+
+func TestLoopTwoPaths(t *testing.T) {
+	assert := assert.New(t)
+	g := NewGroup(zap.NewNop())
+	g.SetLoopDetection(2 * time.Second)
+	fakes := startGroup(t, g, "ethertalk", "tcp-client", "serial")
+	eth, tcp, serial := fakes[0], fakes[1], fakes[2]
+
+	// Another instance shares the Ethernet, and is connected by TCP, so
+	// its frames arrive twice. Only the first is forwarded.
+	eth.in <- loopFrame(t, 1)
+	assert.Len(received(tcp), 1)
+	assert.Len(received(serial), 1)
+	tcp.in <- loopFrame(t, 1)
+	assert.Empty(received(eth))
+	assert.Empty(received(serial))
+
+	// Frames with no second path are forwarded.
+	tcp.in <- loopFrame(t, 2)
+	assert.Len(received(eth), 1)
+	assert.Len(received(serial), 1)
+}
+
+func TestLoopRedundantLink(t *testing.T) {
+	assert := assert.New(t)
+	g := NewGroup(zap.NewNop())
+	g.SetLoopDetection(2 * time.Second)
+	fakes := startGroup(t, g, "ethertalk", "tcp-client", "serial")
+	eth, tcp, serial := fakes[0], fakes[1], fakes[2]
+
+	// A link that only delivers looped frames is disabled.
+	for i := 0; i < redundantLoops; i++ {
+		eth.in <- loopFrame(t, i)
+		assert.Len(received(tcp), 1)
+		assert.Len(received(serial), 1)
+		tcp.in <- loopFrame(t, i)
+		assert.Empty(received(eth))
+		assert.Empty(received(serial))
+	}
+	for _, m := range g.Members() {
+		assert.Equal(m.Kind == "tcp-client", !m.RedundantUntil.IsZero(), m.Kind)
+	}
+	eth.in <- loopFrame(t, 100)
+	assert.Empty(received(tcp))
+	assert.Len(received(serial), 1)
+
+	// Until it delivers a frame that no other member has.
+	tcp.in <- loopFrame(t, 101)
+	assert.Len(received(eth), 1)
+	assert.Len(received(serial), 1)
+	for _, m := range g.Members() {
+		assert.True(m.RedundantUntil.IsZero(), m.Kind)
+	}
+	eth.in <- loopFrame(t, 102)
+	assert.Len(received(tcp), 1)
+	assert.Len(received(serial), 1)
+}
+
+func TestRedundancy(t *testing.T) {
+	assert := assert.New(t)
+	r := &redundancy{}
+	now := time.Unix(1000, 0)
+
+	// A unique frame in the window keeps the link enabled.
+	assert.False(r.observe(false, now))
+	for i := 0; i < redundantLoops; i++ {
+		assert.False(r.observe(true, now))
+	}
+	assert.False(r.disabled(now))
+
+	// In a new window, only looped frames disable it, once.
+	now = now.Add(redundantWindow)
+	for i := 1; i < redundantLoops; i++ {
+		assert.False(r.observe(true, now))
+	}
+	assert.True(r.observe(true, now))
+	assert.False(r.observe(true, now))
+	assert.True(r.disabled(now))
+
+	// For the hold time.
+	assert.True(r.disabled(now.Add(redundantHold - time.Nanosecond)))
+	assert.False(r.disabled(now.Add(redundantHold)))
+}
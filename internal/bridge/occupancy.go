@@ -0,0 +1,136 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"sync"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+// Occupancy tracks which node IDs are in use on the LocalTalk side of
+// each router that shares it, so that routers can defend node IDs in use
+// on each other’s segments.
+//
+// LLAP expects an ACK to an ENQ within the interframe gap, which is too
+// soon for an ACK sent from here over serial or UDP. What makes node ID
+// claiming reliable is the node mask of a TashTalk adapter, which answers
+// in time; see ProxyBridge. ACKs sent by the router are a fallback for
+// slower LocalTalk links, such as LToU.
+type Occupancy struct {
+	mu      sync.Mutex
+	owners  map[ddp.Addr]*router
+	routers map[*router]bool
+}
+
+// NewOccupancy returns an empty Occupancy, to be shared between
+// routers created by Extend.
+func NewOccupancy() *Occupancy {
+	return &Occupancy{
+		owners:  map[ddp.Addr]*router{},
+		routers: map[*router]bool{},
+	}
+}
+
+func (o *Occupancy) join(r *router) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.routers[r] = true
+}
+
+// Records that r has node on its LocalTalk side.
+// Returns the other routers on the same network, which should be told.
+func (o *Occupancy) claim(r *router, node ddp.Node) []*router {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	addr := ddp.Addr{Network: r.network, Node: node}
+	if o.owners[addr] == r {
+		return nil
+	}
+	o.owners[addr] = r
+	return o.peers(r)
+}
+
+// Forgets that r has node on its LocalTalk side.
+// Returns the other routers on the same network, which should be told.
+func (o *Occupancy) release(r *router, node ddp.Node) []*router {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	addr := ddp.Addr{Network: r.network, Node: node}
+	if o.owners[addr] != r {
+		return nil
+	}
+	delete(o.owners, addr)
+	return o.peers(r)
+}
+
+// Forgets all nodes claimed by r.
+// Returns the other routers on the same network, which should be told.
+func (o *Occupancy) leave(r *router) []*router {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	delete(o.routers, r)
+	for addr, owner := range o.owners {
+		if owner == r {
+			delete(o.owners, addr)
+		}
+	}
+	return o.peers(r)
+}
+
+// Returns the nodes on r’s network claimed by other routers.
+func (o *Occupancy) others(r *router) []ddp.Node {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var nodes []ddp.Node
+	for addr, owner := range o.owners {
+		if owner != r && addr.Network == r.network {
+			nodes = append(nodes, addr.Node)
+		}
+	}
+	return nodes
+}
+
+// Returns true if node is claimed by a router other than r.
+func (o *Occupancy) claimedByOther(r *router, node ddp.Node) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	owner, ok := o.owners[ddp.Addr{Network: r.network, Node: node}]
+	return ok && owner != r
+}
+
+// Called with mu held.
+func (o *Occupancy) peers(r *router) []*router {
+	var peers []*router
+	for peer := range o.routers {
+		if peer != r && peer.network == r.network {
+			peers = append(peers, peer)
+		}
+	}
+	return peers
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/nbp"
+)
+
+// Traffic classes, which are rate-limited separately. A packet is in
+// the first class that it fits.
+const (
+	ClassAARP      = "aarp"
+	ClassNBPBrRq   = "nbp-brrq"
+	ClassBroadcast = "broadcast"
+	ClassUnicast   = "unicast"
+)
+
+type (
+	// A RateLimit limits the packets of each class that the group sends
+	// to some members. Rate limits are written as:
+	//
+	//	MEMBER CLASS=RATE[/BURST]...
+	//
+	// MEMBER is as in Rule, and the first rate limit for a member and
+	// class applies. RATE is in packets per second, and BURST
+	// is the number of packets that may be sent at once, by default
+	// the same as RATE. For example, "serial aarp=10 broadcast=20/40".
+	RateLimit struct {
+		Text   string
+		Member string
+		Limits map[string]Limit // by class
+	}
+
+	Limit struct {
+		Rate  float64
+		Burst float64
+	}
+
+	// StormOptions configures the detection of broadcast storms.
+	// A member that sends more than Threshold broadcasts (of any class
+	// but unicast) in a second is quarantined: its packets are dropped
+	// until Quarantine has passed. A Threshold of 0 disables detection.
+	StormOptions struct {
+		Threshold  int
+		Quarantine time.Duration
+	}
+
+	tokenBucket struct {
+		Limit
+		tokens float64
+		last   time.Time
+	}
+
+	// Counts broadcasts from a member, within one-second windows.
+	stormDetector struct {
+		windowStart time.Time
+		count       int
+		until       time.Time // end of quarantine, if any
+	}
+)
+
+// ParseRateLimit parses a rate limit, as described by RateLimit.
+func ParseRateLimit(text string) (RateLimit, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return RateLimit{}, fmt.Errorf("parse rate limit %q: want member and limits", text)
+	}
+	rl := RateLimit{Text: text, Member: fields[0], Limits: map[string]Limit{}}
+	for _, field := range fields[1:] {
+		class, value, ok := strings.Cut(field, "=")
+		if !ok {
+			return RateLimit{}, fmt.Errorf("parse rate limit %q: want class=rate, not %q", text, field)
+		}
+		switch class {
+		case ClassAARP, ClassNBPBrRq, ClassBroadcast, ClassUnicast:
+		default:
+			return RateLimit{}, fmt.Errorf("parse rate limit %q: unknown class %q", text, class)
+		}
+		rate, burst, ok := strings.Cut(value, "/")
+		if !ok {
+			burst = rate
+		}
+		r, err1 := strconv.ParseFloat(rate, 64)
+		b, err2 := strconv.ParseFloat(burst, 64)
+		if err1 != nil || err2 != nil || r <= 0 || b < 1 {
+			return RateLimit{}, fmt.Errorf("parse rate limit %q: invalid rate %q", text, value)
+		}
+		rl.Limits[class] = Limit{Rate: r, Burst: b}
+	}
+	return rl, nil
+}
+
+// Returns the traffic class of a packet.
+func classify(pak ethertalk.Packet, f *frame) string {
+	if pak.SNAPProto == ethertalk.AARPProto {
+		return ClassAARP
+	} else if f.nbp != nil && f.nbp.Function == nbp.FunctionBrRq {
+		return ClassNBPBrRq
+	} else if pak.Dst[0]&0x01 != 0 {
+		return ClassBroadcast
+	}
+	return ClassUnicast
+}
+
+// Returns true if a packet may be sent now, taking a token for it.
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b.last.IsZero() {
+		b.tokens = b.Burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.Rate
+		if b.tokens > b.Burst {
+			b.tokens = b.Burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Counts a broadcast, returning true if it starts a quarantine.
+func (s *stormDetector) observe(now time.Time, opts StormOptions) bool {
+	if now.Sub(s.windowStart) >= time.Second {
+		s.windowStart, s.count = now, 0
+	}
+	s.count++
+	if s.count > opts.Threshold && !s.quarantined(now) {
+		s.until = now.Add(opts.Quarantine)
+		return true
+	}
+	return false
+}
+
+func (s *stormDetector) quarantined(now time.Time) bool {
+	return now.Before(s.until)
+}
+
+// Returns token buckets for the rate limits that apply to m, by class.
+func buckets(limits []RateLimit, m *member) map[string]*tokenBucket {
+	bs := map[string]*tokenBucket{}
+	for _, rl := range limits {
+		if !memberMatches(rl.Member, m) {
+			continue
+		}
+		for class, l := range rl.Limits {
+			if bs[class] == nil {
+				bs[class] = &tokenBucket{Limit: l}
+			}
+		}
+	}
+	return bs
+}
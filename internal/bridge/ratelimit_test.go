@@ -0,0 +1,197 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	cases := []struct {
+		name string
+		text string
+		want RateLimit
+		err  string
+	}{{
+		name: "rate",
+		text: "serial aarp=10",
+		want: RateLimit{Text: "serial aarp=10", Member: "serial", Limits: map[string]Limit{
+			ClassAARP: {Rate: 10, Burst: 10},
+		}},
+	}, {
+		name: "burst",
+		text: "tcp-client:hub:9000  nbp-brrq=0.5/20 broadcast=20/40 unicast=100",
+		want: RateLimit{Text: "tcp-client:hub:9000  nbp-brrq=0.5/20 broadcast=20/40 unicast=100", Member: "tcp-client:hub:9000", Limits: map[string]Limit{
+			ClassNBPBrRq:   {Rate: 0.5, Burst: 20},
+			ClassBroadcast: {Rate: 20, Burst: 40},
+			ClassUnicast:   {Rate: 100, Burst: 100},
+		}},
+	}, {
+		name: "empty",
+		text: "",
+		err:  "want member and limits",
+	}, {
+		name: "no-limits",
+		text: "serial",
+		err:  "want member and limits",
+	}, {
+		name: "no-rate",
+		text: "serial aarp",
+		err:  `want class=rate, not "aarp"`,
+	}, {
+		name: "class",
+		text: "serial ddp=10",
+		err:  `unknown class "ddp"`,
+	}, {
+		name: "not-number",
+		text: "serial aarp=fast",
+		err:  `invalid rate "fast"`,
+	}, {
+		name: "zero-rate",
+		text: "serial aarp=0",
+		err:  `invalid rate "0"`,
+	}, {
+		name: "negative-rate",
+		text: "serial aarp=-1/5",
+		err:  `invalid rate "-1/5"`,
+	}, {
+		name: "small-burst",
+		text: "serial aarp=0.5",
+		err:  `invalid rate "0.5"`,
+	}, {
+		name: "bad-burst",
+		text: "serial aarp=10/",
+		err:  `invalid rate "10/"`,
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			rl, err := ParseRateLimit(c.text)
+			if c.err != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.err)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, rl)
+		})
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	assert := assert.New(t)
+	b := &tokenBucket{Limit: Limit{Rate: 10, Burst: 3}}
+	now := time.Unix(1000, 0)
+
+	// Starts full, allowing a burst.
+	for i := 0; i < 3; i++ {
+		assert.True(b.allow(now), "burst %d", i)
+	}
+	assert.False(b.allow(now))
+
+	// Refills at the rate: one packet every 100ms.
+	now = now.Add(50 * time.Millisecond)
+	assert.False(b.allow(now))
+	now = now.Add(50 * time.Millisecond)
+	assert.True(b.allow(now))
+	assert.False(b.allow(now))
+
+	// Refills no further than the burst.
+	now = now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		assert.True(b.allow(now), "refilled %d", i)
+	}
+	assert.False(b.allow(now))
+}
+
+func TestStormDetector(t *testing.T) {
+	assert := assert.New(t)
+	opts := StormOptions{Threshold: 3, Quarantine: 30 * time.Second}
+	s := &stormDetector{}
+	now := time.Unix(1000, 0)
+
+	// Up to the threshold in a second is fine, even every second.
+	for sec := 0; sec < 3; sec++ {
+		for i := 0; i < 3; i++ {
+			assert.False(s.observe(now, opts))
+		}
+		now = now.Add(time.Second)
+	}
+	assert.False(s.quarantined(now))
+
+	// Beyond it starts a quarantine, once.
+	for i := 0; i < 3; i++ {
+		assert.False(s.observe(now, opts))
+	}
+	assert.True(s.observe(now, opts))
+	assert.False(s.observe(now, opts))
+	assert.True(s.quarantined(now))
+
+	// The quarantine expires.
+	assert.True(s.quarantined(now.Add(30*time.Second - time.Nanosecond)))
+	now = now.Add(30 * time.Second)
+	assert.False(s.quarantined(now))
+	assert.False(s.observe(now, opts))
+
+	// A new storm starts a new quarantine.
+	for i := 0; i < 3; i++ {
+		s.observe(now, opts)
+	}
+	assert.True(s.quarantined(now))
+}
+
+func TestBuckets(t *testing.T) {
+	assert := assert.New(t)
+	limits := []RateLimit{}
+	for _, text := range []string{
+		"serial:/dev/ttyUSB0 aarp=5",
+		"serial aarp=10 broadcast=20",
+		"* unicast=100",
+		"multicast aarp=1",
+	} {
+		rl, err := ParseRateLimit(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		limits = append(limits, rl)
+	}
+
+	bs := buckets(limits, &member{Member: Member{Kind: "serial", Addr: "/dev/ttyUSB0"}})
+	assert.Len(bs, 3)
+	assert.Equal(Limit{Rate: 5, Burst: 5}, bs[ClassAARP].Limit)
+	assert.Equal(Limit{Rate: 20, Burst: 20}, bs[ClassBroadcast].Limit)
+	assert.Equal(Limit{Rate: 100, Burst: 100}, bs[ClassUnicast].Limit)
+
+	bs = buckets(limits, &member{Member: Member{Kind: "ethertalk", Addr: "eth0"}})
+	assert.Len(bs, 1)
+	assert.Equal(Limit{Rate: 100, Burst: 100}, bs[ClassUnicast].Limit)
+}
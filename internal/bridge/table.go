@@ -0,0 +1,138 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"sort"
+	"time"
+)
+
+// The shortest interval between sweeps, however short the TTL.
+const minSweepInterval = time.Second
+
+type (
+	// An AgingTable remembers when addresses were last seen, and forgets
+	// those that have not been seen within its TTL. It is not safe for
+	// concurrent use.
+	AgingTable[K comparable] struct {
+		ttl  time.Duration // 0 is forever
+		now  func() time.Time
+		seen map[K]time.Time
+	}
+
+	// An AddrTable is an ExtBridge that learns addresses, such as nodes
+	// on either side of a router, or local MAC addresses.
+	AddrTable interface {
+		Addrs() []LearnedAddr
+	}
+
+	// A LearnedAddr is an entry in an AddrTable.
+	LearnedAddr struct {
+		Addr     string
+		Hardware string // the hardware address that Addr maps to, if any
+		Side     string // where the address was seen, e.g. "localtalk"
+		LastSeen time.Time
+	}
+)
+
+// NewAgingTable returns an empty table, whose entries expire after ttl.
+// If ttl is 0, entries never expire.
+func NewAgingTable[K comparable](ttl time.Duration) *AgingTable[K] {
+	return &AgingTable[K]{
+		ttl:  ttl,
+		now:  time.Now,
+		seen: map[K]time.Time{},
+	}
+}
+
+// Touch marks k as seen now. Returns true if k was not in the table.
+func (t *AgingTable[K]) Touch(k K) bool {
+	_, ok := t.seen[k]
+	t.seen[k] = t.now()
+	return !ok
+}
+
+// Has returns true if k is in the table.
+func (t *AgingTable[K]) Has(k K) bool {
+	_, ok := t.seen[k]
+	return ok
+}
+
+// Len returns the number of entries in the table.
+func (t *AgingTable[K]) Len() int {
+	return len(t.seen)
+}
+
+// Remove removes k from the table. Returns true if it was present.
+func (t *AgingTable[K]) Remove(k K) bool {
+	_, ok := t.seen[k]
+	delete(t.seen, k)
+	return ok
+}
+
+// Expire removes entries that have not been seen within the TTL,
+// and returns them.
+func (t *AgingTable[K]) Expire() []K {
+	if t.ttl == 0 {
+		return nil
+	}
+	var expired []K
+	deadline := t.now().Add(-t.ttl)
+	for k, seen := range t.seen {
+		if seen.Before(deadline) {
+			expired = append(expired, k)
+			delete(t.seen, k)
+		}
+	}
+	return expired
+}
+
+// Keys returns the entries in the table, ordered by less.
+func (t *AgingTable[K]) Keys(less func(a, b K) bool) []K {
+	keys := make([]K, 0, len(t.seen))
+	for k := range t.seen {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	return keys
+}
+
+// LastSeen returns when k was last seen.
+func (t *AgingTable[K]) LastSeen(k K) time.Time {
+	return t.seen[k]
+}
+
+// SweepInterval returns how often to call Expire. It is always positive.
+func (t *AgingTable[K]) SweepInterval() time.Duration {
+	if t.ttl <= 0 || t.ttl > 4*time.Minute {
+		return time.Minute
+	} else if t.ttl < 4*minSweepInterval {
+		return minSweepInterval
+	}
+	return t.ttl / 4
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSweepInterval(t *testing.T) {
+	for _, tt := range []struct {
+		ttl, want time.Duration
+	}{
+		{0, time.Minute},
+		{-time.Second, time.Minute},
+		{time.Nanosecond, minSweepInterval},
+		{2 * time.Second, minSweepInterval},
+		{time.Minute, 15 * time.Second},
+		{time.Hour, time.Minute},
+	} {
+		t.Run(tt.ttl.String(), func(t *testing.T) {
+			assert.Equal(t, tt.want, NewAgingTable[int](tt.ttl).SweepInterval())
+		})
+	}
+}
+
+func TestExpire(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(0, 0)
+	tab := NewAgingTable[int](time.Minute)
+	tab.now = func() time.Time { return now }
+	tab.Touch(1)
+	now = now.Add(30 * time.Second)
+	tab.Touch(2)
+	now = now.Add(45 * time.Second)
+	assert.Equal([]int{1}, tab.Expire())
+	assert.False(tab.Has(1))
+	assert.True(tab.Has(2))
+
+	forever := NewAgingTable[int](0)
+	forever.Touch(1)
+	assert.Empty(forever.Expire())
+}
@@ -32,16 +32,25 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 	"go.uber.org/zap"
 
+	"github.com/sfiera/multitalk/internal/api"
+	"github.com/sfiera/multitalk/internal/aurp"
 	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/kip"
+	"github.com/sfiera/multitalk/internal/logging"
 	"github.com/sfiera/multitalk/internal/raw"
 	"github.com/sfiera/multitalk/internal/serial"
 	"github.com/sfiera/multitalk/internal/tcp"
 	"github.com/sfiera/multitalk/internal/udp"
+	"github.com/sfiera/multitalk/internal/vde"
+	aurppkg "github.com/sfiera/multitalk/pkg/aurp"
 	"github.com/sfiera/multitalk/pkg/ddp"
+	tashtalk "github.com/sfiera/multitalk/pkg/tash"
 )
 
 const (
@@ -50,12 +59,44 @@ const (
 
 var (
 	ether   = pflag.StringArrayP("ethertalk", "e", []string{}, "interface to bridge via EtherTalk")
+	fcs     = pflag.String("ethertalk-fcs", "auto", "whether captured EtherTalk frames end with an FCS (auto, yes or no)")
 	multi   = pflag.StringArrayP("multicast", "m", []string{}, "interface to bridge via UDP multicast")
+	basil   = pflag.StringArray("basilisk", []string{}, "interface to bridge via Basilisk II/SheepShaver UDP tunnel")
+	basPort = pflag.Int("basilisk-port", udp.BasiliskPort, "UDP port of Basilisk II/SheepShaver tunnel")
+	basBind = pflag.Int("basilisk-bind-port", 0, "UDP port to send to the Basilisk II/SheepShaver tunnel from, if not --basilisk-port (for an emulator on the same host)")
 	tash    = pflag.StringArrayP("serial", "s", []string{}, "serial device to bridge via TashTalk")
 	client  = pflag.StringArrayP("tcp-client", "t", []string{}, "address to dial via TCP")
 	server  = pflag.StringArrayP("tcp-server", "T", []string{}, "address to listen via TCP")
+	peers   = pflag.StringArray("aurp-peer", []string{}, "address of router to tunnel to via AURP")
+	aurpLis = pflag.String("aurp-listen", ":387", "address to listen for AURP peers, bound only with --aurp-peer (port 387 needs root)")
+	zone    = pflag.String("aurp-zone", "MultiTalk", "zone name to advertise to AURP peers")
+	remap   = pflag.String("aurp-remap", "", "network range to remap conflicting AURP networks into, such as 60000-60999")
+	aurpNd  = pflag.Uint8("aurp-node", 253, "node ID from which to announce AURP networks with RTMP and ZIP (0 to not announce)")
+	kipPeer = pflag.StringArray("kip-peer", []string{}, "address of gateway to bridge via DDP-in-UDP (KIP/CAP)")
+	kipBase = pflag.Int("kip-base-port", 200, "UDP port of DDP socket 0 for KIP/CAP")
+	qemuCl  = pflag.StringArray("qemu-client", []string{}, "address to dial QEMU socket/stream netdev via TCP")
+	qemuSv  = pflag.StringArray("qemu-server", []string{}, "address to listen for QEMU socket/stream netdevs via TCP")
+	qemuDg  = pflag.StringArray("qemu-dgram", []string{}, "local,remote addresses to exchange QEMU dgram netdev frames via UDP")
+	qemuMc  = pflag.StringArray("qemu-mcast", []string{}, "multicast group to bridge QEMU socket mcast netdevs via UDP")
+	vdeSw   = pflag.StringArray("vde", []string{}, "VDE switch control directory to plug into, such as /tmp/vde.ctl")
+	filters = pflag.StringArray("filter", []string{}, "rule to filter packets, such as 'deny out tcp-client ddp-type=adsp'")
+	filterF = pflag.String("filter-file", "", "file of rules to filter packets, one per line")
+	limits  = pflag.StringArray("rate-limit", []string{}, "limit on packets sent to members, such as 'serial broadcast=20/40'")
+	stormTh = pflag.Int("storm-threshold", 0, "broadcasts per second that quarantine a member, such as 500 (0 to never quarantine)")
+	stormQt = pflag.Duration("storm-quarantine", 30*time.Second, "how long to drop packets from a member sending a broadcast storm")
+	loopWin = pflag.Duration("loop-window", 0, "how long to remember frames, to detect bridge loops, such as 2s (0 to not detect)")
+	dedupe  = pflag.Duration("dedupe-window", 0, "drop frames repeated within this long, such as 50ms (0 to not drop)")
+	web     = pflag.String("http", "", "address to serve status API via HTTP, such as localhost:8080 (unauthenticated)")
+	baud    = pflag.Int("serial-baud", 1000000, "baud rate for TashTalk serial devices")
+	flow    = pflag.Bool("serial-flow-control", false, "use RTS/CTS flow control for TashTalk serial devices")
+	offload = pflag.Bool("serial-crc-offload", false, "have TashTalk firmware calculate and check CRCs, falling back if it turns out not to")
 	network = pflag.Uint16P("network", "n", 0xff00, "network number for LToU bridging")
+	cable   = pflag.String("cable-range", "", "Phase 2 network range of EtherTalk, such as 1000-1009 (default: --network)")
+	nodeTTL = pflag.Duration("node-ttl", 15*time.Minute, "forget nodes and addresses not heard from for this long (0 to never forget)")
 	debug   = pflag.BoolP("debug", "d", false, "log packets")
+	logFmt  = pflag.String("log-format", "console", "log encoding (console or json)")
+	logFile = pflag.String("log-file", "", "file to log to, instead of stderr")
+	logLvl  = pflag.StringArray("log-level", []string{}, "log level, or per-bridge level such as multicast=debug")
 	version = pflag.BoolP("version", "v", false, "Display version & exit")
 )
 
@@ -65,18 +106,33 @@ func Main() {
 		os.Exit(0)
 	}
 
-	cfg := zap.NewDevelopmentConfig()
-	if !*debug {
-		cfg.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
-	}
-	log, err := cfg.Build()
+	log, levels, err := logger()
 	if err != nil {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
 
 	g := bridge.NewGroup(log)
-	err = bridges(context.Background(), log, g)
+	rules, err := filterRules()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	g.SetFilters(rules)
+	rls, err := rateLimits()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	g.SetRateLimits(rls)
+	if *stormTh < 0 || (*stormTh > 0 && *stormQt <= 0) {
+		fmt.Fprintln(os.Stderr, "--storm-threshold and --storm-quarantine must be positive")
+		os.Exit(1)
+	}
+	g.SetStormProtection(bridge.StormOptions{Threshold: *stormTh, Quarantine: *stormQt})
+	g.SetLoopDetection(*loopWin)
+	g.SetDedupe(*dedupe)
+	err = bridges(context.Background(), log, levels, g)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
@@ -84,36 +140,165 @@ func Main() {
 	g.Run()
 }
 
-func bridges(ctx context.Context, log *zap.Logger, grp *bridge.Group) error {
-	niface := len(*client) + len(*server) + len(*ether) + len(*multi) + len(*tash)
+func logger() (*zap.Logger, *logging.Levels, error) {
+	var cfg zap.Config
+	switch *logFmt {
+	case "console":
+		cfg = zap.NewDevelopmentConfig()
+	case "json":
+		cfg = zap.NewProductionConfig()
+		cfg.Sampling = nil
+	default:
+		return nil, nil, fmt.Errorf("unknown log format %q", *logFmt)
+	}
+	if *logFile != "" {
+		cfg.OutputPaths = []string{*logFile}
+	}
+
+	levels := logging.NewLevels(zap.InfoLevel)
+	if *debug {
+		levels.Set("", zap.DebugLevel)
+	}
+	for _, spec := range *logLvl {
+		err := levels.Parse(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Filtering happens in levels, so that it can be changed at runtime.
+	cfg.Level = zap.NewAtomicLevelAt(zap.DebugLevel)
+	log, err := cfg.Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	return levels.Wrap(log), levels, nil
+}
+
+// Parses the rules in --filter-file, followed by those from --filter.
+func filterRules() ([]bridge.Rule, error) {
+	var texts []string
+	if *filterF != "" {
+		data, err := os.ReadFile(*filterF)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				texts = append(texts, line)
+			}
+		}
+	}
+	texts = append(texts, *filters...)
+
+	var rules []bridge.Rule
+	for _, text := range texts {
+		r, err := bridge.ParseRule(text)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// Parses the limits from --rate-limit.
+func rateLimits() ([]bridge.RateLimit, error) {
+	var rls []bridge.RateLimit
+	for _, text := range *limits {
+		rl, err := bridge.ParseRateLimit(text)
+		if err != nil {
+			return nil, err
+		}
+		rls = append(rls, rl)
+	}
+	return rls, nil
+}
+
+func bridges(ctx context.Context, log *zap.Logger, levels *logging.Levels, grp *bridge.Group) error {
+	niface := len(*client) + len(*server) + len(*ether) + len(*multi) + len(*tash) + len(*peers) + len(*basil) +
+		len(*qemuCl) + len(*qemuSv) + len(*qemuDg) + len(*qemuMc) + len(*vdeSw)
+	if len(*kipPeer) > 0 {
+		niface++
+	}
 	if niface == 0 {
 		return fmt.Errorf("no interfaces specified")
-	} else if (niface == 1) && (len(*server) == 0) && !*debug {
+	} else if (niface == 1) && (len(*server)+len(*qemuSv) == 0) && !*debug {
 		return fmt.Errorf("only one interface specified")
+	} else if *nodeTTL < 0 {
+		return fmt.Errorf("--node-ttl must not be negative")
 	}
 
+	fcsMode, err := raw.ParseFCSMode(*fcs)
+	if err != nil {
+		return err
+	}
 	for _, dev := range *ether {
-		et, err := raw.EtherTalk(dev)
+		et, err := raw.EtherTalk(dev, *nodeTTL, fcsMode)
 		if err != nil {
 			return err
 		}
-		grp.Add(et.Start(ctx, log))
+		grp.Add(ctx, log, "ethertalk", dev, et)
 	}
 
+	for _, sw := range *vdeSw {
+		v, err := vde.Plug(sw)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "vde", sw, v)
+	}
+
+	for _, dev := range *basil {
+		b, err := udp.Basilisk(dev, *basPort, *basBind)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "basilisk", dev, b)
+	}
+
+	var cableRange ddp.NetworkRange
+	if *cable != "" {
+		var err error
+		cableRange, err = ddp.ParseNetworkRange(*cable)
+		if err != nil {
+			return err
+		}
+	}
+	routerOpts := bridge.RouterOptions{
+		Network:    ddp.Network(*network),
+		CableRange: cableRange,
+		// Shared by LocalTalk bridges, to defend each other’s node IDs.
+		Occupancy: bridge.NewOccupancy(),
+		TTL:       *nodeTTL,
+	}
 	for _, dev := range *multi {
 		m, hwAddr, err := udp.Multicast(dev)
 		if err != nil {
 			return err
 		}
-		grp.Add(bridge.Extend(m, ddp.Network(*network), hwAddr).Start(ctx, log))
+		opts := routerOpts
+		opts.Kind = "multicast"
+		grp.Add(ctx, log, "multicast", dev, bridge.Extend(m, hwAddr, opts))
 	}
 
+	features := tashtalk.Features(0)
+	if *offload {
+		features = tashtalk.FeatureCRCCalculation | tashtalk.FeatureCRCChecking
+	}
 	for _, dev := range *tash {
-		tt, hwAddr, err := serial.TashTalk(dev)
+		tt, hwAddr, err := serial.TashTalk(dev, serial.Options{
+			Baud:        *baud,
+			FlowControl: *flow,
+			Features:    features,
+		})
 		if err != nil {
 			return err
 		}
-		grp.Add(bridge.Extend(tt, ddp.Network(*network), hwAddr).Start(ctx, log))
+		opts := routerOpts
+		opts.Kind = "serial"
+		grp.Add(ctx, log, "serial", dev, bridge.Extend(tt, hwAddr, opts))
 	}
 
 	for _, s := range *client {
@@ -121,7 +306,27 @@ func bridges(ctx context.Context, log *zap.Logger, grp *bridge.Group) error {
 		if err != nil {
 			return err
 		}
-		grp.Add(tcp.Start(ctx, log))
+		grp.Add(ctx, log, "tcp-client", s, tcp)
+	}
+
+	if len(*kipPeer) > 0 {
+		k, err := kip.KIP(*kipPeer, *kipBase)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "kip", strings.Join(*kipPeer, ","), k)
+	}
+
+	if len(*peers) > 0 {
+		err := aurpPeers(ctx, log, grp, routerOpts)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = qemus(ctx, log, grp)
+	if err != nil {
+		return err
 	}
 
 	for _, s := range *server {
@@ -132,5 +337,89 @@ func bridges(ctx context.Context, log *zap.Logger, grp *bridge.Group) error {
 		tcp.Serve(ctx, log, grp)
 	}
 
+	if *web != "" {
+		h, err := api.HTTPServer(*web)
+		if err != nil {
+			return err
+		}
+		h.Serve(ctx, log, grp, levels)
+	}
+
+	return nil
+}
+
+func qemus(ctx context.Context, log *zap.Logger, grp *bridge.Group) error {
+	for _, s := range *qemuCl {
+		q, err := tcp.QEMUClient(s)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "qemu-client", s, q)
+	}
+
+	for _, s := range *qemuSv {
+		q, err := tcp.QEMUServer(s)
+		if err != nil {
+			return err
+		}
+		q.Serve(ctx, log, grp)
+	}
+
+	for _, s := range *qemuDg {
+		local, remote, ok := strings.Cut(s, ",")
+		if !ok {
+			return fmt.Errorf("qemu dgram %q: want local,remote", s)
+		}
+		q, err := udp.QEMUDgram(local, remote)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "qemu-dgram", s, q)
+	}
+
+	for _, s := range *qemuMc {
+		q, err := udp.QEMUMulticast(s)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "qemu-mcast", s, q)
+	}
+	return nil
+}
+
+func aurpPeers(ctx context.Context, log *zap.Logger, grp *bridge.Group, routerOpts bridge.RouterOptions) error {
+	opts := aurp.Options{Zone: *zone}
+	opts.Networks = append(opts.Networks, aurppkg.NetworkTuple{
+		Range: ddp.NetworkRange{First: routerOpts.Network, Last: routerOpts.Network},
+	})
+	// Announced on the EtherTalk side, which is the cable range, if any.
+	opts.Router.Proto = ddp.Addr{Network: routerOpts.Network, Node: ddp.Node(*aurpNd)}
+	if (routerOpts.CableRange != ddp.NetworkRange{}) {
+		opts.Networks = append(opts.Networks, aurppkg.NetworkTuple{
+			Range:    routerOpts.CableRange,
+			Extended: true,
+		})
+		opts.Router.Proto.Network = routerOpts.CableRange.First
+	}
+	if *remap != "" {
+		var err error
+		opts.Remap, err = ddp.ParseNetworkRange(*remap)
+		if err != nil {
+			return err
+		}
+	}
+
+	t, err := aurp.Listen(*aurpLis)
+	if err != nil {
+		return err
+	}
+	for _, p := range *peers {
+		peer, err := t.Peer(p, opts)
+		if err != nil {
+			return err
+		}
+		grp.Add(ctx, log, "aurp", p, peer)
+	}
+	t.Serve(ctx, log)
 	return nil
 }
@@ -0,0 +1,257 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Communicates with KIP and CAP gateways, which carry DDP in UDP
+package kip
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/kip"
+)
+
+type (
+	gateway struct {
+		base    int
+		peers   []net.IP
+		conns   map[ddp.Socket]*net.UDPConn
+		unbound []int // ports that could not be bound
+
+		// Which peer each network was last heard from.
+		routes   map[ddp.Network]route
+		routesMu sync.Mutex
+	}
+
+	route struct {
+		peer     int // index into peers
+		lastSeen time.Time
+	}
+)
+
+// KIP returns a bridge to the given gateways, which listens on the
+// ports of all DDP sockets, from base+1 to base+254. Ports that are
+// already in use are skipped.
+func KIP(peers []string, base int) (bridge.ExtBridge, error) {
+	g := &gateway{
+		base:   base,
+		conns:  map[ddp.Socket]*net.UDPConn{},
+		routes: map[ddp.Network]route{},
+	}
+	for _, p := range peers {
+		addr, err := net.ResolveIPAddr("ip4", p)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %s: %s", p, err.Error())
+		}
+		g.peers = append(g.peers, addr.IP)
+	}
+
+	var lastErr error
+	for s := 1; s <= 254; s++ {
+		port := kip.Port(base, ddp.Socket(s))
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+		if err != nil {
+			g.unbound = append(g.unbound, port)
+			lastErr = err
+			continue
+		}
+		g.conns[ddp.Socket(s)] = conn
+	}
+	if len(g.conns) == 0 {
+		return nil, fmt.Errorf("listen kip: %s", lastErr.Error())
+	}
+	return g, nil
+}
+
+func (g *gateway) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	if len(g.unbound) > 0 {
+		log.Warn("some ports unavailable; not receiving on their sockets",
+			zap.Ints("ports", g.unbound))
+	}
+	sendCh := make(chan ethertalk.Packet)
+	recvCh := make(chan ethertalk.Packet)
+
+	wg := sync.WaitGroup{}
+	for _, conn := range g.conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			g.capture(ctx, log, conn, recvCh)
+		}(conn)
+	}
+	go func() {
+		wg.Wait()
+		close(recvCh)
+	}()
+	go func() {
+		<-ctx.Done()
+		for _, conn := range g.conns {
+			conn.Close()
+		}
+	}()
+	go g.transmit(ctx, log, sendCh)
+	return sendCh, recvCh
+}
+
+// Addrs returns the networks heard from each peer.
+func (g *gateway) Addrs() []bridge.LearnedAddr {
+	g.routesMu.Lock()
+	defer g.routesMu.Unlock()
+	var nets []ddp.Network
+	for net := range g.routes {
+		nets = append(nets, net)
+	}
+	sort.Slice(nets, func(i, j int) bool { return nets[i] < nets[j] })
+	var addrs []bridge.LearnedAddr
+	for _, net := range nets {
+		r := g.routes[net]
+		addrs = append(addrs, bridge.LearnedAddr{
+			Addr:     fmt.Sprint(net),
+			Hardware: g.peers[r.peer].String(),
+			Side:     "kip",
+			LastSeen: r.lastSeen,
+		})
+	}
+	return addrs
+}
+
+func (g *gateway) transmit(ctx context.Context, log *zap.Logger, sendCh <-chan ethertalk.Packet) {
+	for packet := range sendCh {
+		if packet.SNAPProto != ethertalk.AppleTalkProto {
+			continue // AARP stays on the local side
+		}
+		d := ddp.ExtPacket{}
+		err := ddp.ExtUnmarshal(packet.Payload, &d)
+		if err != nil {
+			metrics.UnmarshalFailures.WithLabelValues("kip", "ddp").Inc()
+			continue
+		}
+		data, err := kip.Marshal(d)
+		if err != nil {
+			log.With(zap.Error(err)).Error("marshal failed")
+			continue
+		}
+
+		// Send from the source socket’s port, if possible, as replies
+		// may be sent back to it.
+		conn := g.conns[d.SrcSocket]
+		if conn == nil {
+			for _, c := range g.conns {
+				conn = c
+				break
+			}
+		}
+		port := kip.Port(g.base, d.DstSocket)
+		for _, peer := range g.destinations(d.DstNet) {
+			_, err = conn.WriteToUDP(data, &net.UDPAddr{IP: peer, Port: port})
+			if err != nil {
+				log.With(zap.Error(err)).Error("send failed")
+			}
+		}
+	}
+}
+
+// Returns the peer that dst was heard from, or all peers if unknown.
+func (g *gateway) destinations(dst ddp.Network) []net.IP {
+	g.routesMu.Lock()
+	defer g.routesMu.Unlock()
+	if r, ok := g.routes[dst]; ok && dst != 0 {
+		return g.peers[r.peer : r.peer+1]
+	}
+	return g.peers
+}
+
+func (g *gateway) capture(
+	ctx context.Context,
+	log *zap.Logger,
+	conn *net.UDPConn,
+	recvCh chan<- ethertalk.Packet,
+) {
+	bin := make([]byte, 1024)
+	for {
+		n, addr, err := conn.ReadFromUDP(bin)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.With(zap.Error(err)).Error("recv failed")
+			return
+		}
+
+		peer := g.peerIndex(addr.IP)
+		if peer < 0 {
+			metrics.Drops.WithLabelValues("kip", "peer").Inc()
+			continue
+		}
+
+		d := ddp.ExtPacket{}
+		err = kip.Unmarshal(bin[:n], &d)
+		if err != nil {
+			log.With(zap.Error(err)).Debug("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues("kip", "ddp").Inc()
+			continue
+		}
+		if d.SrcNet != 0 {
+			g.routesMu.Lock()
+			g.routes[d.SrcNet] = route{peer: peer, lastSeen: time.Now()}
+			g.routesMu.Unlock()
+		}
+
+		packet, err := ethertalk.AppleTalk(ethernet.Addr{}, d)
+		if err != nil {
+			log.With(zap.Error(err)).Error("marshal failed")
+			continue
+		}
+		select {
+		case recvCh <- *packet:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (g *gateway) peerIndex(ip net.IP) int {
+	for i, peer := range g.peers {
+		if peer.Equal(ip) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,136 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kip
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/kip"
+)
+
+const (
+	testBase   = 23000
+	peerSocket = ddp.Socket(200) // bound by the test, as the peer
+	ourSocket  = ddp.Socket(100)
+)
+
+func testDDP(dstSocket, srcSocket ddp.Socket, data ...byte) ddp.ExtPacket {
+	return ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      uint16(13 + len(data)),
+			DstNet:    20,
+			DstNode:   2,
+			DstSocket: dstSocket,
+			SrcNet:    10,
+			SrcNode:   1,
+			SrcSocket: srcSocket,
+			Proto:     ddp.ProtoAEP,
+		},
+		Data: data,
+	}
+}
+
+func TestLoopback(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Bound first, so that the gateway skips the port, and the test
+	// can act as the peer on the loopback address.
+	peer, err := net.ListenUDP("udp4", &net.UDPAddr{
+		IP:   net.IPv4(127, 0, 0, 1),
+		Port: kip.Port(testBase, peerSocket),
+	})
+	if err != nil {
+		t.Skipf("port unavailable: %s", err.Error())
+	}
+	defer peer.Close()
+	b, err := KIP([]string{"127.0.0.1"}, testBase)
+	if !assert.NoError(err) {
+		return
+	}
+	send, recv := b.Start(ctx, zap.NewNop())
+	defer func() {
+		cancel()
+		for range recv {
+			// Closed once all ports are, so that they can be reused.
+		}
+	}()
+
+	// Encapsulated, to the port of the destination socket, from the
+	// port of the source socket.
+	out := testDDP(peerSocket, ourSocket, 0x01)
+	pak, err := ethertalk.AppleTalk(ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}, out)
+	assert.NoError(err)
+	send <- *pak
+	buf := make([]byte, 1024)
+	peer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := peer.ReadFromUDP(buf)
+	if !assert.NoError(err) {
+		return
+	}
+	assert.Equal(kip.Port(testBase, ourSocket), from.Port)
+	d := ddp.ExtPacket{}
+	assert.NoError(kip.Unmarshal(buf[:n], &d))
+	assert.Equal(out, d)
+
+	// Decapsulated, and the source network is routed to the peer.
+	in := testDDP(ourSocket, peerSocket, 0x02)
+	in.DstNet, in.SrcNet = 10, 20
+	data, err := kip.Marshal(in)
+	assert.NoError(err)
+	_, err = peer.WriteToUDP(data, from)
+	assert.NoError(err)
+	select {
+	case pak := <-recv:
+		d = ddp.ExtPacket{}
+		assert.NoError(ddp.ExtUnmarshal(pak.Payload, &d))
+		assert.Equal(in, d)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no packet received")
+	}
+	assert.Equal([]bridge.LearnedAddr{{Addr: "20", Hardware: "127.0.0.1", Side: "kip"}},
+		withoutTimes(b.(bridge.AddrTable).Addrs()))
+}
+
+func withoutTimes(addrs []bridge.LearnedAddr) []bridge.LearnedAddr {
+	for i := range addrs {
+		addrs[i].LastSeen = time.Time{}
+	}
+	return addrs
+}
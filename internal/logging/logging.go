@@ -0,0 +1,157 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Log levels that can be set per subsystem and changed at runtime
+package logging
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Subsystems are identified by the value of this field,
+// which each bridge adds to its logger.
+const subsystemKey = "bridge"
+
+// Levels holds a default log level, and overrides for particular subsystems.
+type Levels struct {
+	mu   sync.RWMutex
+	def  zapcore.Level
+	subs map[string]zapcore.Level
+}
+
+type core struct {
+	zapcore.Core
+	levels *Levels
+	sub    string
+}
+
+// NewLevels returns Levels which enable def for all subsystems.
+func NewLevels(def zapcore.Level) *Levels {
+	return &Levels{def: def, subs: map[string]zapcore.Level{}}
+}
+
+// Set sets the level of a subsystem, or the default level if sub is empty.
+func (l *Levels) Set(sub string, lvl zapcore.Level) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if sub == "" {
+		l.def = lvl
+	} else {
+		l.subs[sub] = lvl
+	}
+}
+
+// Unset returns a subsystem to the default level.
+func (l *Levels) Unset(sub string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.subs, sub)
+}
+
+// Parse sets a level from a spec in the form "level" or "subsystem=level".
+func (l *Levels) Parse(spec string) error {
+	sub, name := "", spec
+	if i := strings.Index(spec, "="); i >= 0 {
+		sub, name = spec[:i], spec[i+1:]
+	}
+	lvl := zapcore.InfoLevel
+	err := lvl.UnmarshalText([]byte(name))
+	if err != nil {
+		return fmt.Errorf("log level %s: %s", spec, err.Error())
+	}
+	l.Set(sub, lvl)
+	return nil
+}
+
+// Map returns the current levels, with the default level under the key "".
+func (l *Levels) Map() map[string]string {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	m := map[string]string{"": l.def.String()}
+	for sub, lvl := range l.subs {
+		m[sub] = lvl.String()
+	}
+	return m
+}
+
+// String returns the current levels in the form accepted by Parse.
+func (l *Levels) String() string {
+	var specs []string
+	for sub, lvl := range l.Map() {
+		if sub == "" {
+			specs = append(specs, lvl)
+		} else {
+			specs = append(specs, sub+"="+lvl)
+		}
+	}
+	sort.Strings(specs)
+	return strings.Join(specs, ",")
+}
+
+func (l *Levels) enabled(sub string, lvl zapcore.Level) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if subLvl, ok := l.subs[sub]; ok {
+		return subLvl.Enabled(lvl)
+	}
+	return l.def.Enabled(lvl)
+}
+
+// Wrap returns a logger which filters log entries according to l.
+// The underlying logger should be enabled for all levels that l may enable.
+func (l *Levels) Wrap(log *zap.Logger) *zap.Logger {
+	return log.WithOptions(zap.WrapCore(func(c zapcore.Core) zapcore.Core {
+		return &core{c, l, ""}
+	}))
+}
+
+func (c *core) Enabled(lvl zapcore.Level) bool {
+	return c.levels.enabled(c.sub, lvl)
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	sub := c.sub
+	for _, f := range fields {
+		if f.Key == subsystemKey && f.Type == zapcore.StringType {
+			sub = f.String
+		}
+	}
+	return &core{c.Core.With(fields), c.levels, sub}
+}
+
+func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
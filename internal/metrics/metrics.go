@@ -0,0 +1,124 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Prometheus metrics for bridges and transports
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "multitalk"
+
+var (
+	// Packets and bytes passing through a bridge.Group, by bridge and
+	// protocol. The bridge is the kind of group member, such as
+	// "tcp-client", and not its address, which for accepted connections
+	// changes each time a client reconnects. The protocol is "aarp", or a
+	// DDP protocol type such as "nbp".
+	PacketsIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_in_total",
+		Help:      "Packets received from each member.",
+	}, []string{"bridge", "proto"})
+	BytesIn = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_in_total",
+		Help:      "Bytes received from each member.",
+	}, []string{"bridge", "proto"})
+	PacketsOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "packets_out_total",
+		Help:      "Packets sent to each member.",
+	}, []string{"bridge", "proto"})
+	BytesOut = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "bytes_out_total",
+		Help:      "Bytes sent to each member.",
+	}, []string{"bridge", "proto"})
+
+	Members = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "members",
+		Help:      "Current members of the bridge group.",
+	}, []string{"bridge"})
+
+	AARPOps = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "aarp_ops_total",
+		Help:      "AARP packets passing through the bridge group, by opcode.",
+	}, []string{"op"})
+
+	// Packets that could not be decoded, by bridge and the layer that failed.
+	UnmarshalFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unmarshal_failures_total",
+		Help:      "Packets that could not be unmarshaled.",
+	}, []string{"bridge", "layer"})
+
+	// Packets deliberately not forwarded, by bridge and reason.
+	Drops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "drops_total",
+		Help:      "Packets dropped instead of forwarded.",
+	}, []string{"bridge", "reason"})
+
+	// Packets matched by a filter rule, by the rule’s text and direction.
+	FilterMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "filter_matches_total",
+		Help:      "Packets matched by each filter rule.",
+	}, []string{"rule", "direction"})
+
+	// Members quarantined for broadcast storms, by bridge.
+	Quarantines = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "quarantines_total",
+		Help:      "Members quarantined for sending broadcast storms.",
+	}, []string{"bridge"})
+
+	// Members disabled as redundant links in a loop, by bridge.
+	RedundantLinks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "redundant_links_total",
+		Help:      "Members disabled as redundant links in a bridge loop.",
+	}, []string{"bridge"})
+
+	TCPConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "tcp_connections",
+		Help:      "Open TCP connections, as client or server.",
+	})
+
+	// Frames from a TashTalk device that could not be decoded, by reason.
+	TashDrops = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tashtalk_drops_total",
+		Help:      "Frames received from TashTalk and dropped.",
+	}, []string{"device", "reason"})
+)
@@ -29,27 +29,51 @@
 package raw
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"net"
 	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/pcap"
 	"go.uber.org/zap"
 
 	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
 	"github.com/sfiera/multitalk/pkg/ethernet"
 	"github.com/sfiera/multitalk/pkg/ethertalk"
 )
 
+// FCSMode says whether captured frames end with an FCS, which some
+// NICs deliver, such as when configured with rx-fcs.
+type FCSMode int
+
+const (
+	FCSAuto    = FCSMode(iota) // detect from the first frames captured
+	FCSAbsent                  // frames never end with an FCS
+	FCSPresent                 // frames always end with an FCS
+)
+
+// Frames that must end with a valid FCS before FCSAuto decides that
+// the NIC delivers it.
+const fcsDetectFrames = 4
+
 type (
 	elap struct {
 		dev         string
 		eth         ethernet.Addr
+		fcs         FCSMode // used only by capture()
+		fcsVotes    int     // frames seen with an FCS, while detecting
 		mu          sync.Mutex
 		capturer    capturer
 		transmitter transmitter
+
+		// Source addresses seen on the local network, guarded by mu.
+		localAddrs *bridge.AgingTable[ethernet.Addr]
+		// Those which sent Phase 1 packets, guarded by mu.
+		phase1Addrs *bridge.AgingTable[ethernet.Addr]
 	}
 
 	capturer interface {
@@ -61,13 +85,33 @@ type (
 	}
 )
 
-func EtherTalk(dev string) (bridge.ExtBridge, error) {
+// ParseFCSMode parses "auto", "yes" or "no".
+func ParseFCSMode(s string) (FCSMode, error) {
+	switch s {
+	case "auto":
+		return FCSAuto, nil
+	case "yes":
+		return FCSPresent, nil
+	case "no":
+		return FCSAbsent, nil
+	}
+	return FCSAuto, fmt.Errorf("unknown fcs mode %q", s)
+}
+
+// EtherTalk returns a bridge to dev. Local addresses that have not been
+// heard from within ttl are forgotten; if ttl is 0, they never are.
+func EtherTalk(dev string, ttl time.Duration, fcs FCSMode) (bridge.ExtBridge, error) {
 	i, err := net.InterfaceByName(dev)
 	if err != nil {
 		return nil, fmt.Errorf("interface %s: %s", dev, err.Error())
 	}
 
-	b := &elap{dev: dev}
+	b := &elap{
+		dev:         dev,
+		fcs:         fcs,
+		localAddrs:  bridge.NewAgingTable[ethernet.Addr](ttl),
+		phase1Addrs: bridge.NewAgingTable[ethernet.Addr](ttl),
+	}
 	copy(b.eth[:], i.HardwareAddr)
 
 	b.capturer, err = b.setupCapture(dev)
@@ -88,7 +132,6 @@ func (b *elap) Start(ctx context.Context, log *zap.Logger) (
 	recv <-chan ethertalk.Packet,
 ) {
 	log = log.With(
-		zap.String("bridge", "raw"),
 		zap.String("dev", b.dev),
 		zap.String("eth", b.eth.String()),
 	)
@@ -96,6 +139,7 @@ func (b *elap) Start(ctx context.Context, log *zap.Logger) (
 	recvCh := make(chan ethertalk.Packet)
 	go b.capture(log, recvCh)
 	go b.transmit(log, sendCh)
+	go b.expire(ctx, log)
 	return sendCh, recvCh
 }
 
@@ -122,7 +166,6 @@ func (b *elap) setupCapture(dev string) (capturer, error) {
 func (b *elap) capture(log *zap.Logger, recvCh chan<- ethertalk.Packet) {
 	defer close(recvCh)
 
-	localAddrs := map[ethernet.Addr]bool{}
 	for {
 		data, ci, err := b.capturer.ReadPacketData()
 		if err != nil {
@@ -131,25 +174,37 @@ func (b *elap) capture(log *zap.Logger, recvCh chan<- ethertalk.Packet) {
 		}
 		if ci.CaptureLength != ci.Length {
 			// DebugLog("truncated packet! %s\n", "");
+		} else if data, err = b.stripFCS(log, data); err != nil {
+			metrics.Drops.WithLabelValues("ethertalk", "fcs").Inc()
+			continue
 		}
 		packet := ethertalk.Packet{}
 		err = ethertalk.Unmarshal(data, &packet)
 		if err != nil {
 			log.With(zap.Error(err)).Error("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues("ethertalk", "ethertalk").Inc()
 			continue
+		} else if packet.Framing == ethertalk.Phase1 {
+			packet, err = b.fromPhase1(log, packet)
+			if err != nil {
+				log.With(zap.Error(err)).Error("unmarshal failed")
+				metrics.UnmarshalFailures.WithLabelValues("ethertalk", "phase1").Inc()
+				continue
+			}
 		}
-		b.packet_handler(recvCh, packet, localAddrs)
+		b.packet_handler(log, recvCh, packet)
 	}
 }
 
 func (b *elap) packet_handler(
+	log *zap.Logger,
 	send chan<- ethertalk.Packet,
 	packet ethertalk.Packet,
-	localAddrs map[ethernet.Addr]bool,
 ) {
 	// Check to make sure the packet we just received wasn't sent
 	// by us (the bridge), otherwise this is how loops happen
 	if packet.Src == b.eth {
+		metrics.Drops.WithLabelValues("ethertalk", "loop").Inc()
 		return
 	}
 
@@ -157,17 +212,104 @@ func (b *elap) packet_handler(
 	// in the list of source addresses we've seen on our network.
 	// If it is, don't bother sending it over the bridge as the
 	// recipient is local.
-	if localAddrs[packet.Dst] {
+	b.mu.Lock()
+	if b.localAddrs.Has(packet.Dst) {
+		b.mu.Unlock()
+		metrics.Drops.WithLabelValues("ethertalk", "local").Inc()
 		return
 	}
 
 	// Destination is remote, but originated locally, so we can add
 	// the source address to our list.
-	localAddrs[packet.Src] = true
+	if b.localAddrs.Touch(packet.Src) {
+		log.Debug("learned local address", zap.Stringer("addr", packet.Src))
+	}
+	b.mu.Unlock()
 
 	send <- packet
 }
 
+var errBadFCS = fmt.Errorf("bad fcs")
+
+// Removes the FCS from the end of a frame, if the NIC delivers it.
+// While the mode is FCSAuto, decides whether it does.
+func (b *elap) stripFCS(log *zap.Logger, data []byte) ([]byte, error) {
+	hasFCS := ethernet.HasFCS(data)
+	switch b.fcs {
+	case FCSAbsent:
+		return data, nil
+	case FCSPresent:
+		if !hasFCS {
+			return nil, errBadFCS
+		}
+	case FCSAuto:
+		if !hasFCS {
+			log.Info("frames have no fcs")
+			b.fcs = FCSAbsent
+			return data, nil
+		}
+		b.fcsVotes++
+		if b.fcsVotes >= fcsDetectFrames {
+			log.Info("frames have fcs; stripping it")
+			b.fcs = FCSPresent
+		}
+	}
+	return data[:len(data)-ethernet.FCSSize], nil
+}
+
+// Converts a Phase 1 packet to Phase 2, which the rest of the group
+// speaks, and remembers that its source needs Phase 1 packets.
+func (b *elap) fromPhase1(log *zap.Logger, packet ethertalk.Packet) (ethertalk.Packet, error) {
+	if packet.Src != b.eth {
+		b.mu.Lock()
+		if b.phase1Addrs.Touch(packet.Src) {
+			log.Info("learned phase 1 address", zap.Stringer("addr", packet.Src))
+		}
+		b.mu.Unlock()
+	}
+	return ethertalk.ToPhase2(packet)
+}
+
+// Periodically forgets local addresses that have not been heard from,
+// even if the network is quiet.
+func (b *elap) expire(ctx context.Context, log *zap.Logger) {
+	ticker := time.NewTicker(b.localAddrs.SweepInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		b.mu.Lock()
+		for _, addr := range b.localAddrs.Expire() {
+			log.Debug("expired local address", zap.Stringer("addr", addr))
+		}
+		for _, addr := range b.phase1Addrs.Expire() {
+			log.Debug("expired phase 1 address", zap.Stringer("addr", addr))
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Addrs returns the source addresses seen on the local network.
+func (b *elap) Addrs() []bridge.LearnedAddr {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var addrs []bridge.LearnedAddr
+	for _, addr := range b.localAddrs.Keys(func(a, b ethernet.Addr) bool {
+		return bytes.Compare(a[:], b[:]) < 0
+	}) {
+		addrs = append(addrs, bridge.LearnedAddr{
+			Addr:     addr.String(),
+			Side:     "local",
+			LastSeen: b.localAddrs.LastSeen(addr),
+		})
+	}
+	return addrs
+}
+
 func (b *elap) setupTransmit(dev string) (transmitter, error) {
 	transmitter, err := pcap.OpenLive(dev, 1, false, 1000)
 	if err != nil {
@@ -178,18 +320,54 @@ func (b *elap) setupTransmit(dev string) (transmitter, error) {
 
 func (b *elap) transmit(log *zap.Logger, ch <-chan ethertalk.Packet) {
 	for packet := range ch {
+		// A packet from the far side with a local source address means
+		// that the address has moved, so packets to it must be bridged.
+		b.mu.Lock()
+		if b.localAddrs.Remove(packet.Src) {
+			log.Warn("local address moved to far side", zap.Stringer("addr", packet.Src))
+		}
+		b.mu.Unlock()
+
 		// Rewrite the source of the packet, so that capture() will know
 		// not to forward it back and create a loop.
 		packet.Src = b.eth
 
-		bin, err := ethertalk.Marshal(packet)
-		if err != nil {
-			log.With(zap.Error(err)).Error("marshal failed")
-			continue
+		for _, framing := range b.framings(packet.Dst) {
+			out := packet
+			if framing == ethertalk.Phase1 {
+				var err error
+				out, err = ethertalk.ToPhase1(packet)
+				if err != nil {
+					log.With(zap.Error(err)).Error("marshal failed")
+					continue
+				}
+			}
+			bin, err := ethertalk.Marshal(out)
+			if err != nil {
+				log.With(zap.Error(err)).Error("marshal failed")
+				continue
+			}
+			err = b.transmitter.WritePacketData(bin)
+			if err != nil {
+				log.With(zap.Error(err)).Error("write packet")
+			}
 		}
-		err = b.transmitter.WritePacketData(bin)
-		if err != nil {
-			log.With(zap.Error(err)).Error("write packet")
+	}
+}
+
+// Returns the framings to send a packet to dst with. Broadcasts are sent
+// with both, if any Phase 1 nodes have been heard from.
+func (b *elap) framings(dst ethernet.Addr) []ethertalk.Framing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if dst[0]&0x01 == 0 {
+		if b.phase1Addrs.Has(dst) {
+			return []ethertalk.Framing{ethertalk.Phase1}
 		}
+		return []ethertalk.Framing{ethertalk.Phase2}
+	}
+	if b.phase1Addrs.Len() > 0 {
+		return []ethertalk.Framing{ethertalk.Phase2, ethertalk.Phase1}
 	}
+	return []ethertalk.Framing{ethertalk.Phase2}
 }
@@ -32,34 +32,171 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/ddp"
 	"github.com/sfiera/multitalk/pkg/llap"
 	"github.com/sfiera/multitalk/pkg/tash"
 	"github.com/tarm/serial"
 	"go.uber.org/zap"
 )
 
+const (
+	minBackoff = 1 * time.Second
+	maxBackoff = 30 * time.Second
+
+	// How often to log a summary of dropped frames, if any.
+	dropSummaryInterval = 1 * time.Minute
+)
+
+// Metric labels for reasons that tash.Decoder drops a frame.
+var dropReasons = map[error]string{
+	tash.ErrFramingError: "framing",
+	tash.ErrFrameAborted: "aborted",
+	tash.ErrBadCRC:       "crc",
+	tash.ErrMalformed:    "malformed",
+}
+
+// Options configures the serial port of a TashTalk unit.
+type Options struct {
+	Baud        int  // TashTalk expects 1,000,000
+	FlowControl bool // use RTS/CTS hardware flow control
+
+	// Firmware features to enable. TashTalk does not report whether it
+	// supports them, so they are enabled as configured. If TashTalk
+	// turns out not to check CRCs, by passing on a frame with a bad
+	// CRC, all features are disabled again.
+	Features tash.Features
+}
+
 type tt struct {
-	device string
-	port   *serial.Port
-	dec    tash.Decoder
+	device   string // as specified by the user, for logging
+	open     func() (io.ReadWriteCloser, error)
+	features tash.Features // requested, or 0 if unsupported
+
+	dec tash.Decoder // used only by read()
+
+	port   io.ReadWriteCloser // nil while disconnected
 	enc    tash.Encoder
+	portMu sync.Mutex
+
+	nodes   tash.NodeSet
+	nodesMu sync.Mutex
+	nodesCh chan struct{} // signals that nodes has changed
+}
+
+func TashTalk(device string, opts Options) (bridge.Bridge, []byte, error) {
+	// If possible, reopen the device by a path that will survive
+	// unplugging and replugging a USB adapter.
+	path := stablePath(device)
+	t, err := newTT(device, func() (io.ReadWriteCloser, error) {
+		return openPort(path, opts)
+	}, opts.Features)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, nil, nil
+}
+
+func newTT(device string, open func() (io.ReadWriteCloser, error), features tash.Features) (*tt, error) {
+	t := &tt{
+		device:   device,
+		open:     open,
+		features: features,
+		nodesCh:  make(chan struct{}, 1),
+	}
+
+	port, err := t.open()
+	if err != nil {
+		return nil, fmt.Errorf("tash open %s: %w", device, err)
+	}
+	t.port = port
+	t.dec = tash.NewDecoder(port)
+	t.enc = tash.NewEncoder(port)
+	err = t.configure()
+	if err != nil {
+		port.Close()
+		return nil, fmt.Errorf("tash configure %s: %w", device, err)
+	}
+	return t, nil
 }
 
-func TashTalk(device string) (bridge.Bridge, []byte, error) {
-	conf := &serial.Config{Name: device, Baud: 1000000}
+// Resets TashTalk and enables the requested features.
+// Called with portMu held, or before starting.
+//
+// The decoder is told only of FeatureCRCChecking, and verifies it until
+// TashTalk confirms it by reporting a bad CRC; see tash.Decoder.
+func (t *tt) configure() error {
+	err := t.enc.Reset()
+	if err != nil {
+		return err
+	}
+	if t.features == 0 {
+		t.dec.SetFeatures(0)
+		return nil
+	}
+	err = t.enc.SetFeatures(t.features | tash.FeatureCRCChecking)
+	if err != nil {
+		return err
+	}
+	t.dec.SetFeatures(tash.FeatureCRCChecking)
+	return nil
+}
+
+// If the decoder found that TashTalk doesn’t check CRCs, it must be
+// older firmware, which doesn’t calculate them either. Stops using
+// features at all, on both the sending and receiving side.
+func (t *tt) checkFeatures(log *zap.Logger) {
+	if t.features == 0 || t.dec.Features()&tash.FeatureCRCChecking != 0 {
+		return
+	}
+	log.Warn("firmware features unsupported; falling back",
+		zap.Uint8("features", uint8(t.features)))
+	t.portMu.Lock()
+	defer t.portMu.Unlock()
+	t.features = 0
+	t.dec.SetFeatures(0)
+	if t.port != nil {
+		err := t.enc.SetFeatures(0)
+		if err != nil {
+			log.With(zap.Error(err)).Error("disable features failed")
+		}
+	}
+}
+
+func openPort(path string, opts Options) (io.ReadWriteCloser, error) {
+	conf := &serial.Config{Name: path, Baud: opts.Baud}
 	port, err := serial.OpenPort(conf)
 	if err != nil {
-		return nil, nil, fmt.Errorf("tash open %s: %w", device, err)
+		return nil, err
 	}
+	if opts.FlowControl {
+		err = setFlowControl(path)
+		if err != nil {
+			port.Close()
+			return nil, fmt.Errorf("flow control: %w", err)
+		}
+	}
+	return port, nil
+}
 
-	return &tt{
-		device: device,
-		port:   port,
-		dec:    tash.NewDecoder(port),
-		enc:    tash.NewEncoder(port),
-	}, nil, nil
+// Returns a /dev/serial/by-id path for device, if there is one.
+func stablePath(device string) string {
+	target, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return device
+	}
+	links, _ := filepath.Glob("/dev/serial/by-id/*")
+	for _, link := range links {
+		if t, err := filepath.EvalSymlinks(link); err == nil && t == target {
+			return link
+		}
+	}
+	return device
 }
 
 func pipe[T any](ch chan T) (<-chan T, chan<- T) { return ch, ch }
@@ -68,10 +205,13 @@ func (t *tt) Start(ctx context.Context, log *zap.Logger) (
 	send chan<- llap.Packet,
 	recv <-chan llap.Packet,
 ) {
-	log = log.With(
-		zap.String("bridge", "udp"),
-		zap.String("device", t.device),
-	)
+	log = log.With(zap.String("device", t.device))
+	t.dec.SetDropFunc(func(reason error, frame []byte) {
+		metrics.TashDrops.WithLabelValues(t.device, dropReasons[reason]).Inc()
+		log.With(zap.Error(reason)).Debug("dropped frame",
+			zap.String("frame", fmt.Sprintf("%x", frame)))
+	})
+	go t.summarizeDrops(ctx, log)
 	sendInCh, sendOutCh := pipe(make(chan llap.Packet))
 	recvInCh, recvOutCh := pipe(make(chan llap.Packet))
 	go t.read(ctx, log, recvOutCh)
@@ -79,19 +219,67 @@ func (t *tt) Start(ctx context.Context, log *zap.Logger) (
 	return sendOutCh, recvInCh
 }
 
+// SetRemoteNodes sets the nodes which TashTalk will answer ENQ and RTS frames for.
+func (t *tt) SetRemoteNodes(nodes []ddp.Node) {
+	t.nodesMu.Lock()
+	t.nodes = tash.NewNodeSet(nodes...)
+	t.nodesMu.Unlock()
+	t.resendNodes()
+}
+
+func (t *tt) resendNodes() {
+	select {
+	case t.nodesCh <- struct{}{}:
+	default: // already pending
+	}
+}
+
 func (t *tt) write(
 	ctx context.Context,
 	log *zap.Logger,
 	llapCh <-chan llap.Packet,
 ) {
-	for packet := range llapCh {
-		err := t.enc.Encode(packet)
-		if err != nil {
-			log.With(zap.Error(err)).Error("send failed")
+	for {
+		select {
+		case packet, ok := <-llapCh:
+			if !ok {
+				return
+			}
+			t.portMu.Lock()
+			err := errDisconnected
+			if t.port != nil {
+				err = t.enc.Encode(packet)
+			}
+			t.portMu.Unlock()
+			if err == errDisconnected {
+				metrics.Drops.WithLabelValues("serial", "disconnected").Inc()
+			} else if err != nil {
+				log.With(zap.Error(err)).Error("send failed")
+			}
+
+		case <-t.nodesCh:
+			t.nodesMu.Lock()
+			nodes := t.nodes
+			t.nodesMu.Unlock()
+			t.portMu.Lock()
+			err := errDisconnected
+			if t.port != nil {
+				err = t.enc.SetNodeIDs(nodes)
+			}
+			t.portMu.Unlock()
+			if err == errDisconnected {
+				// Sent again after reconnecting.
+			} else if err != nil {
+				log.With(zap.Error(err)).Error("set node IDs failed")
+			} else {
+				log.Debug("set node IDs", zap.Stringer("nodes", nodes))
+			}
 		}
 	}
 }
 
+var errDisconnected = fmt.Errorf("disconnected")
+
 func (t *tt) read(
 	ctx context.Context,
 	log *zap.Logger,
@@ -100,18 +288,106 @@ func (t *tt) read(
 	defer close(recvCh)
 	go func() {
 		<-ctx.Done()
-		t.port.Close()
+		t.disconnect()
 	}()
 
 	for {
 		packet := llap.Packet{}
 		err := t.dec.Decode(&packet)
-		if err == io.EOF {
+		t.checkFeatures(log)
+		if ctx.Err() != nil {
 			return
 		} else if err != nil {
+			// Most likely, the adapter was unplugged. Rather than
+			// retrying the read forever, reopen the port.
 			log.With(zap.Error(err)).Error("read failed")
+			t.disconnect()
+			if !t.reconnect(ctx, log) {
+				return
+			}
+			continue
+		} else if llap.Validate(packet) != nil {
+			metrics.UnmarshalFailures.WithLabelValues("serial", "llap").Inc()
 			continue
 		}
 		recvCh <- packet
 	}
 }
+
+// Periodically logs the totals of dropped frames, when they have changed.
+func (t *tt) summarizeDrops(ctx context.Context, log *zap.Logger) {
+	ticker := time.NewTicker(dropSummaryInterval)
+	defer ticker.Stop()
+	last := tash.DecoderStats{}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := t.dec.Stats()
+		if stats == last {
+			continue
+		}
+		last = stats
+		log.Info("dropped frames",
+			zap.Uint64("framing", stats.FramingErrors),
+			zap.Uint64("aborted", stats.Aborts),
+			zap.Uint64("crc", stats.BadCRC),
+			zap.Uint64("malformed", stats.Malformed),
+		)
+	}
+}
+
+func (t *tt) disconnect() {
+	t.portMu.Lock()
+	defer t.portMu.Unlock()
+	if t.port != nil {
+		t.port.Close()
+		t.port = nil
+	}
+}
+
+// Reopens the port, with exponential backoff.
+// Returns false if ctx is done first.
+func (t *tt) reconnect(ctx context.Context, log *zap.Logger) bool {
+	backoff := minBackoff
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+
+		port, err := t.open()
+		if err != nil {
+			log.With(zap.Error(err), zap.Duration("backoff", backoff)).Debug("reopen failed")
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
+		}
+
+		t.portMu.Lock()
+		if ctx.Err() != nil {
+			t.portMu.Unlock()
+			port.Close()
+			return false
+		}
+		t.port = port
+		t.dec.Reset(port)
+		t.enc = tash.NewEncoder(port)
+		err = t.configure()
+		t.portMu.Unlock()
+		if err != nil {
+			log.With(zap.Error(err)).Error("reset failed")
+			t.disconnect()
+			continue
+		}
+
+		log.Info("reconnected")
+		t.resendNodes()
+		return true
+	}
+}
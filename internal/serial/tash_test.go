@@ -0,0 +1,264 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package serial
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+	"github.com/sfiera/multitalk/pkg/llap"
+	"github.com/sfiera/multitalk/pkg/tash"
+	"github.com/sfiera/multitalk/pkg/tash/tashtest"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// Returns an open func which opens each of devices in turn.
+func opener(devices ...*tashtest.Device) func() (io.ReadWriteCloser, error) {
+	return func() (io.ReadWriteCloser, error) {
+		if len(devices) == 0 {
+			return nil, fmt.Errorf("no such device")
+		}
+		d := devices[0]
+		devices = devices[1:]
+		return d.Port(), nil
+	}
+}
+
+func TestTashTalk(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dev := tashtest.NewDevice(0)
+	defer dev.Close()
+	b, err := newTT("test", opener(dev), 0)
+	assert.NoError(err)
+	send, recv := b.Start(ctx, zap.NewNop())
+
+	b.SetRemoteNodes([]ddp.Node{0x10, 0x11})
+	assert.Eventually(func() bool {
+		return dev.Nodes() == tash.NewNodeSet(0x10, 0x11)
+	}, time.Second, time.Millisecond)
+
+	// LocalTalk → bridge, with ENQs for remote nodes answered.
+	go func() {
+		dev.Receive(*llap.Enq(0x10, 0x10))
+		dev.Receive(*llap.Enq(0x20, 0x20))
+	}()
+	assert.Equal(*llap.Enq(0x10, 0x10), <-recv)
+	assert.Equal(*llap.Enq(0x20, 0x20), <-recv)
+	assert.Equal(*llap.Ack(0x10, 0x10), <-dev.Wire())
+
+	// Bridge → LocalTalk.
+	pak := llap.Packet{
+		Header:  llap.Header{DstNode: 0x20, SrcNode: 0x10, Kind: llap.TypeDDP},
+		Payload: []byte{0x00, 0x07, 0x02, 0x02, 0x02, 0x00, 0xaa},
+	}
+	send <- pak
+	assert.Equal(pak, <-dev.Wire())
+}
+
+func TestTashTalkFeatures(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dev := tashtest.NewDevice(tash.FeatureCRCCalculation | tash.FeatureCRCChecking)
+	defer dev.Close()
+	b, err := newTT("test", opener(dev), tash.FeatureCRCCalculation|tash.FeatureCRCChecking)
+	assert.NoError(err)
+	send, recv := b.Start(ctx, zap.NewNop())
+
+	// Features are enabled from the start, and frames are sent without
+	// a CRC, for TashTalk to calculate.
+	assert.Eventually(func() bool {
+		return dev.Features() == tash.FeatureCRCCalculation|tash.FeatureCRCChecking
+	}, time.Second, time.Millisecond)
+	data := llap.Packet{
+		Header:  llap.Header{DstNode: 0x20, SrcNode: 0x10, Kind: llap.TypeDDP},
+		Payload: []byte{0x00, 0x07, 0x02, 0x02, 0x02, 0x00, 0xaa},
+	}
+	enq := *llap.Enq(0x20, 0x20)
+	send <- data
+	send <- enq
+	assert.Equal(data, <-dev.Wire())
+	assert.Equal(enq, <-dev.Wire())
+
+	// TashTalk reports bad CRCs itself, which confirms checking.
+	go func() {
+		dev.ReceiveFrame([]byte{0x02, 0x01, 0x81, 0xea, 0xea})
+		dev.Receive(enq)
+	}()
+	assert.Equal(enq, <-recv)
+	assert.Equal(uint64(1), b.dec.Stats().BadCRC)
+	assert.True(b.dec.Confirmed())
+	assert.Equal(tash.FeatureCRCChecking, b.dec.Features())
+
+	send <- data
+	assert.Equal(data, <-dev.Wire())
+	assert.Equal(tash.FeatureCRCCalculation|tash.FeatureCRCChecking, dev.Features())
+}
+
+func TestTashTalkLegacyFeatures(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dev := tashtest.NewDevice(0)
+	defer dev.Close()
+	b, err := newTT("test", opener(dev), tash.FeatureCRCCalculation|tash.FeatureCRCChecking)
+	assert.NoError(err)
+	send, recv := b.Start(ctx, zap.NewNop())
+
+	// Older firmware waits for the CRC of a frame sent without one.
+	pak := *llap.Enq(0x20, 0x20)
+	send <- pak
+
+	// A bad CRC that TashTalk passes on shows that it doesn’t check.
+	go func() {
+		dev.ReceiveFrame([]byte{0x02, 0x01, 0x81, 0xea, 0xea})
+		dev.Receive(pak)
+	}()
+	assert.Equal(pak, <-recv)
+	assert.Equal(uint64(1), b.dec.Stats().BadCRC)
+	assert.Equal(tash.Features(0), b.dec.Features())
+
+	// The command disabling features completes the waiting frame with a
+	// bad CRC, so it is not transmitted. Later frames are, with a CRC.
+	for i := 0; i < 3; i++ {
+		send <- pak
+		assert.Equal(pak, <-dev.Wire())
+	}
+	select {
+	case extra := <-dev.Wire():
+		t.Errorf("unexpected frame %v", extra)
+	case <-time.After(20 * time.Millisecond):
+	}
+	go dev.Receive(*llap.Enq(0x30, 0x30))
+	assert.Equal(*llap.Enq(0x30, 0x30), <-recv)
+	assert.Equal(tash.Features(0), dev.Features())
+}
+
+func TestTashTalkReconnect(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dev1 := tashtest.NewDevice(0)
+	dev2 := tashtest.NewDevice(0)
+	defer dev2.Close()
+	b, err := newTT("test", opener(dev1, dev2), 0)
+	assert.NoError(err)
+	_, recv := b.Start(ctx, zap.NewNop())
+	b.SetRemoteNodes([]ddp.Node{0x10})
+	assert.Eventually(func() bool {
+		return dev1.Nodes().IsSet(0x10)
+	}, time.Second, time.Millisecond)
+
+	// Unplug; after reconnecting, the node IDs are set again.
+	dev1.Close()
+	assert.Eventually(func() bool {
+		return dev2.Nodes().IsSet(0x10)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	go dev2.Receive(*llap.Enq(0x20, 0x20))
+	assert.Equal(*llap.Enq(0x20, 0x20), <-recv)
+}
+
+// Returns a DDP packet from an EtherTalk node.
+func etherTalkDDP(t *testing.T, src ddp.Addr, dst ddp.Addr) ethertalk.Packet {
+	pak, err := ethertalk.AppleTalk(ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, byte(src.Node)}, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      14,
+			DstNet:    dst.Network,
+			DstNode:   dst.Node,
+			DstSocket: 4,
+			SrcNet:    src.Network,
+			SrcNode:   src.Node,
+			SrcSocket: 4,
+			Proto:     ddp.ProtoAEP,
+		},
+		Data: []byte{0x01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pak
+}
+
+func TestRouterNodeMask(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dev := tashtest.NewDevice(0)
+	defer dev.Close()
+	b, err := newTT("test", opener(dev), 0)
+	assert.NoError(err)
+	r := bridge.Extend(b, []byte{0x08, 0x00, 0x07, 0xaa, 0xbb, 0xcc}, bridge.RouterOptions{Network: 5})
+	send, recv := r.Start(ctx, zap.NewNop())
+	go func() {
+		for range recv {
+		}
+	}()
+
+	// Nodes heard from on the EtherTalk side are answered for.
+	send <- etherTalkDDP(t, ddp.Addr{Network: 5, Node: 0x30}, ddp.Addr{Network: 5, Node: 0x20})
+	send <- etherTalkDDP(t, ddp.Addr{Network: 5, Node: 0x31}, ddp.Addr{Network: 5, Node: 0x20})
+	<-dev.Wire()
+	<-dev.Wire()
+	assert.Eventually(func() bool {
+		return dev.Nodes() == tash.NewNodeSet(0x30, 0x31)
+	}, time.Second, time.Millisecond)
+	go dev.Receive(*llap.Enq(0x30, 0x30))
+	assert.Equal(*llap.Ack(0x30, 0x30), <-dev.Wire())
+
+	// Nodes on other networks are not on the LocalTalk network.
+	send <- etherTalkDDP(t, ddp.Addr{Network: 7, Node: 0x40}, ddp.Addr{Network: 5, Node: 0x20})
+	<-dev.Wire()
+	assert.Never(func() bool {
+		return dev.Nodes().IsSet(0x40)
+	}, 50*time.Millisecond, time.Millisecond)
+
+	// A node heard from on the LocalTalk wire itself is not.
+	assert.NoError(dev.Receive(llap.Packet{
+		Header:  llap.Header{DstNode: 0x20, SrcNode: 0x31, Kind: llap.TypeDDP},
+		Payload: []byte{0x00, 0x06, 0x04, 0x04, 0x04, 0x01},
+	}))
+	assert.Eventually(func() bool {
+		return dev.Nodes() == tash.NewNodeSet(0x30)
+	}, time.Second, time.Millisecond)
+}
@@ -39,11 +39,17 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
 	"github.com/sfiera/multitalk/pkg/ethertalk"
 )
 
 type client struct {
 	conn net.Conn
+	kind string // the kind of group member, for logs and metrics
+
+	// QEMU’s socket and stream netdevs use the same framing, but carry
+	// all Ethernet frames, not only AppleTalk ones.
+	qemu bool
 }
 
 func TCPClient(server string) (bridge.ExtBridge, error) {
@@ -51,14 +57,28 @@ func TCPClient(server string) (bridge.ExtBridge, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dial %s: %s", server, err.Error())
 	}
-	return &client{conn}, nil
+	return &client{conn: conn, kind: "tcp-client"}, nil
+}
+
+// QEMUClient connects to QEMU, listening with
+// -netdev socket,listen=… or -netdev stream,server=on,….
+func QEMUClient(server string) (bridge.ExtBridge, error) {
+	conn, err := net.Dial("tcp", server)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %s", server, err.Error())
+	}
+	return &client{conn: conn, kind: "qemu-client", qemu: true}, nil
+}
+
+// Returns the name of the bridge, for logs and metrics.
+func (c *client) name() string {
+	return c.kind
 }
 
 func (c *client) Start(ctx context.Context, log *zap.Logger) (
 	send chan<- ethertalk.Packet,
 	recv <-chan ethertalk.Packet,
 ) {
-	log = log.With(zap.String("bridge", "tcp"))
 	sendCh := make(chan ethertalk.Packet)
 	recvCh := make(chan ethertalk.Packet)
 	go c.capture(ctx, log, recvCh)
@@ -80,6 +100,8 @@ func (c *client) transmit(ctx context.Context, log *zap.Logger, sendCh <-chan et
 
 func (c *client) capture(ctx context.Context, log *zap.Logger, recvCh chan<- ethertalk.Packet) {
 	defer close(recvCh)
+	metrics.TCPConnections.Inc()
+	defer metrics.TCPConnections.Dec()
 	go func() {
 		<-ctx.Done()
 		c.conn.Close()
@@ -100,12 +122,18 @@ func (c *client) capture(ctx context.Context, log *zap.Logger, recvCh chan<- eth
 
 		if length > 4096 {
 			log.With(zap.Error(err), zap.Uint32("length", length)).Error("invalid length")
+			metrics.Drops.WithLabelValues(c.name(), "length").Inc()
+			_, err = io.CopyN(io.Discard, c.conn, int64(length))
+			if err != nil {
+				log.With(zap.Error(err)).Error("recv packet failed")
+				return
+			}
 			continue
 		}
 		// DebugLog("receiving packet of length: %u\n", length);
 
 		data := make([]byte, length)
-		_, err = c.conn.Read(data)
+		_, err = io.ReadFull(c.conn, data)
 		if err != nil {
 			log.With(zap.Error(err)).Error("recv packet failed")
 			return
@@ -114,8 +142,13 @@ func (c *client) capture(ctx context.Context, log *zap.Logger, recvCh chan<- eth
 
 		packet := ethertalk.Packet{}
 		err = ethertalk.Unmarshal(data, &packet)
-		if err != nil {
+		if err != nil && c.qemu {
+			// Most likely an Ethernet II frame, such as IP.
+			metrics.Drops.WithLabelValues(c.name(), "proto").Inc()
+			continue
+		} else if err != nil {
 			log.With(zap.Error(err)).Error("unmarshal failed")
+			metrics.UnmarshalFailures.WithLabelValues(c.name(), "ethertalk").Inc()
 			continue
 		}
 
@@ -127,7 +160,14 @@ func (c *client) capture(ctx context.Context, log *zap.Logger, recvCh chan<- eth
 			(packet.SNAPProto == ethertalk.AppleTalkProto)) {
 			// Not an appletalk or aarp frame, drop it.
 			// DebugLog("Not an AppleTalk or AARP frame, dropping: %d\n", packet.Proto);
+			metrics.Drops.WithLabelValues(c.name(), "proto").Inc()
 			continue
+		} else if packet.Framing == ethertalk.Phase1 {
+			packet, err = ethertalk.ToPhase2(packet)
+			if err != nil {
+				metrics.Drops.WithLabelValues(c.name(), "proto").Inc()
+				continue
+			}
 		}
 
 		recvCh <- packet
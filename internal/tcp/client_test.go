@@ -0,0 +1,146 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package tcp
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+func testFrame(t *testing.T, data ...byte) (ethertalk.Packet, []byte) {
+	packet, err := ethertalk.AppleTalk(
+		ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03},
+		ddp.ExtPacket{
+			ExtHeader: ddp.ExtHeader{
+				Size:      uint16(13 + len(data)),
+				DstNet:    20,
+				DstNode:   0xff,
+				DstSocket: 4,
+				SrcNet:    10,
+				SrcNode:   1,
+				SrcSocket: 4,
+				Proto:     ddp.ProtoAEP,
+			},
+			Data: data,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := ethertalk.Marshal(*packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *packet, bin
+}
+
+// Writes data to conn as QEMU frames it, after its length.
+func writeFrame(t *testing.T, conn net.Conn, data []byte) {
+	err := binary.Write(conn, binary.BigEndian, uint32(len(data)))
+	if err == nil {
+		_, err = conn.Write(data)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQEMUStream(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Acts as QEMU, with -netdev stream,server=on.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := QEMUClient(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	qemu, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qemu.Close()
+	qemu.SetDeadline(time.Now().Add(time.Second))
+	send, recv := c.Start(ctx, zap.NewNop())
+
+	// Each frame is sent after its length, as a 32-bit big-endian
+	// integer.
+	packet, bin := testFrame(t, 1, 2, 3)
+	send <- packet
+	length := uint32(0)
+	assert.NoError(binary.Read(qemu, binary.BigEndian, &length))
+	assert.Equal(uint32(len(bin)), length)
+	got := make([]byte, length)
+	_, err = io.ReadFull(qemu, got)
+	assert.NoError(err)
+	assert.Equal(bin, got)
+
+	// Frames from QEMU that aren’t AppleTalk, or are too long, are
+	// skipped without losing the framing of those that follow.
+	ipv4 := append([]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x52, 0x54, 0x00, 0x12, 0x34, 0x56,
+		0x08, 0x00,
+	}, make([]byte, 46)...)
+	writeFrame(t, qemu, ipv4)
+	writeFrame(t, qemu, make([]byte, 5000))
+	packet, bin = testFrame(t, 4, 5, 6)
+	writeFrame(t, qemu, bin)
+
+	select {
+	case got := <-recv:
+		assert.Equal(packet.Src, got.Src)
+		assert.Equal(packet.Payload, got.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("frame not received")
+	}
+
+	// The bridge closes when QEMU does.
+	qemu.Close()
+	select {
+	case _, ok := <-recv:
+		assert.False(ok)
+	case <-time.After(time.Second):
+		t.Fatal("not closed")
+	}
+}
@@ -40,6 +40,7 @@ import (
 
 type server struct {
 	listen net.Listener
+	qemu   bool
 }
 
 func TCPServer(listen string) (*server, error) {
@@ -47,7 +48,17 @@ func TCPServer(listen string) (*server, error) {
 	if err != nil {
 		return nil, fmt.Errorf("dial %s: %s", listen, err.Error())
 	}
-	return &server{l}, nil
+	return &server{listen: l}, nil
+}
+
+// QEMUServer accepts connections from QEMU, connecting with
+// -netdev socket,connect=… or -netdev stream,server=off,….
+func QEMUServer(listen string) (*server, error) {
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %s", listen, err.Error())
+	}
+	return &server{listen: l, qemu: true}, nil
 }
 
 func (s *server) Serve(ctx context.Context, log *zap.Logger, grp *bridge.Group) {
@@ -57,11 +68,15 @@ func (s *server) Serve(ctx context.Context, log *zap.Logger, grp *bridge.Group)
 			if err != nil {
 				continue
 			}
+			cl := &client{conn: c, kind: "tcp-server", qemu: s.qemu}
+			if s.qemu {
+				cl.kind = "qemu-server"
+			}
 			log.With(
-				zap.String("bridge", "tcp"),
+				zap.String("bridge", cl.name()),
 				zap.Stringer("remoteAddr", c.RemoteAddr()),
 			).Info("opened")
-			grp.Add((&client{c}).Start(ctx, log))
+			grp.Add(ctx, log, cl.name(), c.RemoteAddr().String(), cl)
 		}
 	}()
 }
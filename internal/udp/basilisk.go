@@ -0,0 +1,227 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package udp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// Default port of the Basilisk II and SheepShaver UDP tunnel.
+const BasiliskPort = 6066
+
+// Basilisk II and SheepShaver exchange raw Ethernet frames by UDP,
+// broadcast on the local subnet. An emulated Mac’s hardware address is
+// 'B', '2', then the IPv4 address of its host, so that unicast frames
+// can be sent directly to it.
+type basilisk struct {
+	iface     *net.Interface
+	conn      *net.UDPConn // receives on the tunnel port
+	sendConn  *net.UDPConn // sends from the bind port; may be conn
+	port      int
+	broadcast net.IP
+	local     []net.IP
+}
+
+// Basilisk returns a bridge to emulators on the subnet of iface, which
+// receives on the tunnel port and sends from bindPort, or from the
+// tunnel port if bindPort is 0.
+//
+// An emulator on the same host shares the tunnel port, if both bind it
+// with SO_REUSEADDR. Sending from another port then tells this bridge’s
+// broadcasts apart from the emulator’s; if the ports are the same, only
+// frames from the emulator’s own hardware address are taken as its.
+// Either way, frames unicast to an emulator on this host may be
+// received by only one of the two sockets.
+func Basilisk(iface string, port, bindPort int) (bridge.ExtBridge, error) {
+	i, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %s", iface, err.Error())
+	}
+	b := basilisk{iface: i, port: port}
+
+	addrs, err := i.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface %s: %s", iface, err.Error())
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.To4() == nil {
+			continue
+		}
+		ip, mask := ipNet.IP.To4(), net.IP(ipNet.Mask).To4()
+		if b.broadcast == nil && mask != nil {
+			b.broadcast = make(net.IP, 4)
+			for j := range ip {
+				b.broadcast[j] = ip[j] | ^mask[j]
+			}
+		}
+		b.local = append(b.local, ip)
+	}
+	if b.broadcast == nil {
+		return nil, fmt.Errorf("interface %s: no IPv4 address", iface)
+	}
+
+	b.conn, err = listenShared(port)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %s", iface, err.Error())
+	}
+	b.sendConn = b.conn
+	if bindPort != 0 && bindPort != port {
+		b.sendConn, err = net.ListenUDP("udp4", &net.UDPAddr{Port: bindPort})
+		if err != nil {
+			b.conn.Close()
+			return nil, fmt.Errorf("listen %s: %s", iface, err.Error())
+		}
+	}
+	return &b, nil
+}
+
+func (b *basilisk) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	log = log.With(zap.String("iface", b.iface.Name))
+	sendCh := make(chan ethertalk.Packet)
+	recvCh := make(chan ethertalk.Packet)
+	go b.capture(ctx, log, recvCh)
+	go b.transmit(ctx, log, sendCh)
+	return sendCh, recvCh
+}
+
+func (b *basilisk) transmit(
+	ctx context.Context,
+	log *zap.Logger,
+	sendCh <-chan ethertalk.Packet,
+) {
+	for packet := range sendCh {
+		dst := &net.UDPAddr{IP: b.broadcast, Port: b.port}
+		if packet.Dst[0]&0x01 == 0 {
+			ip, ok := basiliskIP(packet.Dst)
+			if !ok {
+				// Unicast to a node that isn’t an emulator.
+				metrics.Drops.WithLabelValues("basilisk", "unicast").Inc()
+				continue
+			}
+			dst.IP = ip
+		}
+
+		data, err := ethertalk.Marshal(packet)
+		if err != nil {
+			log.With(zap.Error(err)).Error("marshal failed")
+			continue
+		}
+		_, err = b.sendConn.WriteToUDP(data, dst)
+		if err != nil {
+			log.With(zap.Error(err)).Error("send failed")
+		}
+	}
+}
+
+func (b *basilisk) capture(
+	ctx context.Context,
+	log *zap.Logger,
+	recvCh chan<- ethertalk.Packet,
+) {
+	defer close(recvCh)
+	go func() {
+		<-ctx.Done()
+		b.conn.Close()
+		b.sendConn.Close()
+	}()
+
+	bin := make([]byte, 1518)
+	for {
+		n, addr, err := b.conn.ReadFromUDP(bin)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.With(zap.Error(err)).Error("recv failed")
+			return
+		}
+
+		if n < ethertalk.EthHeaderSize+1 || binary.BigEndian.Uint16(bin[12:14]) > 1500 {
+			// Ethernet II, such as IP: not EtherTalk.
+			metrics.Drops.WithLabelValues("basilisk", "proto").Inc()
+			continue
+		}
+
+		packet := ethertalk.Packet{}
+		err = ethertalk.Unmarshal(bin[:n], &packet)
+		if err != nil {
+			metrics.UnmarshalFailures.WithLabelValues("basilisk", "ethertalk").Inc()
+			continue
+		} else if b.isSender(addr, packet) {
+			// Our own broadcasts are received back again.
+			metrics.Drops.WithLabelValues("basilisk", "loop").Inc()
+			continue
+		} else if packet.SNAPProto != ethertalk.AARPProto && packet.SNAPProto != ethertalk.AppleTalkProto {
+			metrics.Drops.WithLabelValues("basilisk", "proto").Inc()
+			continue
+		}
+
+		select {
+		case recvCh <- packet:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns true if packet came from this bridge’s own socket, rather
+// than from an emulator on this host sharing its address.
+func (b *basilisk) isSender(from *net.UDPAddr, packet ethertalk.Packet) bool {
+	if from.Port != b.sendConn.LocalAddr().(*net.UDPAddr).Port {
+		return false
+	} else if ip, ok := basiliskIP(packet.Src); ok && ip.Equal(from.IP) {
+		return false
+	}
+	for _, ip := range b.local {
+		if ip.Equal(from.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the host of an emulated Mac, given its hardware address.
+func basiliskIP(addr ethernet.Addr) (net.IP, bool) {
+	if addr[0] != 'B' || addr[1] != '2' {
+		return nil, false
+	}
+	return net.IPv4(addr[2], addr[3], addr[4], addr[5]), true
+}
@@ -0,0 +1,162 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+var (
+	bridgedMAC  = ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}
+	emulatorMAC = ethernet.Addr{'B', '2', 127, 0, 0, 1}
+)
+
+func testFrame(t *testing.T, src ethernet.Addr, data ...byte) ethertalk.Packet {
+	packet, err := ethertalk.AppleTalk(src, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      uint16(13 + len(data)),
+			DstNet:    20,
+			DstNode:   0xff,
+			DstSocket: 4,
+			SrcNet:    10,
+			SrcNode:   1,
+			SrcSocket: 4,
+			Proto:     ddp.ProtoAEP,
+		},
+		Data: data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *packet
+}
+
+// Returns the next frame sent to conn, and the address it came from.
+func readFrame(t *testing.T, conn *net.UDPConn) (ethertalk.Packet, *net.UDPAddr) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	bin := make([]byte, 1518)
+	n, addr, err := conn.ReadFromUDP(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := ethertalk.Packet{}
+	if err := ethertalk.Unmarshal(bin[:n], &packet); err != nil {
+		t.Fatal(err)
+	}
+	return packet, addr
+}
+
+func TestBasiliskLoopback(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		bindPort bool // whether to send from a port other than the tunnel’s
+		src      ethernet.Addr
+	}{
+		{"shared-port", false, emulatorMAC},
+		{"bind-port-emulator", true, emulatorMAC},
+		{"bind-port-bridged", true, bridgedMAC},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Acts as an emulator on the same host, sharing the port.
+			emulator, err := listenShared(0)
+			if err != nil {
+				t.Skipf("listen: %s", err.Error())
+			}
+			defer emulator.Close()
+			port := emulator.LocalAddr().(*net.UDPAddr).Port
+
+			bindPort := 0
+			if tt.bindPort {
+				conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				bindPort = conn.LocalAddr().(*net.UDPAddr).Port
+				conn.Close()
+			}
+
+			b, err := Basilisk("lo", port, bindPort)
+			if err != nil {
+				t.Skipf("basilisk: %s", err.Error())
+			}
+			send, recv := b.Start(ctx, zap.NewNop())
+
+			// The bridge’s broadcast reaches the emulator, and is
+			// received back by the bridge too, which must drop it.
+			sent := testFrame(t, bridgedMAC, 1)
+			send <- sent
+			got, from := readFrame(t, emulator)
+			assert.Equal(sent.Payload, got.Payload)
+			if tt.bindPort {
+				assert.Equal(bindPort, from.Port)
+			} else {
+				assert.Equal(port, from.Port)
+			}
+
+			// The emulator’s broadcast is received, although it comes
+			// from the same host.
+			frame := testFrame(t, tt.src, 2)
+			data, err := ethertalk.Marshal(frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = emulator.WriteToUDP(data, &net.UDPAddr{
+				IP:   net.IPv4(127, 255, 255, 255),
+				Port: port,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case got := <-recv:
+				assert.Equal(tt.src, got.Src)
+				assert.Equal(frame.Payload, got.Payload)
+			case <-time.After(time.Second):
+				t.Fatal("emulator’s frame not received")
+			}
+
+			cancel()
+			for range recv {
+			}
+		})
+	}
+}
@@ -35,6 +35,7 @@ import (
 	"os"
 
 	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
 	"github.com/sfiera/multitalk/pkg/llap"
 	"github.com/sfiera/multitalk/pkg/ltou"
 	"go.uber.org/zap"
@@ -70,10 +71,7 @@ func (b *multicast) Start(ctx context.Context, log *zap.Logger) (
 	send chan<- llap.Packet,
 	recv <-chan llap.Packet,
 ) {
-	log = log.With(
-		zap.String("bridge", "udp"),
-		zap.String("iface", b.iface.Name),
-	)
+	log = log.With(zap.String("iface", b.iface.Name))
 	sendInCh, sendOutCh := pipe(make(chan llap.Packet))
 	recvInCh, recvOutCh := pipe(make(chan llap.Packet))
 	go b.capture(ctx, log, recvOutCh)
@@ -125,12 +123,17 @@ func (b *multicast) capture(
 		packet := ltou.Packet{}
 		err = ltou.Unmarshal(bin[:n], &packet)
 		if err != nil {
+			metrics.UnmarshalFailures.WithLabelValues("multicast", "ltou").Inc()
+			continue
+		} else if llap.Validate(packet.LLAP) != nil {
+			metrics.UnmarshalFailures.WithLabelValues("multicast", "llap").Inc()
 			continue
 		}
 
 		if b.isSender(addr, packet) {
 			// If this bridge sent the packet, avoid a loop by ignoring
 			// it when it’s received back again via multicast.
+			metrics.Drops.WithLabelValues("multicast", "loop").Inc()
 			continue
 		}
 
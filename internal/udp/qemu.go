@@ -0,0 +1,224 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package udp
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// QEMU’s dgram and socket netdevs send one Ethernet frame per datagram,
+// with no length prefix, either to a single peer or to a multicast group.
+type qemu struct {
+	recvConn, sendConn *net.UDPConn
+	remote             *net.UDPAddr
+	multicast          bool
+
+	// Addresses of this host, from which our own frames come back.
+	localIPs []net.IP
+}
+
+// QEMUDgram exchanges frames with QEMU at remote. QEMU is configured
+// with the addresses the other way around, as with
+// -netdev socket,udp=local,localaddr=remote.
+func QEMUDgram(local, remote string) (bridge.ExtBridge, error) {
+	localAddr, err := net.ResolveUDPAddr("udp4", local)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %s", local, err.Error())
+	}
+	remoteAddr, err := net.ResolveUDPAddr("udp4", remote)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %s", remote, err.Error())
+	}
+	conn, err := net.ListenUDP("udp4", localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %s", local, err.Error())
+	}
+	return &qemu{recvConn: conn, sendConn: conn, remote: remoteAddr}, nil
+}
+
+// QEMUMulticast joins the multicast group of QEMU instances configured
+// with -netdev socket,mcast=group or -netdev dgram,remote.…=group.
+func QEMUMulticast(group string) (bridge.ExtBridge, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp4", group)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %s", group, err.Error())
+	}
+	recvConn, err := net.ListenMulticastUDP("udp4", nil, groupAddr)
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %s", group, err.Error())
+	}
+	// Sent from a separate port, so that our own frames can be told
+	// apart when they are received back from the group.
+	sendConn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		recvConn.Close()
+		return nil, fmt.Errorf("listen %s: %s", group, err.Error())
+	}
+	localIPs, err := interfaceIPs()
+	if err != nil {
+		recvConn.Close()
+		sendConn.Close()
+		return nil, err
+	}
+	return &qemu{
+		recvConn:  recvConn,
+		sendConn:  sendConn,
+		remote:    groupAddr,
+		multicast: true,
+		localIPs:  localIPs,
+	}, nil
+}
+
+// Returns the name of the bridge, for metrics.
+func (b *qemu) name() string {
+	if b.multicast {
+		return "qemu-mcast"
+	}
+	return "qemu-dgram"
+}
+
+func (b *qemu) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	log = log.With(zap.Stringer("remoteAddr", b.remote))
+	sendCh := make(chan ethertalk.Packet)
+	recvCh := make(chan ethertalk.Packet)
+	go b.capture(ctx, log, recvCh)
+	go b.transmit(ctx, log, sendCh)
+	return sendCh, recvCh
+}
+
+func (b *qemu) transmit(
+	ctx context.Context,
+	log *zap.Logger,
+	sendCh <-chan ethertalk.Packet,
+) {
+	for packet := range sendCh {
+		data, err := ethertalk.Marshal(packet)
+		if err != nil {
+			log.With(zap.Error(err)).Error("marshal failed")
+			continue
+		}
+		_, err = b.sendConn.WriteToUDP(data, b.remote)
+		if err != nil {
+			log.With(zap.Error(err)).Error("send failed")
+		}
+	}
+}
+
+func (b *qemu) capture(
+	ctx context.Context,
+	log *zap.Logger,
+	recvCh chan<- ethertalk.Packet,
+) {
+	defer close(recvCh)
+	go func() {
+		<-ctx.Done()
+		b.recvConn.Close()
+		b.sendConn.Close()
+	}()
+
+	bin := make([]byte, 65536)
+	for {
+		n, addr, err := b.recvConn.ReadFromUDP(bin)
+		if ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.With(zap.Error(err)).Error("recv failed")
+			return
+		}
+
+		if b.multicast && b.isSender(addr) {
+			metrics.Drops.WithLabelValues(b.name(), "loop").Inc()
+			continue
+		} else if !b.multicast && !addr.IP.Equal(b.remote.IP) {
+			metrics.Drops.WithLabelValues(b.name(), "peer").Inc()
+			continue
+		}
+
+		packet := ethertalk.Packet{}
+		err = ethertalk.Unmarshal(bin[:n], &packet)
+		if err != nil {
+			// Most likely an Ethernet II frame, such as IP.
+			metrics.Drops.WithLabelValues(b.name(), "proto").Inc()
+			continue
+		} else if packet.SNAPProto != ethertalk.AARPProto && packet.SNAPProto != ethertalk.AppleTalkProto {
+			metrics.Drops.WithLabelValues(b.name(), "proto").Inc()
+			continue
+		}
+		if packet.Framing == ethertalk.Phase1 {
+			packet, err = ethertalk.ToPhase2(packet)
+			if err != nil {
+				metrics.Drops.WithLabelValues(b.name(), "proto").Inc()
+				continue
+			}
+		}
+
+		select {
+		case recvCh <- packet:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *qemu) isSender(from *net.UDPAddr) bool {
+	if from.Port != b.sendConn.LocalAddr().(*net.UDPAddr).Port {
+		return false
+	}
+	for _, ip := range b.localIPs {
+		if ip.Equal(from.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lists the addresses of this host’s interfaces.
+func interfaceIPs() ([]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("interface addrs: %s", err.Error())
+	}
+	ips := []net.IP{}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package udp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+func TestQEMUDgram(t *testing.T) {
+	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Acts as QEMU, with -netdev dgram,local.…,remote.….
+	qemu, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qemu.Close()
+	local, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bridgeAddr := local.LocalAddr().(*net.UDPAddr)
+	local.Close()
+
+	b, err := QEMUDgram(bridgeAddr.String(), qemu.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	send, recv := b.Start(ctx, zap.NewNop())
+
+	// Each frame is a datagram of its own, with no length prefix.
+	packet := testFrame(t, bridgedMAC, 1, 2, 3)
+	bin, err := ethertalk.Marshal(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send <- packet
+	got, from := readFrame(t, qemu)
+	assert.Equal(bridgeAddr.String(), from.String())
+	assert.Equal(packet.Payload, got.Payload)
+
+	// Frames from other hosts, and frames that aren’t AppleTalk, are
+	// dropped.
+	stranger, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err == nil {
+		defer stranger.Close()
+		_, err = stranger.WriteToUDP(bin, bridgeAddr)
+		assert.NoError(err)
+	}
+	ipv4 := append([]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0x52, 0x54, 0x00, 0x12, 0x34, 0x56,
+		0x08, 0x00,
+	}, make([]byte, 46)...)
+	_, err = qemu.WriteToUDP(ipv4, bridgeAddr)
+	assert.NoError(err)
+
+	packet = testFrame(t, emulatorMAC, 4, 5, 6)
+	bin, err = ethertalk.Marshal(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = qemu.WriteToUDP(bin, bridgeAddr)
+	assert.NoError(err)
+	select {
+	case got := <-recv:
+		assert.Equal(packet.Src, got.Src)
+		assert.Equal(packet.Payload, got.Payload)
+	case <-time.After(time.Second):
+		t.Fatal("frame not received")
+	}
+
+	cancel()
+	for range recv {
+	}
+}
@@ -0,0 +1,243 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+// Communicates with VDE (Virtual Distributed Ethernet) switches
+package vde
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/cpu"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/internal/metrics"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+const (
+	// Sent in each request to the control socket.
+	magic   = 0xfeedface
+	version = 3
+
+	reqNewControl = 0 // request a port, numbered by the switch
+
+	descrSize = 128
+)
+
+type (
+	// Struct request_v3 of libvdeplug. Integers are in host byte order.
+	request struct {
+		Magic, Version uint32
+		Type           int32
+		Sock           sockaddrUn
+		Description    [descrSize]byte
+	}
+
+	plug struct {
+		switchPath string
+		ctl        net.Conn
+		data       *net.UnixConn
+		dataPath   string // our end of the data socket
+		port       *net.UnixAddr
+	}
+)
+
+var plugs int32
+
+// Plug connects to a vde_switch as a new port. path is the switch’s
+// control directory, such as /tmp/vde.ctl, or the control socket in it.
+func Plug(path string) (bridge.ExtBridge, error) {
+	ctlPath := path
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		ctlPath = filepath.Join(path, "ctl")
+	}
+	p := &plug{switchPath: path}
+
+	var err error
+	p.dataPath = filepath.Join(os.TempDir(), fmt.Sprintf("vde.%05d-%05d",
+		os.Getpid(), atomic.AddInt32(&plugs, 1)))
+	os.Remove(p.dataPath)
+	p.data, err = net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p.dataPath, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("vde %s: %s", path, err.Error())
+	}
+
+	p.ctl, err = net.Dial("unix", ctlPath)
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("vde %s: %s", path, err.Error())
+	}
+
+	p.port, err = p.request()
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("vde %s: %s", path, err.Error())
+	}
+	return p, nil
+}
+
+// Asks the switch for a port, returning the address to send frames to.
+func (p *plug) request() (*net.UnixAddr, error) {
+	req := request{
+		Magic:   magic,
+		Version: version,
+		Type:    reqNewControl,
+		Sock:    newSockaddrUn(p.dataPath),
+	}
+	copy(req.Description[:], fmt.Sprintf("multitalk pid=%d", os.Getpid()))
+	err := binary.Write(p.ctl, hostOrder(), req)
+	if err != nil {
+		return nil, fmt.Errorf("send request: %s", err.Error())
+	}
+
+	rsp := sockaddrUn{}
+	err = binary.Read(p.ctl, hostOrder(), &rsp)
+	if err != nil {
+		return nil, fmt.Errorf("read response: %s", err.Error())
+	}
+	path := rsp.path()
+	if path == "" {
+		return nil, fmt.Errorf("read response: switch refused port")
+	}
+	return &net.UnixAddr{Name: path, Net: "unixgram"}, nil
+}
+
+func hostOrder() binary.ByteOrder {
+	if cpu.IsBigEndian {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+func (p *plug) close() {
+	if p.ctl != nil {
+		p.ctl.Close()
+	}
+	p.data.Close()
+	os.Remove(p.dataPath)
+}
+
+func (p *plug) Start(ctx context.Context, log *zap.Logger) (
+	send chan<- ethertalk.Packet,
+	recv <-chan ethertalk.Packet,
+) {
+	log = log.With(zap.String("switch", p.switchPath))
+	sendCh := make(chan ethertalk.Packet)
+	recvCh := make(chan ethertalk.Packet)
+	go p.capture(ctx, log, recvCh)
+	go p.transmit(ctx, log, sendCh)
+	go p.watch(ctx, log)
+	return sendCh, recvCh
+}
+
+// Closes the plug when ctx is done, or when the switch hangs up.
+func (p *plug) watch(ctx context.Context, log *zap.Logger) {
+	done := make(chan struct{})
+	go func() {
+		// The switch sends nothing more on the control socket.
+		_, _ = io.Copy(io.Discard, p.ctl)
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+	case <-done:
+		log.Warn("switch closed connection")
+	}
+	p.close()
+}
+
+func (p *plug) transmit(
+	ctx context.Context,
+	log *zap.Logger,
+	sendCh <-chan ethertalk.Packet,
+) {
+	for packet := range sendCh {
+		data, err := ethertalk.Marshal(packet)
+		if err != nil {
+			log.With(zap.Error(err)).Error("marshal failed")
+			continue
+		}
+		_, err = p.data.WriteToUnix(data, p.port)
+		if err != nil {
+			log.With(zap.Error(err)).Debug("send failed")
+			metrics.Drops.WithLabelValues("vde", "send").Inc()
+		}
+	}
+}
+
+func (p *plug) capture(
+	ctx context.Context,
+	log *zap.Logger,
+	recvCh chan<- ethertalk.Packet,
+) {
+	defer close(recvCh)
+	bin := make([]byte, 65536)
+	for {
+		n, _, err := p.data.ReadFromUnix(bin)
+		if ctx.Err() != nil || errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			log.With(zap.Error(err)).Error("recv failed")
+			return
+		}
+
+		packet := ethertalk.Packet{}
+		err = ethertalk.Unmarshal(bin[:n], &packet)
+		if err != nil {
+			// Most likely an Ethernet II frame, such as IP.
+			metrics.Drops.WithLabelValues("vde", "proto").Inc()
+			continue
+		} else if packet.SNAPProto != ethertalk.AARPProto && packet.SNAPProto != ethertalk.AppleTalkProto {
+			metrics.Drops.WithLabelValues("vde", "proto").Inc()
+			continue
+		}
+		if packet.Framing == ethertalk.Phase1 {
+			packet, err = ethertalk.ToPhase2(packet)
+			if err != nil {
+				metrics.Drops.WithLabelValues("vde", "proto").Inc()
+				continue
+			}
+		}
+
+		select {
+		case recvCh <- packet:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+//go:build linux || darwin || dragonfly || freebsd || netbsd || openbsd
+
+package vde
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+
+	"github.com/sfiera/multitalk/internal/bridge"
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+	"github.com/sfiera/multitalk/pkg/ethertalk"
+)
+
+// A vde_switch, with a control socket in dir, which hands out one port.
+type fakeSwitch struct {
+	t    *testing.T
+	dir  string
+	ctl  net.Listener
+	port *net.UnixConn
+	reqs chan request
+	conn chan net.Conn
+}
+
+func newFakeSwitch(t *testing.T, refuse bool) *fakeSwitch {
+	dir := t.TempDir()
+	ctl, err := net.Listen("unix", filepath.Join(dir, "ctl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ctl.Close() })
+	port, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "port"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { port.Close() })
+
+	s := &fakeSwitch{
+		t:    t,
+		dir:  dir,
+		ctl:  ctl,
+		port: port,
+		reqs: make(chan request, 1),
+		conn: make(chan net.Conn, 1),
+	}
+	go func() {
+		c, err := ctl.Accept()
+		if err != nil {
+			return
+		}
+		req := request{}
+		if binary.Read(c, hostOrder(), &req) != nil {
+			c.Close()
+			return
+		}
+		s.reqs <- req
+		rsp := newSockaddrUn(filepath.Join(dir, "port"))
+		if refuse {
+			rsp = newSockaddrUn("")
+		}
+		_ = binary.Write(c, hostOrder(), rsp)
+		s.conn <- c
+	}()
+	return s
+}
+
+func testPacket(t *testing.T) ethertalk.Packet {
+	pak, err := ethertalk.AppleTalk(ethernet.Addr{0x08, 0x00, 0x07, 0x01, 0x02, 0x03}, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{
+			Size:      14,
+			DstNet:    0,
+			DstNode:   0xff,
+			DstSocket: 4,
+			SrcNet:    10,
+			SrcNode:   7,
+			SrcSocket: 4,
+			Proto:     ddp.ProtoAEP,
+		},
+		Data: []byte{0x01},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *pak
+}
+
+func TestPlug(t *testing.T) {
+	assert := assert.New(t)
+	sw := newFakeSwitch(t, false)
+	b, err := Plug(sw.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := <-sw.reqs
+	assert.Equal(uint32(magic), req.Magic)
+	assert.Equal(uint32(version), req.Version)
+	assert.Equal(int32(reqNewControl), req.Type)
+	dataPath := req.Sock.path()
+	assert.Equal(b.(*plug).dataPath, dataPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	send, recv := b.Start(ctx, zap.NewNop())
+	defer close(send)
+
+	// To the switch, through the port it handed out.
+	want := testPacket(t)
+	send <- want
+	bin := make([]byte, 4096)
+	sw.port.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := sw.port.ReadFromUnix(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := ethertalk.Packet{}
+	assert.NoError(ethertalk.Unmarshal(bin[:n], &got))
+	assert.Equal(want.Src, got.Src)
+	assert.Equal(want.Payload, got.Payload)
+
+	// From the switch, to our end of the data socket.
+	data, err := ethertalk.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sw.port.WriteToUnix(data, &net.UnixAddr{Name: dataPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-recv:
+		assert.Equal(want.Src, got.Src)
+		assert.Equal(want.Payload, got.Payload)
+	case <-time.After(2 * time.Second):
+		t.Fatal("no packet received")
+	}
+
+	// When the switch hangs up, the plug closes.
+	(<-sw.conn).Close()
+	select {
+	case _, ok := <-recv:
+		assert.False(ok)
+	case <-time.After(2 * time.Second):
+		t.Fatal("plug not closed")
+	}
+}
+
+func TestPlugRefused(t *testing.T) {
+	sw := newFakeSwitch(t, true)
+	_, err := Plug(filepath.Join(sw.dir, "ctl"))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "switch refused port")
+	}
+}
+
+func TestSockaddrUn(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("/tmp/vde.ctl/port", newSockaddrUn("/tmp/vde.ctl/port").path())
+	assert.Equal("", newSockaddrUn("").path())
+	assert.Equal(2+sunPathSize, binary.Size(sockaddrUn{}))
+}
+
+func TestPlugLogs(t *testing.T) {
+	assert := assert.New(t)
+	sw := newFakeSwitch(t, false)
+	b, err := Plug(sw.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	core, logs := observer.New(zap.InfoLevel)
+	g := bridge.NewGroup(zap.New(core))
+	go g.Run()
+	g.Add(context.Background(), zap.New(core), "vde", sw.dir, b)
+	<-sw.reqs
+	(<-sw.conn).Close()
+
+	assert.Eventually(func() bool {
+		return logs.FilterMessage("switch closed connection").Len() > 0
+	}, 2*time.Second, time.Millisecond)
+	for _, e := range logs.FilterMessage("switch closed connection").All() {
+		n := 0
+		for _, f := range e.Context {
+			if f.Key == "bridge" {
+				assert.Equal("vde", f.String)
+				n++
+			}
+		}
+		assert.Equal(1, n)
+	}
+}
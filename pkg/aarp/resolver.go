@@ -0,0 +1,243 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package aarp
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+)
+
+// Defaults for a Resolver. Requests are retried at the same rate as
+// probes in Inside AppleTalk.
+const (
+	DefaultRetries  = 10
+	DefaultInterval = 200 * time.Millisecond
+	DefaultTTL      = 10 * time.Minute
+)
+
+// ErrTimeout is returned by Resolve when no response arrives.
+var ErrTimeout = errors.New("aarp: no response")
+
+type (
+	// A Resolver maintains an address mapping table, from AppleTalk
+	// addresses to hardware addresses. Entries are learned from AARP
+	// traffic and gleaned from DDP traffic, or requested by Resolve,
+	// and expire when they have not been refreshed within the TTL.
+	//
+	// A Resolver is safe for concurrent use.
+	Resolver struct {
+		Retries  int           // requests to send before giving up
+		Interval time.Duration // between requests
+		TTL      time.Duration // 0 means entries never expire
+
+		send func(Packet) error
+		now  func() time.Time
+
+		mu      sync.Mutex
+		amt     map[ddp.Addr]Entry
+		waiting map[ddp.Addr][]chan ethernet.Addr
+	}
+
+	// An Entry is a mapping in a Resolver’s table.
+	Entry struct {
+		Proto    ddp.Addr
+		Hardware ethernet.Addr
+		LastSeen time.Time
+	}
+)
+
+// NewResolver returns a Resolver that transmits requests with send.
+func NewResolver(send func(Packet) error) *Resolver {
+	return &Resolver{
+		Retries:  DefaultRetries,
+		Interval: DefaultInterval,
+		TTL:      DefaultTTL,
+		send:     send,
+		now:      time.Now,
+		amt:      map[ddp.Addr]Entry{},
+		waiting:  map[ddp.Addr][]chan ethernet.Addr{},
+	}
+}
+
+// Lookup returns the hardware address for addr, if it is in the table.
+func (r *Resolver) Lookup(addr ddp.Addr) (ethernet.Addr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e, ok := r.amt[addr]
+	if !ok || r.expired(e) {
+		return ethernet.Addr{}, false
+	}
+	return e.Hardware, true
+}
+
+// Resolve returns the hardware address for query. If it is not in the
+// table, Resolve sends requests from src until a response arrives
+// (passed to Handle), ctx is done, or the retries are exhausted.
+// If another Resolve for query is in progress, it waits for the same
+// response instead of sending its own requests.
+func (r *Resolver) Resolve(ctx context.Context, src AddrPair, query ddp.Addr) (ethernet.Addr, error) {
+	r.mu.Lock()
+	if e, ok := r.amt[query]; ok && !r.expired(e) {
+		r.mu.Unlock()
+		return e.Hardware, nil
+	}
+	ch := make(chan ethernet.Addr, 1)
+	first := len(r.waiting[query]) == 0
+	r.waiting[query] = append(r.waiting[query], ch)
+	r.mu.Unlock()
+	defer r.stopWaiting(query, ch)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for i := 0; i < r.Retries; i++ {
+		if first {
+			err := r.send(Request(src, query))
+			if err != nil {
+				return ethernet.Addr{}, err
+			}
+		}
+		select {
+		case hw := <-ch:
+			return hw, nil
+		case <-ctx.Done():
+			return ethernet.Addr{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return ethernet.Addr{}, ErrTimeout
+}
+
+func (r *Resolver) stopWaiting(query ddp.Addr, ch chan ethernet.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	chs := r.waiting[query]
+	for i, c := range chs {
+		if c == ch {
+			chs = append(chs[:i], chs[i+1:]...)
+			break
+		}
+	}
+	if len(chs) == 0 {
+		delete(r.waiting, query)
+	} else {
+		r.waiting[query] = chs
+	}
+}
+
+// Pending returns true if a Resolve for addr is in progress.
+func (r *Resolver) Pending(addr ddp.Addr) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.waiting[addr]) > 0
+}
+
+// Handle learns from a received AARP packet. Requests and responses
+// map their sender; probes are tentative, and are ignored.
+//
+// Returns true if the packet answered a pending Resolve.
+func (r *Resolver) Handle(pak Packet) bool {
+	switch pak.Opcode {
+	case RequestOp, ResponseOp:
+		return r.Glean(pak.Src.Proto, pak.Src.Hardware)
+	default:
+		return false
+	}
+}
+
+// Glean records that addr is at hw, for example from the source of a
+// received DDP packet. Broadcast, multicast and zero hardware addresses
+// are ignored.
+//
+// Returns true if the mapping answered a pending Resolve.
+func (r *Resolver) Glean(addr ddp.Addr, hw ethernet.Addr) bool {
+	if hw == (ethernet.Addr{}) || hw[0]&0x01 != 0 {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.amt[addr] = Entry{Proto: addr, Hardware: hw, LastSeen: r.now()}
+	chs := r.waiting[addr]
+	for _, ch := range chs {
+		select {
+		case ch <- hw:
+		default: // already answered
+		}
+	}
+	return len(chs) > 0
+}
+
+// Forget removes addr from the table, for example when its node
+// is known to have moved.
+func (r *Resolver) Forget(addr ddp.Addr) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.amt, addr)
+}
+
+// Expire removes entries that have not been refreshed within the TTL,
+// and returns them.
+func (r *Resolver) Expire() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var expired []Entry
+	for addr, e := range r.amt {
+		if r.expired(e) {
+			expired = append(expired, e)
+			delete(r.amt, addr)
+		}
+	}
+	return expired
+}
+
+// Entries returns the table, ordered by AppleTalk address.
+func (r *Resolver) Entries() []Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entries := make([]Entry, 0, len(r.amt))
+	for _, e := range r.amt {
+		if !r.expired(e) {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i].Proto, entries[j].Proto
+		return a.Network < b.Network || (a.Network == b.Network && a.Node < b.Node)
+	})
+	return entries
+}
+
+// Called with mu held.
+func (r *Resolver) expired(e Entry) bool {
+	return r.TTL != 0 && r.now().Sub(e.LastSeen) > r.TTL
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package aarp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/ethernet"
+)
+
+var (
+	self = AddrPair{
+		Hardware: ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x01},
+		Proto:    ddp.Addr{Network: 65280, Node: 1},
+	}
+	peer = AddrPair{
+		Hardware: ethernet.Addr{0x08, 0x00, 0x07, 0x00, 0x00, 0x02},
+		Proto:    ddp.Addr{Network: 65280, Node: 2},
+	}
+)
+
+func TestResolve(t *testing.T) {
+	assert := assert.New(t)
+	var r *Resolver
+	sent := 0
+	r = NewResolver(func(pak Packet) error {
+		assert.Equal(Request(self, peer.Proto), pak)
+		sent++
+		if sent == 2 {
+			// Answer the second request.
+			go r.Handle(Response(peer, self))
+		}
+		return nil
+	})
+	r.Interval = 10 * time.Millisecond
+
+	hw, err := r.Resolve(context.Background(), self, peer.Proto)
+	assert.NoError(err)
+	assert.Equal(peer.Hardware, hw)
+	assert.Equal(2, sent)
+
+	// Now cached, so no more requests.
+	hw, err = r.Resolve(context.Background(), self, peer.Proto)
+	assert.NoError(err)
+	assert.Equal(peer.Hardware, hw)
+	assert.Equal(2, sent)
+	assert.False(r.Pending(peer.Proto))
+}
+
+func TestResolveTimeout(t *testing.T) {
+	assert := assert.New(t)
+	sent := 0
+	r := NewResolver(func(pak Packet) error {
+		sent++
+		return nil
+	})
+	r.Retries = 3
+	r.Interval = time.Millisecond
+
+	_, err := r.Resolve(context.Background(), self, peer.Proto)
+	assert.Equal(ErrTimeout, err)
+	assert.Equal(3, sent)
+}
+
+func TestGlean(t *testing.T) {
+	assert := assert.New(t)
+	now := time.Unix(0, 0)
+	r := NewResolver(nil)
+	r.now = func() time.Time { return now }
+	r.TTL = time.Minute
+
+	assert.False(r.Glean(peer.Proto, ethernet.Addr{}))
+	assert.False(r.Glean(peer.Proto, ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff}))
+	_, ok := r.Lookup(peer.Proto)
+	assert.False(ok)
+
+	assert.False(r.Handle(Probe(peer.Hardware, peer.Proto)))
+	_, ok = r.Lookup(peer.Proto)
+	assert.False(ok)
+
+	assert.False(r.Handle(Request(peer, self.Proto)))
+	hw, ok := r.Lookup(peer.Proto)
+	assert.True(ok)
+	assert.Equal(peer.Hardware, hw)
+	assert.Equal([]Entry{{peer.Proto, peer.Hardware, now}}, r.Entries())
+
+	now = now.Add(2 * time.Minute)
+	_, ok = r.Lookup(peer.Proto)
+	assert.False(ok)
+	assert.Equal([]Entry{{peer.Proto, peer.Hardware, time.Unix(0, 0)}}, r.Expire())
+	assert.Empty(r.Entries())
+}
@@ -0,0 +1,554 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Encodes and decodes AURP (AppleTalk Update-based Routing Protocol)
+// packets, as tunneled over UDP.
+//
+// See RFC 1504.
+package aurp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+// Port is the UDP port for AURP tunnels.
+const Port = 387
+
+const (
+	version = uint16(0x0001)
+
+	authorityNull = uint8(0)
+	authorityIP   = uint8(1)
+)
+
+type PacketType uint16
+
+const (
+	TypeAppleTalk = PacketType(0x0002) // tunneled DDP
+	TypeAURP      = PacketType(0x0003) // routing information
+)
+
+type Command uint16
+
+const (
+	CommandRIReq     = Command(0x0001)
+	CommandRIRsp     = Command(0x0002)
+	CommandRIAck     = Command(0x0003)
+	CommandRIUpd     = Command(0x0004)
+	CommandRD        = Command(0x0005)
+	CommandZReq      = Command(0x0006)
+	CommandZRsp      = Command(0x0007)
+	CommandOpenReq   = Command(0x0008)
+	CommandOpenRsp   = Command(0x0009)
+	CommandTickle    = Command(0x000e)
+	CommandTickleAck = Command(0x000f)
+)
+
+type Flags uint16
+
+const (
+	// In RI-Rsp, set on the last packet of the routing table.
+	FlagLast = Flags(0x8000)
+	// In RI-Req, RI-Rsp and RI-Ack, asks for zone information.
+	FlagSendZoneInfo = Flags(0x4000)
+
+	// In Open-Rsp, describe the responder’s environment.
+	FlagRemappingActive   = Flags(0x4000)
+	FlagHopCountReduction = Flags(0x2000)
+)
+
+type Subcode uint16
+
+const (
+	SubcodeZIReq    = Subcode(0x0001)
+	SubcodeZIRsp    = Subcode(0x0001) // for non-extended networks
+	SubcodeExtZIRsp = Subcode(0x0002) // for extended networks
+)
+
+type EventCode uint8
+
+const (
+	EventNull                   = EventCode(0)
+	EventNetworkAdded           = EventCode(1)
+	EventNetworkDeleted         = EventCode(2)
+	EventNetworkRouteChanged    = EventCode(3)
+	EventNetworkDistanceChanged = EventCode(4)
+	EventZoneChanged            = EventCode(5)
+)
+
+type (
+	// A DomainID identifies one end of a tunnel.
+	// For IP tunnels, Address is an IPv4 address.
+	DomainID struct {
+		Authority uint8
+		Address   []byte
+	}
+
+	DomainHeader struct {
+		Dst, Src DomainID
+		Type     PacketType
+	}
+
+	// Header is present on AURP packets, but not AppleTalk packets.
+	Header struct {
+		ConnID  uint16
+		Seq     uint16
+		Command Command
+		Flags   Flags
+	}
+
+	// Combines all data in an AURP tunnel packet.
+	//
+	// For TypeAppleTalk, Data is a marshaled ddp.ExtPacket, and Header
+	// is unused. For TypeAURP, Data is the command-specific body.
+	Packet struct {
+		DomainHeader
+		Header
+		Data []byte
+	}
+
+	// An Option is a connection option in Open-Req and Open-Rsp.
+	Option struct {
+		Type uint8
+		Data []byte
+	}
+
+	OpenReq struct {
+		Version uint16
+		Options []Option
+	}
+
+	// A negative Timeout is an error code, refusing the connection.
+	OpenRsp struct {
+		Timeout int16
+		Options []Option
+	}
+
+	// A NetworkTuple describes a route to a network, in RI-Rsp.
+	NetworkTuple struct {
+		Range    ddp.NetworkRange
+		Extended bool
+		Distance uint8
+	}
+
+	// An Event describes a change to the routing table, in RI-Upd.
+	Event struct {
+		Code EventCode
+		NetworkTuple
+	}
+
+	// A ZoneTuple names a zone of a network, in ZI-Rsp.
+	ZoneTuple struct {
+		Network ddp.Network
+		Zone    string
+	}
+)
+
+// IPDomainID returns the DomainID for an IPv4 address.
+func IPDomainID(ip net.IP) DomainID {
+	if ip4 := ip.To4(); ip4 != nil {
+		return DomainID{Authority: authorityIP, Address: []byte(ip4)}
+	}
+	return DomainID{Authority: authorityNull}
+}
+
+// IP returns the address of an IP DomainID, or nil.
+func (d DomainID) IP() net.IP {
+	if d.Authority != authorityIP || len(d.Address) != net.IPv4len {
+		return nil
+	}
+	return net.IP(d.Address)
+}
+
+func readDomainID(r *bytes.Reader, d *DomainID) error {
+	n, err := r.ReadByte()
+	if err != nil {
+		return err
+	} else if n < 1 {
+		return fmt.Errorf("invalid length %d", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return err
+	}
+	d.Authority = data[0]
+	d.Address = nil
+	if d.Authority != authorityNull {
+		if len(data) < 3 {
+			return fmt.Errorf("invalid length %d", n)
+		}
+		d.Address = data[3:] // after the reserved distinguisher
+	}
+	return nil
+}
+
+func writeDomainID(w *bytes.Buffer, d DomainID) {
+	if d.Authority == authorityNull {
+		w.Write([]byte{1, authorityNull})
+		return
+	}
+	w.WriteByte(byte(3 + len(d.Address)))
+	w.WriteByte(d.Authority)
+	w.Write([]byte{0, 0})
+	w.Write(d.Address)
+}
+
+// Unmarshals a packet from bytes.
+func Unmarshal(data []byte, pak *Packet) error {
+	r := bytes.NewReader(data)
+
+	err := readDomainID(r, &pak.Dst)
+	if err != nil {
+		return fmt.Errorf("read dst domain: %s", err.Error())
+	}
+	err = readDomainID(r, &pak.Src)
+	if err != nil {
+		return fmt.Errorf("read src domain: %s", err.Error())
+	}
+
+	var rest struct {
+		Version, Reserved uint16
+		Type              PacketType
+	}
+	err = binary.Read(r, binary.BigEndian, &rest)
+	if err != nil {
+		return fmt.Errorf("read domain header: %s", err.Error())
+	} else if rest.Version != version {
+		return fmt.Errorf("read domain header: unknown version %d", rest.Version)
+	}
+	pak.Type = rest.Type
+
+	pak.Header = Header{}
+	switch pak.Type {
+	case TypeAppleTalk:
+	case TypeAURP:
+		err = binary.Read(r, binary.BigEndian, &pak.Header)
+		if err != nil {
+			return fmt.Errorf("read aurp header: %s", err.Error())
+		}
+	default:
+		return fmt.Errorf("read domain header: unknown type $%04x", uint16(pak.Type))
+	}
+
+	pak.Data, err = io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read data: %s", err.Error())
+	}
+	return nil
+}
+
+// Marshals a packet to bytes.
+func Marshal(pak Packet) ([]byte, error) {
+	w := bytes.NewBuffer([]byte{})
+	writeDomainID(w, pak.Dst)
+	writeDomainID(w, pak.Src)
+	_ = binary.Write(w, binary.BigEndian, []uint16{version, 0, uint16(pak.Type)})
+
+	switch pak.Type {
+	case TypeAppleTalk:
+	case TypeAURP:
+		_ = binary.Write(w, binary.BigEndian, pak.Header)
+	default:
+		return nil, fmt.Errorf("write domain header: unknown type $%04x", uint16(pak.Type))
+	}
+
+	w.Write(pak.Data)
+	return w.Bytes(), nil
+}
+
+func readOptions(r *bytes.Reader) ([]Option, error) {
+	count, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	var opts []Option
+	for i := 0; i < int(count); i++ {
+		n, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		} else if n < 1 {
+			return nil, fmt.Errorf("invalid option length %d", n)
+		}
+		data := make([]byte, n)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, Option{Type: data[0], Data: data[1:]})
+	}
+	return opts, nil
+}
+
+func writeOptions(w *bytes.Buffer, opts []Option) {
+	w.WriteByte(byte(len(opts)))
+	for _, opt := range opts {
+		w.WriteByte(byte(1 + len(opt.Data)))
+		w.WriteByte(opt.Type)
+		w.Write(opt.Data)
+	}
+}
+
+func UnmarshalOpenReq(data []byte, req *OpenReq) error {
+	r := bytes.NewReader(data)
+	err := binary.Read(r, binary.BigEndian, &req.Version)
+	if err != nil {
+		return fmt.Errorf("read open-req: %s", err.Error())
+	}
+	req.Options, err = readOptions(r)
+	if err != nil {
+		return fmt.Errorf("read open-req options: %s", err.Error())
+	}
+	return nil
+}
+
+func MarshalOpenReq(req OpenReq) []byte {
+	w := bytes.NewBuffer([]byte{})
+	_ = binary.Write(w, binary.BigEndian, req.Version)
+	writeOptions(w, req.Options)
+	return w.Bytes()
+}
+
+func UnmarshalOpenRsp(data []byte, rsp *OpenRsp) error {
+	r := bytes.NewReader(data)
+	err := binary.Read(r, binary.BigEndian, &rsp.Timeout)
+	if err != nil {
+		return fmt.Errorf("read open-rsp: %s", err.Error())
+	}
+	rsp.Options = nil
+	if rsp.Timeout >= 0 {
+		rsp.Options, err = readOptions(r)
+		if err != nil {
+			return fmt.Errorf("read open-rsp options: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func MarshalOpenRsp(rsp OpenRsp) []byte {
+	w := bytes.NewBuffer([]byte{})
+	_ = binary.Write(w, binary.BigEndian, rsp.Timeout)
+	if rsp.Timeout >= 0 {
+		writeOptions(w, rsp.Options)
+	}
+	return w.Bytes()
+}
+
+// Network tuples are:
+//   - the first network of the range (2 bytes),
+//   - the range flag (bit 7) and distance (1 byte), and if extended,
+//   - the last network of the range (2 bytes) and a reserved byte.
+func readTuple(r *bytes.Reader, t *NetworkTuple, reserved bool) error {
+	var head struct {
+		First ddp.Network
+		Flags uint8
+	}
+	err := binary.Read(r, binary.BigEndian, &head)
+	if err != nil {
+		return err
+	}
+	t.Range = ddp.NetworkRange{First: head.First, Last: head.First}
+	t.Extended = head.Flags&0x80 != 0
+	t.Distance = head.Flags & 0x1f
+	if t.Extended {
+		err = binary.Read(r, binary.BigEndian, &t.Range.Last)
+		if err != nil {
+			return err
+		}
+		if reserved {
+			_, err = r.ReadByte()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeTuple(w *bytes.Buffer, t NetworkTuple, reserved bool) {
+	flags := t.Distance & 0x1f
+	if t.Extended {
+		flags |= 0x80
+	}
+	_ = binary.Write(w, binary.BigEndian, t.Range.First)
+	w.WriteByte(flags)
+	if t.Extended {
+		_ = binary.Write(w, binary.BigEndian, t.Range.Last)
+		if reserved {
+			w.WriteByte(0)
+		}
+	}
+}
+
+// UnmarshalTuples decodes the network tuples of an RI-Rsp.
+func UnmarshalTuples(data []byte) ([]NetworkTuple, error) {
+	r := bytes.NewReader(data)
+	var tuples []NetworkTuple
+	for r.Len() > 0 {
+		t := NetworkTuple{}
+		err := readTuple(r, &t, true)
+		if err != nil {
+			return nil, fmt.Errorf("read network tuple: %s", err.Error())
+		}
+		tuples = append(tuples, t)
+	}
+	return tuples, nil
+}
+
+// MarshalTuples encodes the network tuples of an RI-Rsp.
+func MarshalTuples(tuples []NetworkTuple) []byte {
+	w := bytes.NewBuffer([]byte{})
+	for _, t := range tuples {
+		writeTuple(w, t, true)
+	}
+	return w.Bytes()
+}
+
+// UnmarshalEvents decodes the event tuples of an RI-Upd.
+func UnmarshalEvents(data []byte) ([]Event, error) {
+	r := bytes.NewReader(data)
+	var events []Event
+	for r.Len() > 0 {
+		e := Event{}
+		code, err := r.ReadByte()
+		if err == nil {
+			e.Code = EventCode(code)
+			err = readTuple(r, &e.NetworkTuple, false)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read event tuple: %s", err.Error())
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// MarshalEvents encodes the event tuples of an RI-Upd.
+func MarshalEvents(events []Event) []byte {
+	w := bytes.NewBuffer([]byte{})
+	for _, e := range events {
+		w.WriteByte(byte(e.Code))
+		writeTuple(w, e.NetworkTuple, false)
+	}
+	return w.Bytes()
+}
+
+// UnmarshalZIReq decodes the networks requested by a ZI-Req.
+func UnmarshalZIReq(data []byte) ([]ddp.Network, error) {
+	r := bytes.NewReader(data)
+	var sub Subcode
+	err := binary.Read(r, binary.BigEndian, &sub)
+	if err != nil {
+		return nil, fmt.Errorf("read zi-req: %s", err.Error())
+	} else if sub != SubcodeZIReq {
+		return nil, fmt.Errorf("read zi-req: unsupported subcode %d", sub)
+	} else if r.Len()%2 != 0 {
+		return nil, fmt.Errorf("read zi-req: odd length")
+	}
+	nets := make([]ddp.Network, r.Len()/2)
+	_ = binary.Read(r, binary.BigEndian, nets)
+	return nets, nil
+}
+
+// MarshalZIReq encodes a ZI-Req for the zones of nets.
+func MarshalZIReq(nets []ddp.Network) []byte {
+	w := bytes.NewBuffer([]byte{})
+	_ = binary.Write(w, binary.BigEndian, SubcodeZIReq)
+	_ = binary.Write(w, binary.BigEndian, nets)
+	return w.Bytes()
+}
+
+// UnmarshalZIRsp decodes the zone tuples of a ZI-Rsp. A zone name may
+// be given as an offset (with the high bit set) to an earlier name,
+// counted from the start of data.
+func UnmarshalZIRsp(data []byte) (Subcode, []ZoneTuple, error) {
+	r := bytes.NewReader(data)
+	var sub Subcode
+	err := binary.Read(r, binary.BigEndian, &sub)
+	if err != nil {
+		return 0, nil, fmt.Errorf("read zi-rsp: %s", err.Error())
+	} else if sub != SubcodeZIRsp && sub != SubcodeExtZIRsp {
+		return 0, nil, fmt.Errorf("read zi-rsp: unsupported subcode %d", sub)
+	}
+
+	var tuples []ZoneTuple
+	for r.Len() > 0 {
+		t := ZoneTuple{}
+		err = binary.Read(r, binary.BigEndian, &t.Network)
+		if err == nil {
+			t.Zone, err = readZoneName(r, data)
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("read zone tuple: %s", err.Error())
+		}
+		tuples = append(tuples, t)
+	}
+	return sub, tuples, nil
+}
+
+func readZoneName(r *bytes.Reader, data []byte) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	if n&0x80 != 0 {
+		lo, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		offset := int(n&0x7f)<<8 | int(lo)
+		if offset >= len(data) {
+			return "", fmt.Errorf("invalid zone name offset %d", offset)
+		}
+		return readZoneName(bytes.NewReader(data[offset:]), data[:offset])
+	}
+	name := make([]byte, n)
+	_, err = io.ReadFull(r, name)
+	if err != nil {
+		return "", err
+	}
+	return string(name), nil
+}
+
+// MarshalZIRsp encodes a ZI-Rsp with the given zone tuples.
+// Zone names are always written in full.
+func MarshalZIRsp(sub Subcode, tuples []ZoneTuple) []byte {
+	w := bytes.NewBuffer([]byte{})
+	_ = binary.Write(w, binary.BigEndian, sub)
+	for _, t := range tuples {
+		_ = binary.Write(w, binary.BigEndian, t.Network)
+		w.WriteByte(byte(len(t.Zone)))
+		w.WriteString(t.Zone)
+	}
+	return w.Bytes()
+}
@@ -0,0 +1,193 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package aurp
+
+import (
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+var (
+	dst = IPDomainID(net.IPv4(192, 0, 2, 1))
+	src = IPDomainID(net.IPv4(192, 0, 2, 2))
+)
+
+func TestPacket(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		hex  string
+		pak  Packet
+	}{{
+		name: "open-req",
+		hex: "07 01 0000 c0000201" + // dst domain
+			"07 01 0000 c0000202" + // src domain
+			"0001 0000 0003" + // version 1, AURP
+			"1234 0000 0008 0000" + // conn 0x1234, Open-Req
+			"0001 00", // version 1, no options
+		pak: Packet{
+			DomainHeader: DomainHeader{Dst: dst, Src: src, Type: TypeAURP},
+			Header:       Header{ConnID: 0x1234, Command: CommandOpenReq},
+			Data:         MarshalOpenReq(OpenReq{Version: 1}),
+		},
+	}, {
+		name: "appletalk",
+		hex: "07 01 0000 c0000201" +
+			"07 01 0000 c0000202" +
+			"0001 0000 0002" + // version 1, AppleTalk
+			"000e 0000 03e8 03e9 05 06 04 04 04 aa", // DDP
+		pak: Packet{
+			DomainHeader: DomainHeader{Dst: dst, Src: src, Type: TypeAppleTalk},
+			Data:         unhex("000e000003e803e90506040404aa"),
+		},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pak := Packet{}
+			if assert.NoError(Unmarshal(unhex(tt.hex), &pak)) {
+				assert.Equal(tt.pak, pak)
+			}
+			data, err := Marshal(tt.pak)
+			if assert.NoError(err) {
+				assert.Equal(unhex(tt.hex), data)
+			}
+		})
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, hex, err string
+	}{
+		{"empty", "", "read dst domain: EOF"},
+		{"version", "0100 0100 0002 0000 0003", "read domain header: unknown version 2"},
+		{"type", "0100 0100 0001 0000 0009", "read domain header: unknown type $0009"},
+		{"short-header", "0100 0100 0001 0000 0003 1234", "read aurp header: unexpected EOF"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal(unhex(tt.hex), &Packet{})
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func TestDomainID(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(net.IPv4(192, 0, 2, 1).To4(), dst.IP())
+	assert.Nil(IPDomainID(net.ParseIP("2001:db8::1")).IP())
+}
+
+func TestOpen(t *testing.T) {
+	assert := assert.New(t)
+	req := OpenReq{Version: 1, Options: []Option{{Type: 1, Data: []byte{0xaa}}}}
+	data := MarshalOpenReq(req)
+	assert.Equal(unhex("0001 01 02 01 aa"), data)
+	got := OpenReq{}
+	assert.NoError(UnmarshalOpenReq(data, &got))
+	assert.Equal(req, got)
+
+	rsp := OpenRsp{Timeout: 90}
+	data = MarshalOpenRsp(rsp)
+	assert.Equal(unhex("005a 00"), data)
+	gotRsp := OpenRsp{}
+	assert.NoError(UnmarshalOpenRsp(data, &gotRsp))
+	assert.Equal(rsp, gotRsp)
+
+	rsp = OpenRsp{Timeout: -1}
+	data = MarshalOpenRsp(rsp)
+	assert.Equal(unhex("ffff"), data)
+	assert.NoError(UnmarshalOpenRsp(data, &gotRsp))
+	assert.Equal(rsp, gotRsp)
+}
+
+func TestTuples(t *testing.T) {
+	assert := assert.New(t)
+	tuples := []NetworkTuple{
+		{Range: ddp.NetworkRange{First: 5, Last: 5}, Distance: 1},
+		{Range: ddp.NetworkRange{First: 1000, Last: 1009}, Extended: true},
+	}
+	data := MarshalTuples(tuples)
+	assert.Equal(unhex("0005 01"+"03e8 80 03f1 00"), data)
+	got, err := UnmarshalTuples(data)
+	assert.NoError(err)
+	assert.Equal(tuples, got)
+
+	_, err = UnmarshalTuples(unhex("03e8 80 03"))
+	assert.Error(err)
+}
+
+func TestEvents(t *testing.T) {
+	assert := assert.New(t)
+	events := []Event{
+		{Code: EventNetworkAdded, NetworkTuple: NetworkTuple{Range: ddp.NetworkRange{First: 1000, Last: 1009}, Extended: true, Distance: 2}},
+		{Code: EventNetworkDeleted, NetworkTuple: NetworkTuple{Range: ddp.NetworkRange{First: 5, Last: 5}}},
+	}
+	data := MarshalEvents(events)
+	assert.Equal(unhex("01 03e8 82 03f1"+"02 0005 00"), data)
+	got, err := UnmarshalEvents(data)
+	assert.NoError(err)
+	assert.Equal(events, got)
+}
+
+func TestZoneInfo(t *testing.T) {
+	assert := assert.New(t)
+	data := MarshalZIReq([]ddp.Network{5, 1000})
+	assert.Equal(unhex("0001 0005 03e8"), data)
+	nets, err := UnmarshalZIReq(data)
+	assert.NoError(err)
+	assert.Equal([]ddp.Network{5, 1000}, nets)
+
+	tuples := []ZoneTuple{{5, "Home"}, {1000, "Office"}}
+	data = MarshalZIRsp(SubcodeZIRsp, tuples)
+	assert.Equal(unhex("0001 0005 04486f6d65 03e8 064f6666696365"), data)
+	sub, got, err := UnmarshalZIRsp(data)
+	assert.NoError(err)
+	assert.Equal(SubcodeZIRsp, sub)
+	assert.Equal(tuples, got)
+
+	// The second name refers back to the first, at offset 4.
+	sub, got, err = UnmarshalZIRsp(unhex("0002 03e8 04486f6d65 03e9 8004"))
+	assert.NoError(err)
+	assert.Equal(SubcodeExtZIRsp, sub)
+	assert.Equal([]ZoneTuple{{1000, "Home"}, {1001, "Home"}}, got)
+}
@@ -164,6 +164,23 @@ func ExtMarshal(pak ExtPacket) ([]byte, error) {
 	return w.Bytes(), nil
 }
 
+// Checksum returns the DDP checksum of a marshaled extended packet,
+// which covers the data following the checksum field. A checksum of 0
+// means “no checksum”, so a sum of 0 is returned as 0xffff.
+func Checksum(data []byte) uint16 {
+	sum := uint16(0)
+	if len(data) > 4 {
+		for _, b := range data[4:] {
+			sum += uint16(b)
+			sum = sum<<1 | sum>>15
+		}
+	}
+	if sum == 0 {
+		return 0xffff
+	}
+	return sum
+}
+
 // Converts an extended packet to a short-form packet.
 //
 // Discards the network and node information.
@@ -129,3 +129,57 @@ func unhex(s string) []byte {
 	}
 	return data
 }
+
+func TestNetworkRange(t *testing.T) {
+	assert := assert.New(t)
+	r := NetworkRange{1000, 1009}
+	assert.False(r.Contains(999))
+	assert.True(r.Contains(1000))
+	assert.True(r.Contains(1009))
+	assert.False(r.Contains(1010))
+	assert.Equal("1000-1009", r.String())
+	assert.Equal("42", NetworkRange{42, 42}.String())
+	assert.True(StartupRange.Contains(0xff00))
+	assert.False(StartupRange.Contains(0xffff))
+	assert.True(r.Overlaps(NetworkRange{1009, 1020}))
+	assert.True(r.Overlaps(NetworkRange{1005, 1005}))
+	assert.False(r.Overlaps(NetworkRange{1010, 1020}))
+	assert.False(r.Overlaps(NetworkRange{42, 42}))
+}
+
+func TestChecksum(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(uint16(0xffff), Checksum(nil))
+	assert.Equal(uint16(0xffff), Checksum([]byte{0x00, 0x0e, 0x12, 0x34, 0x00}))
+	assert.Equal(uint16(0x0002), Checksum([]byte{0x00, 0x0e, 0x12, 0x34, 0x01}))
+	assert.Equal(uint16(0x0008), Checksum([]byte{0x00, 0x0e, 0x12, 0x34, 0x01, 0x02}))
+}
+
+func TestParseNetworkRange(t *testing.T) {
+	for _, tt := range []struct {
+		in      string
+		want    NetworkRange
+		wantErr string
+	}{
+		{in: "1000-1009", want: NetworkRange{1000, 1009}},
+		{in: "42", want: NetworkRange{42, 42}},
+		{in: "65280-65534", want: StartupRange},
+		{in: "0-5", wantErr: `parse network range "0-5": invalid range`},
+		{in: "9-5", wantErr: `parse network range "9-5": invalid range`},
+		{in: "x", wantErr: `parse network range "x": strconv.ParseUint: parsing "x": invalid syntax`},
+		{in: "1-65536", wantErr: `parse network range "1-65536": strconv.ParseUint: parsing "65536": value out of range`},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			assert := assert.New(t)
+			r, err := ParseNetworkRange(tt.in)
+			if tt.wantErr != "" {
+				if assert.Error(err) {
+					assert.Equal(tt.wantErr, err.Error())
+				}
+				return
+			}
+			assert.NoError(err)
+			assert.Equal(tt.want, r)
+		})
+	}
+}
@@ -27,6 +27,12 @@
 
 package ddp
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 type (
 	Network uint16
 	Node    uint8
@@ -36,4 +42,55 @@ type (
 		Network Network
 		Node    Node
 	}
+
+	// A NetworkRange is the inclusive range of network numbers assigned
+	// to an extended (Phase 2) network, such as an EtherTalk cable.
+	// A non-extended network has First == Last.
+	NetworkRange struct {
+		First, Last Network
+	}
 )
+
+// Networks that nodes may use to acquire an address before they have
+// heard from a router, and learned the real range of their cable.
+var StartupRange = NetworkRange{0xff00, 0xfffe}
+
+// Contains returns true if net is within the range.
+func (r NetworkRange) Contains(net Network) bool {
+	return r.First <= net && net <= r.Last
+}
+
+// Overlaps returns true if any network is in both ranges.
+func (r NetworkRange) Overlaps(o NetworkRange) bool {
+	return r.First <= o.Last && o.First <= r.Last
+}
+
+// String returns the range as "first-last", or "net" if non-extended.
+func (r NetworkRange) String() string {
+	if r.First == r.Last {
+		return strconv.Itoa(int(r.First))
+	}
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+// ParseNetworkRange parses a range as formatted by NetworkRange.String.
+// Network 0 is reserved, and may not be part of a range.
+func ParseNetworkRange(s string) (NetworkRange, error) {
+	first, last, ok := strings.Cut(s, "-")
+	if !ok {
+		last = first
+	}
+	f, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return NetworkRange{}, fmt.Errorf("parse network range %q: %s", s, err.Error())
+	}
+	l, err := strconv.ParseUint(last, 10, 16)
+	if err != nil {
+		return NetworkRange{}, fmt.Errorf("parse network range %q: %s", s, err.Error())
+	}
+	r := NetworkRange{Network(f), Network(l)}
+	if r.First == 0 || r.First > r.Last {
+		return NetworkRange{}, fmt.Errorf("parse network range %q: invalid range", s)
+	}
+	return r, nil
+}
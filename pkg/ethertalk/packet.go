@@ -45,15 +45,37 @@ var (
 	AARPProto      = SNAPProto{[3]byte{0x00, 0x00, 0x00}, 0x80F3}
 
 	AppleTalkBroadcast = ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff}
+
+	// Phase 1 uses the Ethernet broadcast address instead.
+	Broadcast = ethernet.Addr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+)
+
+// Framings of EtherTalk packets.
+const (
+	// Phase 2: IEEE 802.3, with an 802.2 SNAP header.
+	Phase2 = Framing(iota)
+	// Phase 1: Ethernet II, with the SNAP protocol as the EtherType.
+	// DDP packets are preceded by an LLAP header.
+	Phase1
 )
 
 const (
 	EthHeaderSize  = 13
 	LinkHeaderSize = 3
 	SNAPProtoSize  = 5
+
+	// Sizes at least this large in an EthHeader are EtherTypes.
+	minEtherType = 0x0600
+	// Size of an AARP packet for Ethernet.
+	aarpSize = 28
+
+	// Shorter frames are padded to this size, not counting the FCS.
+	MinFrameSize = 60
 )
 
 type (
+	Framing uint8
+
 	EthHeader struct {
 		Dst, Src ethernet.Addr
 		Size     uint16
@@ -79,12 +101,20 @@ type (
 	//     payload,
 	//   * the DDP or AARP payload itself, and
 	//   * optionally, extra padding as specified by the Ethernet header.
+	//
+	// Pad holds any bytes received after the payload: padding up to the
+	// minimum frame size, and perhaps an FCS. It is not marshaled;
+	// instead, Marshal adds fresh padding where needed.
+	//
+	// In Phase 1 packets, Size is the EtherType, and there is no
+	// LLC header. SNAPProto is still set, to identify the payload.
 	Packet struct {
 		EthHeader
 		LinkHeader        // always equals SNAP in EtherTalk
 		SNAPProto         // always AppleTalkProto or AARPProto in EtherTalk
 		Payload    []byte // marshaled ddp.Packet or aarp.Packet
-		Pad        []byte
+		Pad        []byte // as received; ignored by Marshal
+		Framing    Framing
 	}
 )
 
@@ -95,6 +125,8 @@ func Unmarshal(data []byte, pak *Packet) error {
 	err := binary.Read(r, binary.BigEndian, &pak.EthHeader)
 	if err != nil {
 		return fmt.Errorf("read eth header: %s", err.Error())
+	} else if pak.Size >= minEtherType {
+		return unmarshalPhase1(r, pak)
 	}
 
 	err = binary.Read(r, binary.BigEndian, &pak.LinkHeader)
@@ -125,7 +157,41 @@ func Unmarshal(data []byte, pak *Packet) error {
 	return nil
 }
 
-// Marshals a packet to bytes.
+// Unmarshals the rest of a Phase 1 packet, after the Ethernet header.
+func unmarshalPhase1(r *bytes.Reader, pak *Packet) error {
+	pak.Framing = Phase1
+	pak.LinkHeader = LinkHeader{}
+	switch pak.Size {
+	case AppleTalkProto.Proto:
+		pak.SNAPProto = AppleTalkProto
+	case AARPProto.Proto:
+		pak.SNAPProto = AARPProto
+	default:
+		return fmt.Errorf("read eth header: unknown ethertype $%04x", pak.Size)
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("read data: %s", err.Error())
+	}
+
+	// Ethernet II has no length field, so the payload must be told
+	// apart from the padding by its own length.
+	size := aarpSize
+	if pak.SNAPProto == AppleTalkProto {
+		if len(data) < 5 {
+			return fmt.Errorf("read data: incomplete data (%d < %d)", len(data), 5)
+		}
+		size = 3 + int(binary.BigEndian.Uint16(data[3:5])&0x03ff)
+	}
+	if len(data) < size {
+		return fmt.Errorf("read data: incomplete data (%d < %d)", len(data), size)
+	}
+	pak.Payload, pak.Pad = data[:size], data[size:]
+	return nil
+}
+
+// Marshals a packet to bytes, padded to MinFrameSize.
 func Marshal(pak Packet) ([]byte, error) {
 	w := bytes.NewBuffer([]byte{})
 	err := binary.Write(w, binary.BigEndian, pak.EthHeader)
@@ -133,14 +199,16 @@ func Marshal(pak Packet) ([]byte, error) {
 		return nil, fmt.Errorf("write eth header: %s", err.Error())
 	}
 
-	err = binary.Write(w, binary.BigEndian, pak.LinkHeader)
-	if err != nil {
-		return nil, fmt.Errorf("write link header: %s", err.Error())
-	}
+	if pak.Framing == Phase2 {
+		err = binary.Write(w, binary.BigEndian, pak.LinkHeader)
+		if err != nil {
+			return nil, fmt.Errorf("write link header: %s", err.Error())
+		}
 
-	err = binary.Write(w, binary.BigEndian, pak.SNAPProto)
-	if err != nil {
-		return nil, fmt.Errorf("write snap proto: %s", err.Error())
+		err = binary.Write(w, binary.BigEndian, pak.SNAPProto)
+		if err != nil {
+			return nil, fmt.Errorf("write snap proto: %s", err.Error())
+		}
 	}
 
 	n, err := w.Write(pak.Payload)
@@ -150,19 +218,16 @@ func Marshal(pak Packet) ([]byte, error) {
 		return nil, fmt.Errorf("write data: incomplete data (%d < %d)", n, len(pak.Payload))
 	}
 
-	n, err = w.Write(pak.Pad)
-	if err != nil {
-		return nil, fmt.Errorf("write padding: %s", err.Error())
-	} else if n < len(pak.Pad) {
-		return nil, fmt.Errorf("write padding: incomplete data (%d < %d)", n, len(pak.Pad))
+	if w.Len() < MinFrameSize {
+		w.Write(make([]byte, MinFrameSize-w.Len()))
 	}
-
 	return w.Bytes(), nil
 }
 
 // Returns true if two packets are equal. Ignores padding.
 func Equal(a, b *Packet) bool {
 	return ((a.EthHeader == b.EthHeader) &&
+		(a.Framing == b.Framing) &&
 		(a.LinkHeader == b.LinkHeader) &&
 		(a.SNAPProto == b.SNAPProto) &&
 		(bytes.Compare(a.Payload, b.Payload) == 0))
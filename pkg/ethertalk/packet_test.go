@@ -33,66 +33,100 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/sfiera/multitalk/pkg/ddp"
 	"github.com/sfiera/multitalk/pkg/ethernet"
 )
 
-func TestUnmarshalNoError(t *testing.T) {
-	cases := []struct {
-		name, hex string
-		expected  Packet
-	}{{
-		"AARP",
-		"090007ffffff" + "080007b4b1ce" + "0024" + // Ethernet header
-			"aaaa03" + "00000080f3" + // Link header + SNAP Proto
-			"0001809b06040003080007b4b1ce00ff005f00000000000000ff005f" + // DDP payload
-			"080007b4b1ce080007b4", // Padding
-		Packet{
-			EthHeader: EthHeader{
-				Dst:  ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff},
-				Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
-				Size: 36,
-			},
-			LinkHeader: SNAP,
-			SNAPProto:  AARPProto,
-			Payload:    unhex("0001809b06040003080007b4b1ce00ff005f00000000000000ff005f"),
-			Pad:        unhex("080007b4b1ce080007b4"),
+// Frames as received, with their padding.
+var captures = []struct {
+	name, hex string
+	expected  Packet
+}{{
+	"AARP",
+	"090007ffffff" + "080007b4b1ce" + "0024" + // Ethernet header
+		"aaaa03" + "00000080f3" + // Link header + SNAP Proto
+		"0001809b06040003080007b4b1ce00ff005f00000000000000ff005f" + // DDP payload
+		"080007b4b1ce080007b4", // Padding
+	Packet{
+		EthHeader: EthHeader{
+			Dst:  ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff},
+			Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
+			Size: 36,
 		},
-	}, {
-		"ZIP",
-		"090007ffffff" + "080007b4b1ce" + "001d" + // Ethernet header
-			"aaaa03" + "080007809b" + // Link header + SNAP Proto
-			"001500000000ff00ff5f060606050000000000012a080007b4b1ce" + // ZIP payload
-			"080007b4b1ce809b417070", // Padding
-		Packet{
-			EthHeader: EthHeader{
-				Dst:  ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff},
-				Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
-				Size: 29,
-			},
-			LinkHeader: SNAP,
-			SNAPProto:  AppleTalkProto,
-			Payload:    unhex("001500000000ff00ff5f060606050000000000012a"),
-			Pad:        unhex("080007b4b1ce080007b4b1ce809b417070"),
+		LinkHeader: SNAP,
+		SNAPProto:  AARPProto,
+		Payload:    unhex("0001809b06040003080007b4b1ce00ff005f00000000000000ff005f"),
+		Pad:        unhex("080007b4b1ce080007b4"),
+	},
+}, {
+	"ZIP",
+	"090007ffffff" + "080007b4b1ce" + "001d" + // Ethernet header
+		"aaaa03" + "080007809b" + // Link header + SNAP Proto
+		"001500000000ff00ff5f060606050000000000012a080007b4b1ce" + // ZIP payload
+		"080007b4b1ce809b417070", // Padding
+	Packet{
+		EthHeader: EthHeader{
+			Dst:  ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff},
+			Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
+			Size: 29,
 		},
-	}, {
-		"NBP",
-		"090007ffffff" + "080007b4b1ce" + "002e" +
-			"aaaa03" + "080007809b" +
-			"002600000000ff00ff5f02fd022101ff005ffd00034661620b576f726b73746174696f6e012a",
-		Packet{
-			EthHeader: EthHeader{
-				Dst:  ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff},
-				Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
-				Size: 46,
-			},
-			LinkHeader: SNAP,
-			SNAPProto:  AppleTalkProto,
-			Payload:    unhex("002600000000ff00ff5f02fd022101ff005ffd00034661620b576f726b73746174696f6e012a"),
-			Pad:        unhex(""),
+		LinkHeader: SNAP,
+		SNAPProto:  AppleTalkProto,
+		Payload:    unhex("001500000000ff00ff5f060606050000000000012a"),
+		Pad:        unhex("080007b4b1ce080007b4b1ce809b417070"),
+	},
+}, {
+	"NBP",
+	"090007ffffff" + "080007b4b1ce" + "002e" +
+		"aaaa03" + "080007809b" +
+		"002600000000ff00ff5f02fd022101ff005ffd00034661620b576f726b73746174696f6e012a",
+	Packet{
+		EthHeader: EthHeader{
+			Dst:  ethernet.Addr{0x09, 0x00, 0x07, 0xff, 0xff, 0xff},
+			Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
+			Size: 46,
 		},
-	}}
+		LinkHeader: SNAP,
+		SNAPProto:  AppleTalkProto,
+		Payload:    unhex("002600000000ff00ff5f02fd022101ff005ffd00034661620b576f726b73746174696f6e012a"),
+		Pad:        unhex(""),
+	},
+}, {
+	"Phase1_AARP",
+	"ffffffffffff" + "080007b4b1ce" + "80f3" + // Ethernet II header
+		"0001809b06040003080007b4b1ce00ff005f00000000000000ff005f" + // AARP payload
+		"000000000000000000000000000000000000", // Padding
+	Packet{
+		EthHeader: EthHeader{
+			Dst:  Broadcast,
+			Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
+			Size: 0x80f3,
+		},
+		SNAPProto: AARPProto,
+		Payload:   unhex("0001809b06040003080007b4b1ce00ff005f00000000000000ff005f"),
+		Pad:       unhex("000000000000000000000000000000000000"),
+		Framing:   Phase1,
+	},
+}, {
+	"Phase1_DDP",
+	"ffffffffffff" + "080007b4b1ce" + "809b" + // Ethernet II header
+		"ff2a01" + "0006fdfd0201" + // LLAP header + short DDP
+		"0000", // Padding
+	Packet{
+		EthHeader: EthHeader{
+			Dst:  Broadcast,
+			Src:  ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce},
+			Size: 0x809b,
+		},
+		SNAPProto: AppleTalkProto,
+		Payload:   unhex("ff2a010006fdfd0201"),
+		Pad:       unhex("0000"),
+		Framing:   Phase1,
+	},
+}}
 
-	for _, c := range cases {
+func TestUnmarshalNoError(t *testing.T) {
+	for _, c := range captures {
 		t.Run(c.name, func(t *testing.T) {
 			assert := assert.New(t)
 			p := Packet{}
@@ -103,6 +137,48 @@ func TestUnmarshalNoError(t *testing.T) {
 	}
 }
 
+func TestMarshal(t *testing.T) {
+	for _, c := range captures {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			data, err := Marshal(c.expected)
+			if !assert.NoError(err) {
+				return
+			}
+			// The received padding is replaced by zeros.
+			frame := unhex(c.hex)
+			frame = frame[:len(frame)-len(c.expected.Pad)]
+			for len(frame) < MinFrameSize {
+				frame = append(frame, 0)
+			}
+			assert.Equal(frame, data)
+		})
+	}
+}
+
+func TestMarshalPads(t *testing.T) {
+	assert := assert.New(t)
+	p, err := AppleTalk(ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce}, ddp.ExtPacket{
+		ExtHeader: ddp.ExtHeader{Size: 14, DstNode: 0xff, DstSocket: 2, SrcSocket: 2, Proto: ddp.ProtoNBP},
+		Data:      []byte{0x21},
+	})
+	if !assert.NoError(err) {
+		return
+	}
+	data, err := Marshal(*p)
+	if assert.NoError(err) {
+		assert.Len(data, MinFrameSize)
+		assert.Equal(make([]byte, MinFrameSize-36), data[36:])
+	}
+
+	// Received padding and FCS are not forwarded.
+	p.Pad = unhex("deadbeefdeadbeef")
+	again, err := Marshal(*p)
+	if assert.NoError(err) {
+		assert.Equal(data, again)
+	}
+}
+
 func TestError(t *testing.T) {
 
 	cases := []struct {
@@ -122,6 +198,16 @@ func TestError(t *testing.T) {
 		"090007ffffff" + "080007b4b1ce" + "0010" +
 			"ffffff",
 		"read link header: not SNAP",
+	}, {
+		"ethertype",
+		"ffffffffffff" + "080007b4b1ce" + "0800" +
+			"4500",
+		"read eth header: unknown ethertype $0800",
+	}, {
+		"phase1_incomplete",
+		"ffffffffffff" + "080007b4b1ce" + "809b" +
+			"ff2a01" + "0010fdfd0201",
+		"read data: incomplete data (9 < 19)",
 	}}
 
 	for _, c := range cases {
@@ -0,0 +1,134 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package ethertalk
+
+import (
+	"fmt"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/llap"
+)
+
+// ToPhase2 converts a Phase 1 packet to Phase 2 framing.
+//
+// The LLAP header is removed from DDP packets, and short DDP packets
+// are extended, with network 0 (“this network”). Broadcasts are sent
+// to the AppleTalk broadcast address.
+func ToPhase2(pak Packet) (Packet, error) {
+	if pak.Framing == Phase2 {
+		return pak, nil
+	}
+	payload := pak.Payload
+	if pak.SNAPProto == AppleTalkProto {
+		l := llap.Packet{}
+		err := llap.Unmarshal(pak.Payload, &l)
+		if err == nil {
+			err = llap.Validate(l)
+		}
+		if err != nil {
+			return Packet{}, fmt.Errorf("phase 1 to 2: %s", err.Error())
+		}
+
+		switch l.Kind {
+		case llap.TypeExtDDP:
+			payload = l.Payload
+		case llap.TypeDDP:
+			short := ddp.Packet{}
+			err = ddp.Unmarshal(l.Payload, &short)
+			if err != nil {
+				return Packet{}, fmt.Errorf("phase 1 to 2: %s", err.Error())
+			}
+			payload, err = ddp.ExtMarshal(ddp.ShortToExt(short, 0, l.DstNode, l.SrcNode))
+			if err != nil {
+				return Packet{}, fmt.Errorf("phase 1 to 2: %s", err.Error())
+			}
+		default:
+			return Packet{}, fmt.Errorf("phase 1 to 2: unexpected llap type $%02x", l.Kind)
+		}
+	}
+
+	dst := pak.Dst
+	if dst == Broadcast {
+		dst = AppleTalkBroadcast
+	}
+	return Packet{
+		EthHeader: EthHeader{
+			Dst:  dst,
+			Src:  pak.Src,
+			Size: LinkHeaderSize + SNAPProtoSize + uint16(len(payload)),
+		},
+		LinkHeader: SNAP,
+		SNAPProto:  pak.SNAPProto,
+		Payload:    payload,
+	}, nil
+}
+
+// ToPhase1 converts a Phase 2 packet to Phase 1 framing.
+//
+// DDP packets are given an LLAP header, and stay extended.
+// Broadcasts and multicasts are sent to the Ethernet broadcast address,
+// as Phase 1 has no multicast.
+func ToPhase1(pak Packet) (Packet, error) {
+	if pak.Framing == Phase1 {
+		return pak, nil
+	}
+	payload := pak.Payload
+	if pak.SNAPProto == AppleTalkProto {
+		d := ddp.ExtPacket{}
+		err := ddp.ExtUnmarshal(pak.Payload, &d)
+		if err != nil {
+			return Packet{}, fmt.Errorf("phase 2 to 1: %s", err.Error())
+		}
+		payload, err = llap.Marshal(llap.Packet{
+			Header: llap.Header{
+				DstNode: d.DstNode,
+				SrcNode: d.SrcNode,
+				Kind:    llap.TypeExtDDP,
+			},
+			Payload: pak.Payload,
+		})
+		if err != nil {
+			return Packet{}, fmt.Errorf("phase 2 to 1: %s", err.Error())
+		}
+	}
+
+	dst := pak.Dst
+	if dst[0]&0x01 != 0 {
+		dst = Broadcast
+	}
+	return Packet{
+		EthHeader: EthHeader{
+			Dst:  dst,
+			Src:  pak.Src,
+			Size: pak.SNAPProto.Proto,
+		},
+		SNAPProto: pak.SNAPProto,
+		Payload:   payload,
+		Framing:   Phase1,
+	}, nil
+}
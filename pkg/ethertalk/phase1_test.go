@@ -0,0 +1,141 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package ethertalk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sfiera/multitalk/pkg/ethernet"
+)
+
+var src = ethernet.Addr{0x08, 0x00, 0x07, 0xb4, 0xb1, 0xce}
+
+func TestToPhase2(t *testing.T) {
+	cases := []struct {
+		name     string
+		phase1   Packet
+		expected Packet
+	}{{
+		"short",
+		Packet{
+			EthHeader: EthHeader{Dst: Broadcast, Src: src, Size: 0x809b},
+			SNAPProto: AppleTalkProto,
+			Payload:   unhex("ff2a01" + "0006fdfd0201"),
+			Framing:   Phase1,
+		},
+		Packet{
+			EthHeader:  EthHeader{Dst: AppleTalkBroadcast, Src: src, Size: 22},
+			LinkHeader: SNAP,
+			SNAPProto:  AppleTalkProto,
+			Payload:    unhex("000e000000000000ff2afdfd02" + "01"),
+		},
+	}, {
+		"extended",
+		Packet{
+			EthHeader: EthHeader{Dst: src, Src: src, Size: 0x809b},
+			SNAPProto: AppleTalkProto,
+			Payload:   unhex("052a02" + "000e000003e803e9052a04fd04" + "01"),
+			Framing:   Phase1,
+		},
+		Packet{
+			EthHeader:  EthHeader{Dst: src, Src: src, Size: 22},
+			LinkHeader: SNAP,
+			SNAPProto:  AppleTalkProto,
+			Payload:    unhex("000e000003e803e9052a04fd04" + "01"),
+		},
+	}, {
+		"aarp",
+		Packet{
+			EthHeader: EthHeader{Dst: Broadcast, Src: src, Size: 0x80f3},
+			SNAPProto: AARPProto,
+			Payload:   unhex("0001809b06040003080007b4b1ce00ff005f00000000000000ff005f"),
+			Framing:   Phase1,
+		},
+		Packet{
+			EthHeader:  EthHeader{Dst: AppleTalkBroadcast, Src: src, Size: 36},
+			LinkHeader: SNAP,
+			SNAPProto:  AARPProto,
+			Payload:    unhex("0001809b06040003080007b4b1ce00ff005f00000000000000ff005f"),
+		},
+	}}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert := assert.New(t)
+			p, err := ToPhase2(c.phase1)
+			if assert.NoError(err) {
+				assert.Equal(c.expected, p)
+			}
+		})
+	}
+}
+
+func TestToPhase1(t *testing.T) {
+	assert := assert.New(t)
+	phase2 := Packet{
+		EthHeader:  EthHeader{Dst: AppleTalkBroadcast, Src: src, Size: 22},
+		LinkHeader: SNAP,
+		SNAPProto:  AppleTalkProto,
+		Payload:    unhex("000e000003e803e9ff2a04fd04" + "01"),
+	}
+	p, err := ToPhase1(phase2)
+	if assert.NoError(err) {
+		assert.Equal(Packet{
+			EthHeader: EthHeader{Dst: Broadcast, Src: src, Size: 0x809b},
+			SNAPProto: AppleTalkProto,
+			Payload:   unhex("ff2a02" + "000e000003e803e9ff2a04fd04" + "01"),
+			Framing:   Phase1,
+		}, p)
+	}
+
+	bin, err := Marshal(p)
+	if assert.NoError(err) {
+		assert.Equal(unhex("ffffffffffff"+"080007b4b1ce"+"809b"+"ff2a02"+"000e000003e803e9ff2a04fd04"+"01"+
+			strings.Repeat("00", 29)), bin) // padding
+	}
+
+	back, err := ToPhase2(p)
+	if assert.NoError(err) {
+		assert.Equal(phase2, back)
+	}
+}
+
+func TestToPhase2Error(t *testing.T) {
+	_, err := ToPhase2(Packet{
+		EthHeader: EthHeader{Dst: Broadcast, Src: src, Size: 0x809b},
+		SNAPProto: AppleTalkProto,
+		Payload:   unhex("ff2a81"),
+		Framing:   Phase1,
+	})
+	if assert.Error(t, err) {
+		assert.Equal(t, "phase 1 to 2: unexpected llap type $81", err.Error())
+	}
+}
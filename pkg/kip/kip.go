@@ -0,0 +1,111 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Encodes and decodes DDP packets carried in UDP, as by KIP and CAP.
+//
+// Each datagram holds an LLAP header and a DDP packet. The UDP port is
+// a base port, normally 200, plus the DDP socket number.
+package kip
+
+import (
+	"fmt"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/llap"
+)
+
+// Base of the port mapping, to which socket numbers are added.
+const DefaultBasePort = 200
+
+// Port returns the UDP port which carries a DDP socket.
+func Port(base int, socket ddp.Socket) int {
+	return base + int(socket)
+}
+
+// Socket returns the DDP socket carried by a UDP port,
+// or false if the port is outside the mapping.
+func Socket(base, port int) (ddp.Socket, bool) {
+	socket := port - base
+	if socket < 1 || socket > 254 {
+		return 0, false
+	}
+	return ddp.Socket(socket), true
+}
+
+// Unmarshals a packet from a UDP datagram.
+//
+// Short DDP packets are converted to extended ones, with network 0
+// (“this network”).
+func Unmarshal(data []byte, pak *ddp.ExtPacket) error {
+	l := llap.Packet{}
+	err := llap.Unmarshal(data, &l)
+	if err != nil {
+		return fmt.Errorf("read kip: %s", err.Error())
+	}
+	err = llap.Validate(l)
+	if err != nil {
+		return fmt.Errorf("read kip: %s", err.Error())
+	}
+
+	switch l.Kind {
+	case llap.TypeDDP:
+		short := ddp.Packet{}
+		err = ddp.Unmarshal(l.Payload, &short)
+		if err != nil {
+			return fmt.Errorf("read kip: %s", err.Error())
+		}
+		*pak = ddp.ShortToExt(short, 0, l.DstNode, l.SrcNode)
+	case llap.TypeExtDDP:
+		err = ddp.ExtUnmarshal(l.Payload, pak)
+		if err != nil {
+			return fmt.Errorf("read kip: %s", err.Error())
+		}
+	default:
+		return fmt.Errorf("read kip: unexpected llap type $%02x", l.Kind)
+	}
+	return nil
+}
+
+// Marshals a packet to a UDP datagram.
+func Marshal(pak ddp.ExtPacket) ([]byte, error) {
+	payload, err := ddp.ExtMarshal(pak)
+	if err != nil {
+		return nil, fmt.Errorf("write kip: %s", err.Error())
+	}
+	data, err := llap.Marshal(llap.Packet{
+		Header: llap.Header{
+			DstNode: pak.DstNode,
+			SrcNode: pak.SrcNode,
+			Kind:    llap.TypeExtDDP,
+		},
+		Payload: payload,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("write kip: %s", err.Error())
+	}
+	return data, nil
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package kip
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(strings.ReplaceAll(s, " ", ""))
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+var echo = ddp.ExtPacket{
+	ExtHeader: ddp.ExtHeader{
+		Size:      0x000e,
+		DstNet:    1000,
+		DstNode:   5,
+		DstSocket: 4,
+		SrcNet:    1001,
+		SrcNode:   6,
+		SrcSocket: 0x80,
+		Proto:     ddp.ProtoAEP,
+	},
+	Data: []byte{0x01},
+}
+
+func TestMarshal(t *testing.T) {
+	assert := assert.New(t)
+	data, err := Marshal(echo)
+	if assert.NoError(err) {
+		assert.Equal(unhex("05 06 02"+"000e 0000 03e8 03e9 05 06 04 80 04 01"), data)
+	}
+}
+
+func TestUnmarshal(t *testing.T) {
+	for _, tt := range []struct {
+		name, hex string
+		want      ddp.ExtPacket
+		err       string
+	}{{
+		name: "extended",
+		hex:  "05 06 02" + "000e 0000 03e8 03e9 05 06 04 80 04 01",
+		want: echo,
+	}, {
+		name: "short",
+		hex:  "05 06 01" + "0006 04 80 04 01",
+		want: ddp.ExtPacket{
+			ExtHeader: ddp.ExtHeader{
+				Size:      0x000e,
+				DstNode:   5,
+				DstSocket: 4,
+				SrcNode:   6,
+				SrcSocket: 0x80,
+				Proto:     ddp.ProtoAEP,
+			},
+			Data: []byte{0x01},
+		},
+	}, {
+		name: "enq",
+		hex:  "05 06 81",
+		err:  "read kip: unexpected llap type $81",
+	}, {
+		name: "length",
+		hex:  "05 06 02" + "000f 0000 03e8 03e9 05 06 04 80 04 01",
+		err:  "read kip: DDP packet length mismatch: 14 vs. 15",
+	}, {
+		name: "empty",
+		hex:  "",
+		err:  "read kip: read udp header: EOF",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			pak := ddp.ExtPacket{}
+			err := Unmarshal(unhex(tt.hex), &pak)
+			if tt.err != "" {
+				if assert.Error(err) {
+					assert.Equal(tt.err, err.Error())
+				}
+				return
+			}
+			if assert.NoError(err) {
+				assert.Equal(tt.want, pak)
+			}
+		})
+	}
+}
+
+func TestPortMapping(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(202, Port(DefaultBasePort, 2))
+	assert.Equal(454, Port(DefaultBasePort, 254))
+
+	s, ok := Socket(DefaultBasePort, 206)
+	assert.True(ok)
+	assert.Equal(ddp.Socket(6), s)
+	_, ok = Socket(DefaultBasePort, 200)
+	assert.False(ok)
+	_, ok = Socket(DefaultBasePort, 455)
+	assert.False(ok)
+}
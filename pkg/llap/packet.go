@@ -42,6 +42,8 @@ const (
 	TypeExtDDP = Type(0x02)
 	TypeEnq    = Type(0x81)
 	TypeAck    = Type(0x82)
+	TypeRTS    = Type(0x84)
+	TypeCTS    = Type(0x85)
 )
 
 type (
@@ -58,6 +60,34 @@ type (
 	}
 )
 
+// IsControl returns true for control frames, which have no payload.
+func (t Type) IsControl() bool {
+	return t&0x80 != 0
+}
+
+// Validate returns an error if pak is not a well-formed LLAP packet:
+// either a control frame with no payload, or a DDP packet whose length
+// matches its header.
+func Validate(pak Packet) error {
+	switch pak.Kind {
+	case TypeDDP, TypeExtDDP:
+		if len(pak.Payload) < 2 {
+			return fmt.Errorf("invalid DDP packet length: %d", len(pak.Payload))
+		}
+		inferredLength := binary.BigEndian.Uint16(pak.Payload[:2]) & 0x03ff
+		if int(inferredLength) != len(pak.Payload) {
+			return fmt.Errorf("DDP packet length mismatch: %d vs. %d", len(pak.Payload), inferredLength)
+		}
+	case TypeEnq, TypeAck, TypeRTS, TypeCTS:
+		if len(pak.Payload) != 0 {
+			return fmt.Errorf("control frame packet with payload")
+		}
+	default:
+		return fmt.Errorf("invalid packet type: $%02x", pak.Kind)
+	}
+	return nil
+}
+
 func Unmarshal(data []byte, pak *Packet) error {
 	r := bytes.NewReader(data)
 	err := binary.Read(r, binary.BigEndian, &pak.Header)
@@ -113,6 +143,26 @@ func Ack(dstNode, srcNode ddp.Node) *Packet {
 	}
 }
 
+func RTS(dstNode, srcNode ddp.Node) *Packet {
+	return &Packet{
+		Header: Header{
+			DstNode: dstNode,
+			SrcNode: srcNode,
+			Kind:    TypeRTS,
+		},
+	}
+}
+
+func CTS(dstNode, srcNode ddp.Node) *Packet {
+	return &Packet{
+		Header: Header{
+			DstNode: dstNode,
+			SrcNode: srcNode,
+			Kind:    TypeCTS,
+		},
+	}
+}
+
 func AppleTalk(dstNode, srcNode ddp.Node, payload ddp.Packet) (*Packet, error) {
 	data, err := ddp.Marshal(payload)
 	if err != nil {
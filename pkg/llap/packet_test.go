@@ -0,0 +1,97 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package llap
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		packet  Packet
+		wantErr string
+	}{{
+		name:   "enq",
+		packet: *Enq(2, 1),
+	}, {
+		name:   "ack",
+		packet: *Ack(2, 1),
+	}, {
+		name:   "rts",
+		packet: *RTS(2, 1),
+	}, {
+		name:   "cts",
+		packet: *CTS(2, 1),
+	}, {
+		name: "ddp",
+		packet: Packet{
+			Header:  Header{DstNode: 2, SrcNode: 1, Kind: TypeDDP},
+			Payload: []byte{0x00, 0x03, 0xaa},
+		},
+	}, {
+		name: "short-ddp",
+		packet: Packet{
+			Header:  Header{DstNode: 2, SrcNode: 1, Kind: TypeExtDDP},
+			Payload: []byte{0x00},
+		},
+		wantErr: `invalid DDP packet length: 1`,
+	}, {
+		name: "non-empty-cts",
+		packet: Packet{
+			Header:  Header{DstNode: 2, SrcNode: 1, Kind: TypeCTS},
+			Payload: []byte{0x00},
+		},
+		wantErr: `control frame packet with payload`,
+	}, {
+		name:    "invalid-type",
+		packet:  Packet{Header: Header{DstNode: 2, SrcNode: 1, Kind: 0x83}},
+		wantErr: `invalid packet type: $83`,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(tt.packet)
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+			} else if assert.Error(t, err) {
+				assert.Equal(t, tt.wantErr, err.Error())
+			}
+		})
+	}
+}
+
+func TestIsControl(t *testing.T) {
+	assert := assert.New(t)
+	assert.False(TypeDDP.IsControl())
+	assert.False(TypeExtDDP.IsControl())
+	assert.True(TypeEnq.IsControl())
+	assert.True(TypeAck.IsControl())
+	assert.True(TypeRTS.IsControl())
+	assert.True(TypeCTS.IsControl())
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Encodes and decodes NBP (Name Binding Protocol) packets
+package nbp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+const (
+	FunctionBrRq      = Function(1) // broadcast request, to a router
+	FunctionLkUp      = Function(2) // lookup
+	FunctionLkUpReply = Function(3) // lookup reply
+	FunctionFwdReq    = Function(4) // forward request, between routers
+)
+
+type (
+	Function uint8
+
+	// An Entity is an NBP name, as object:type@zone.
+	Entity struct {
+		Object, Type, Zone string
+	}
+
+	Tuple struct {
+		Network    ddp.Network
+		Node       ddp.Node
+		Socket     ddp.Socket
+		Enumerator uint8
+		Entity
+	}
+
+	Packet struct {
+		Function Function
+		ID       uint8
+		Tuples   []Tuple
+	}
+)
+
+func (e Entity) String() string {
+	return fmt.Sprintf("%s:%s@%s", e.Object, e.Type, e.Zone)
+}
+
+// Unmarshals a packet from the data of a DDP packet.
+func Unmarshal(data []byte, pak *Packet) error {
+	r := bytes.NewReader(data)
+	ctl, err := r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read nbp header: %s", err.Error())
+	}
+	pak.Function = Function(ctl >> 4)
+	pak.ID, err = r.ReadByte()
+	if err != nil {
+		return fmt.Errorf("read nbp header: %s", err.Error())
+	}
+
+	pak.Tuples = make([]Tuple, ctl&0x0f)
+	for i := range pak.Tuples {
+		t := &pak.Tuples[i]
+		var addr struct {
+			Network    ddp.Network
+			Node       ddp.Node
+			Socket     ddp.Socket
+			Enumerator uint8
+		}
+		err = binary.Read(r, binary.BigEndian, &addr)
+		if err != nil {
+			return fmt.Errorf("read nbp tuple: %s", err.Error())
+		}
+		t.Network, t.Node, t.Socket, t.Enumerator = addr.Network, addr.Node, addr.Socket, addr.Enumerator
+		for _, s := range []*string{&t.Object, &t.Type, &t.Zone} {
+			*s, err = readString(r)
+			if err != nil {
+				return fmt.Errorf("read nbp tuple: %s", err.Error())
+			}
+		}
+	}
+
+	if r.Len() > 0 {
+		return fmt.Errorf("read nbp: excess data")
+	}
+	return nil
+}
+
+// Reads a Pascal string: a length byte, then the characters.
+func readString(r *bytes.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, n)
+	_, err = io.ReadFull(r, s)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// Marshals a packet to the data of a DDP packet.
+func Marshal(pak Packet) ([]byte, error) {
+	if pak.Function > 0x0f || len(pak.Tuples) > 0x0f {
+		return nil, fmt.Errorf("write nbp header: out of range")
+	}
+	w := bytes.NewBuffer([]byte{})
+	w.WriteByte(byte(pak.Function)<<4 | byte(len(pak.Tuples)))
+	w.WriteByte(pak.ID)
+	for _, t := range pak.Tuples {
+		_ = binary.Write(w, binary.BigEndian, t.Network)
+		w.Write([]byte{byte(t.Node), byte(t.Socket), t.Enumerator})
+		for _, s := range []string{t.Object, t.Type, t.Zone} {
+			if len(s) > 32 {
+				return nil, fmt.Errorf("write nbp tuple: name too long: %q", s)
+			}
+			w.WriteByte(byte(len(s)))
+			w.WriteString(s)
+		}
+	}
+	return w.Bytes(), nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package nbp
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// A lookup for Fab:Workstation@*, as captured.
+var lookup = Packet{
+	Function: FunctionLkUp,
+	ID:       1,
+	Tuples: []Tuple{{
+		Network: 0xff00,
+		Node:    0x5f,
+		Socket:  0xfd,
+		Entity:  Entity{Object: "Fab", Type: "Workstation", Zone: "*"},
+	}},
+}
+
+const lookupHex = "2101" + "ff005ffd00" + "03466162" + "0b576f726b73746174696f6e" + "012a"
+
+func TestUnmarshal(t *testing.T) {
+	assert := assert.New(t)
+	pak := Packet{}
+	if assert.NoError(Unmarshal(unhex(lookupHex), &pak)) {
+		assert.Equal(lookup, pak)
+		assert.Equal("Fab:Workstation@*", pak.Tuples[0].Entity.String())
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	assert := assert.New(t)
+	data, err := Marshal(lookup)
+	if assert.NoError(err) {
+		assert.Equal(unhex(lookupHex), data)
+	}
+}
+
+func TestError(t *testing.T) {
+	for _, tt := range []struct {
+		name, hex, err string
+	}{
+		{"empty", "", "read nbp header: EOF"},
+		{"no_id", "21", "read nbp header: EOF"},
+		{"short_tuple", "2101ff00", "read nbp tuple: unexpected EOF"},
+		{"short_name", "2101ff005ffd00034661", "read nbp tuple: unexpected EOF"},
+		{"excess", lookupHex + "00", "read nbp: excess data"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			data, _ := hex.DecodeString(tt.hex)
+			err := Unmarshal(data, &Packet{})
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.err, err.Error())
+			}
+		})
+	}
+}
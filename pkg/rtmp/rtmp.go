@@ -0,0 +1,163 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Encodes and decodes RTMP (Routing Table Maintenance Protocol) packets
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+// Socket is the socket of the RTMP process in routers.
+const Socket = ddp.Socket(1)
+
+const (
+	idLength     = 8    // bits in the node ID of the sender
+	version      = 0x82 // RTMP version 2, in place of a tuple’s last byte
+	extendedFlag = 0x80
+	distanceMask = 0x1f
+)
+
+type Function uint8
+
+// Functions of RTMP Request packets, with DDP type ddp.ProtoRTMPReq.
+const (
+	FunctionRequest  = Function(1) // for the router’s address
+	FunctionRDRSplit = Function(2) // for routes, with split horizon
+	FunctionRDRFull  = Function(3) // for routes, without split horizon
+)
+
+type (
+	// A Tuple describes a route to a network.
+	Tuple struct {
+		Range    ddp.NetworkRange
+		Extended bool
+		Distance uint8
+	}
+
+	// A Packet is an RTMP Data packet, which routers broadcast, or an
+	// RTMP Response, which has no tuples besides the network’s own.
+	Packet struct {
+		Network ddp.Network // of the sending router
+		Node    ddp.Node
+
+		// If the sender is on an extended network, the first tuple
+		// is the range of that network, at distance 0.
+		Extended bool
+		Tuples   []Tuple
+	}
+)
+
+// Unmarshals a packet from the data of a DDP packet.
+func Unmarshal(data []byte, pak *Packet) error {
+	r := bytes.NewReader(data)
+	var head struct {
+		Network  ddp.Network
+		IDLength uint8
+		Node     ddp.Node
+	}
+	err := binary.Read(r, binary.BigEndian, &head)
+	if err != nil {
+		return fmt.Errorf("read rtmp header: %s", err.Error())
+	} else if head.IDLength != idLength {
+		return fmt.Errorf("read rtmp header: unsupported ID length %d", head.IDLength)
+	}
+	pak.Network, pak.Node = head.Network, head.Node
+
+	// A non-extended network has an empty tuple to give the version.
+	rest := data[len(data)-r.Len():]
+	pak.Extended = !bytes.HasPrefix(rest, []byte{0x00, 0x00, version})
+	if !pak.Extended {
+		_, _ = r.Seek(3, io.SeekCurrent)
+	}
+
+	pak.Tuples = nil
+	for r.Len() > 0 {
+		t := Tuple{}
+		var tHead struct {
+			First ddp.Network
+			Flags uint8
+		}
+		err = binary.Read(r, binary.BigEndian, &tHead)
+		if err != nil {
+			return fmt.Errorf("read rtmp tuple: %s", err.Error())
+		}
+		t.Range = ddp.NetworkRange{First: tHead.First, Last: tHead.First}
+		t.Extended = tHead.Flags&extendedFlag != 0
+		t.Distance = tHead.Flags & distanceMask
+		if t.Extended {
+			var tail struct {
+				Last    ddp.Network
+				Version uint8
+			}
+			err = binary.Read(r, binary.BigEndian, &tail)
+			if err != nil {
+				return fmt.Errorf("read rtmp tuple: %s", err.Error())
+			}
+			t.Range.Last = tail.Last
+		}
+		pak.Tuples = append(pak.Tuples, t)
+	}
+	if pak.Extended && (len(pak.Tuples) == 0 || !pak.Tuples[0].Extended) {
+		return fmt.Errorf("read rtmp: missing network range")
+	}
+	return nil
+}
+
+// Marshals a packet to the data of a DDP packet.
+func Marshal(pak Packet) ([]byte, error) {
+	if pak.Extended && (len(pak.Tuples) == 0 || !pak.Tuples[0].Extended) {
+		return nil, fmt.Errorf("write rtmp: missing network range")
+	}
+	w := bytes.NewBuffer([]byte{})
+	_ = binary.Write(w, binary.BigEndian, pak.Network)
+	w.Write([]byte{idLength, byte(pak.Node)})
+	if !pak.Extended {
+		w.Write([]byte{0x00, 0x00, version})
+	}
+	for _, t := range pak.Tuples {
+		if t.Distance > distanceMask {
+			return nil, fmt.Errorf("write rtmp tuple: distance %d out of range", t.Distance)
+		}
+		flags := t.Distance
+		if t.Extended {
+			flags |= extendedFlag
+		}
+		_ = binary.Write(w, binary.BigEndian, t.Range.First)
+		w.WriteByte(flags)
+		if t.Extended {
+			_ = binary.Write(w, binary.BigEndian, t.Range.Last)
+			w.WriteByte(version)
+		}
+	}
+	return w.Bytes(), nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package rtmp
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestMarshalUnmarshal(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		pak  Packet
+		hex  string
+	}{{
+		name: "non-extended",
+		pak: Packet{
+			Network: 10,
+			Node:    254,
+			Tuples: []Tuple{
+				{Range: ddp.NetworkRange{First: 20, Last: 20}, Distance: 1},
+				{Range: ddp.NetworkRange{First: 100, Last: 109}, Extended: true, Distance: 2},
+			},
+		},
+		hex: "000a08fe" + "000082" + "001401" + "0064" + "82" + "006d82",
+	}, {
+		name: "extended",
+		pak: Packet{
+			Network:  1000,
+			Node:     254,
+			Extended: true,
+			Tuples: []Tuple{
+				{Range: ddp.NetworkRange{First: 1000, Last: 1009}, Extended: true},
+				{Range: ddp.NetworkRange{First: 20, Last: 20}, Distance: 1},
+			},
+		},
+		hex: "03e808fe" + "03e88003f182" + "001401",
+	}, {
+		name: "response",
+		pak:  Packet{Network: 10, Node: 254},
+		hex:  "000a08fe000082",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			data, err := Marshal(tt.pak)
+			if assert.NoError(err) {
+				assert.Equal(unhex(tt.hex), data)
+			}
+			pak := Packet{}
+			if assert.NoError(Unmarshal(unhex(tt.hex), &pak)) {
+				assert.Equal(tt.pak, pak)
+			}
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	for _, tt := range []struct {
+		name, hex, err string
+	}{
+		{"empty", "", "read rtmp header: EOF"},
+		{"id-length", "000a10fe000082", "read rtmp header: unsupported ID length 16"},
+		{"short-tuple", "000a08fe00008200", "read rtmp tuple: unexpected EOF"},
+		{"short-range", "03e808fe03e880", "read rtmp tuple: EOF"},
+		{"no-range", "03e808fe001401", "read rtmp: missing network range"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Unmarshal(unhex(tt.hex), &Packet{})
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.err, err.Error())
+			}
+		})
+	}
+	_, err := Marshal(Packet{Extended: true})
+	assert.Error(t, err)
+}
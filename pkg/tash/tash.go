@@ -34,9 +34,11 @@ package tash
 import (
 	"bufio"
 	"bytes"
-	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
 
 	"github.com/sfiera/multitalk/pkg/ddp"
 	"github.com/sfiera/multitalk/pkg/llap"
@@ -49,15 +51,64 @@ const (
 	escapeFrameDone    = byte(0xfd)
 	escapeFramingError = byte(0xfe)
 	escapeFrameAbort   = byte(0xfa)
+	escapeFrameBadCRC  = byte(0xfc) // only with FeatureCRCChecking
 
-	commandNoop    = byte(0x00)
-	commandFrame   = byte(0x01)
-	commandNodeIDs = byte(0x02)
+	commandNoop     = byte(0x00)
+	commandFrame    = byte(0x01)
+	commandNodeIDs  = byte(0x02)
+	commandFeatures = byte(0x03)
+
+	// With FeatureCRCChecking, how often the Decoder checks that
+	// TashTalk really is checking CRCs.
+	verifyInterval = 16
 )
 
+// Features are optional capabilities of newer TashTalk firmware.
+//
+// TashTalk does not report its version or features. Older firmware
+// ignores the command that enables them, but with FeatureCRCChecking
+// enabled, the Decoder notices when TashTalk passes on a bad CRC;
+// see Decoder.SetFeatures.
+type Features uint8
+
+const (
+	// TashTalk calculates the CRC of frames sent by the host,
+	// so the Encoder omits it and TashTalk appends it on the wire.
+	FeatureCRCCalculation = Features(0x80)
+	// TashTalk checks the CRC of frames received from the network,
+	// so the Decoder can trust it instead of checking every frame.
+	FeatureCRCChecking = Features(0x40)
+)
+
+// Reasons that a Decoder drops a frame, passed to a DropFunc.
+var (
+	ErrFramingError = errors.New("framing error")
+	ErrFrameAborted = errors.New("frame aborted")
+	ErrBadCRC       = errors.New("invalid CRC")
+	ErrMalformed    = errors.New("malformed frame")
+)
+
+// A DropFunc is called when a Decoder drops a frame, with the reason and
+// the unescaped data received so far. The data must not be retained.
+type DropFunc func(reason error, frame []byte)
+
 // A Decoder translates TashTalk serial input to LLAP packets.
 type Decoder struct {
-	r io.ByteReader
+	r         io.ByteReader
+	features  Features
+	confirmed bool // TashTalk has reported a bad CRC itself
+	frames    int  // since the last verified frame
+	onDrop    DropFunc
+
+	framingErrors, aborts, badCRC, malformed uint64
+}
+
+// DecoderStats counts packets dropped by a Decoder.
+type DecoderStats struct {
+	FramingErrors uint64 // frames with a framing error from TashTalk
+	Aborts        uint64 // frames aborted from TashTalk
+	BadCRC        uint64 // frames with an invalid CRC16
+	Malformed     uint64 // frames too short for LLAP, or badly escaped
 }
 
 // NewDecoder returns a Decoder with r as its input.
@@ -69,18 +120,77 @@ func NewDecoder(r io.Reader) Decoder {
 	}
 }
 
+// Reset discards any partially-decoded frame and switches to r as input.
+// Stats and features are preserved.
+func (d *Decoder) Reset(r io.Reader) {
+	d.r = NewDecoder(r).r
+}
+
+// SetFeatures sets the features that have been enabled on TashTalk
+// with Encoder.SetFeatures. Only FeatureCRCChecking affects decoding.
+//
+// With FeatureCRCChecking, the Decoder checks the CRC of every frame
+// until the feature is confirmed, and of one in every few frames after.
+// If a check fails, TashTalk must not support the feature, and the
+// Decoder clears it and checks every frame again.
+func (d *Decoder) SetFeatures(f Features) {
+	d.features = f
+	d.confirmed = false
+	d.frames = 0
+}
+
+// Confirmed returns true if TashTalk has reported a frame with a bad
+// CRC since SetFeatures, which only firmware that supports
+// FeatureCRCChecking does. Such firmware also supports
+// FeatureCRCCalculation.
+func (d *Decoder) Confirmed() bool {
+	return d.confirmed
+}
+
+// Features returns the features that the Decoder is relying on.
+// This is less than was set if TashTalk turned out not to support them.
+func (d *Decoder) Features() Features {
+	return d.features
+}
+
+// SetDropFunc sets a function to call when a frame is dropped.
+func (d *Decoder) SetDropFunc(f DropFunc) {
+	d.onDrop = f
+}
+
+// Stats returns counts of packets dropped so far.
+// It is safe to call concurrently with Decode.
+func (d *Decoder) Stats() DecoderStats {
+	return DecoderStats{
+		FramingErrors: atomic.LoadUint64(&d.framingErrors),
+		Aborts:        atomic.LoadUint64(&d.aborts),
+		BadCRC:        atomic.LoadUint64(&d.badCRC),
+		Malformed:     atomic.LoadUint64(&d.malformed),
+	}
+}
+
+func (d *Decoder) drop(reason error, count *uint64, buf *bytes.Buffer) {
+	atomic.AddUint64(count, 1)
+	if d.onDrop != nil {
+		d.onDrop(reason, buf.Bytes())
+	}
+	buf.Reset()
+}
+
 // Decode decodes the next valid packet from the decoder’s input.
 // If necessary, it blocks until a full packet can be decoded.
 //
 // Returns an error if an error condition occurs reading from the input
 // (including EOF).
 //
-// If an error occurs decoding a packet, then the packet is silently dropped
+// If an error occurs decoding a packet, then the packet is dropped
 // and decoding continues. Such error cases include:
 // * Malformed packet
 // * Invalid CRC16
 // * Frame error from TashTalk
 // * Frame aborted from TashTalk
+//
+// Dropped packets are counted in Stats, and passed to the DropFunc, if set.
 func (d *Decoder) Decode(pak *llap.Packet) (err error) {
 	escape := false
 	buf := bytes.Buffer{}
@@ -101,34 +211,63 @@ func (d *Decoder) Decode(pak *llap.Packet) (err error) {
 		}
 
 		escape = false
-		if c != escapeFrameDone {
-			if c == escapeZero {
-				buf.WriteByte(0x00)
-			} else {
-				buf.Reset()
-			}
+		switch c {
+		case escapeZero:
+			buf.WriteByte(0x00)
+			continue
+		case escapeFrameDone:
+			// handled below
+		case escapeFramingError:
+			d.drop(ErrFramingError, &d.framingErrors, &buf)
+			continue
+		case escapeFrameAbort:
+			d.drop(ErrFrameAborted, &d.aborts, &buf)
+			continue
+		case escapeFrameBadCRC:
+			d.confirmed = true
+			d.drop(ErrBadCRC, &d.badCRC, &buf)
+			continue
+		default:
+			d.drop(ErrMalformed, &d.malformed, &buf)
 			continue
 		}
 
 		data := buf.Bytes()
-		if localtalk.SumCRC(data) != localtalk.ValidCRC {
-			buf.Reset()
+		if len(data) < 2 {
+			d.drop(ErrMalformed, &d.malformed, &buf)
+			continue
+		} else if d.shouldVerify() && localtalk.SumCRC(data) != localtalk.ValidCRC {
+			d.features &^= FeatureCRCChecking
+			d.drop(ErrBadCRC, &d.badCRC, &buf)
 			continue
 		}
 
 		err = llap.Unmarshal(data[:len(data)-2], pak)
 		if err != nil {
-			buf.Reset()
+			d.drop(ErrMalformed, &d.malformed, &buf)
 			continue
 		}
 		return nil
 	}
 }
 
+func (d *Decoder) shouldVerify() bool {
+	if d.features&FeatureCRCChecking == 0 || !d.confirmed {
+		return true
+	}
+	d.frames++
+	if d.frames < verifyInterval {
+		return false
+	}
+	d.frames = 0
+	return true
+}
+
 // An Encoder translates LLAP packets to TashTalk serial output.
 type Encoder struct {
-	w     io.Writer
-	ready bool
+	w        io.Writer
+	ready    bool
+	features Features
 }
 
 // NewEncoder returns a Decoder with w as its output.
@@ -153,6 +292,7 @@ func (e *Encoder) Reset() error {
 // Encode encodes the packet and sends it to the decoder’s output.
 // If necessary, it blocks until the full packet can be sent.
 // The packet is CRCed and preceded by a TashTalk frame command.
+// With FeatureCRCCalculation, the CRC is left to TashTalk.
 //
 // If the output is not in a ready state (either because the encoder
 // was just created, or because a previous write operation failed),
@@ -168,31 +308,21 @@ func (e *Encoder) Encode(pak llap.Packet) error {
 		}
 	}
 
-	switch pak.Kind {
-	case llap.TypeDDP, llap.TypeExtDDP:
-		if len(pak.Payload) < 2 {
-			return fmt.Errorf("invalid DDP packet length: %d", len(pak.Payload))
-		}
-		inferredLength := binary.BigEndian.Uint16(pak.Payload[:2]) & 0x03ff
-		if int(inferredLength) != len(pak.Payload) {
-			return fmt.Errorf("DDP packet length mismatch: %d vs. %d", len(pak.Payload), inferredLength)
-		}
-	case llap.TypeEnq, llap.TypeAck:
-		if len(pak.Payload) != 0 {
-			return fmt.Errorf("control frame packet with payload")
-		}
-	default:
-		return fmt.Errorf("invalid packet type: $%02x", pak.Kind)
+	err := llap.Validate(pak)
+	if err != nil {
+		return err
 	}
 
 	marshaled, err := llap.Marshal(pak)
 	if err != nil {
 		return err
 	}
-	fcs := localtalk.SumCRC(marshaled)
 	data := []byte{commandFrame}
 	data = append(data, marshaled...)
-	data = append(data, byte(fcs), byte(fcs>>8))
+	if e.features&FeatureCRCCalculation == 0 {
+		fcs := localtalk.SumCRC(marshaled)
+		data = append(data, byte(fcs), byte(fcs>>8))
+	}
 	_, err = e.w.Write(data)
 	if err != nil {
 		e.ready = false
@@ -220,6 +350,25 @@ func (e *Encoder) SetNodeIDs(ids NodeSet) error {
 	return nil
 }
 
+// SetFeatures enables the given features in TashTalk, and disables others.
+// Features are not reset by Reset().
+func (e *Encoder) SetFeatures(f Features) error {
+	if !e.ready {
+		err := e.Reset()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err := e.w.Write([]byte{commandFeatures, byte(f)})
+	if err != nil {
+		e.ready = false
+		return err
+	}
+	e.features = f
+	return nil
+}
+
 // A NodeSet represents a mask of 256 nodes within a network.
 //
 // Each bit specifies a node ID, starting from the LSB of bitfield[0],
@@ -250,3 +399,23 @@ func (ns *NodeSet) Add(n ddp.Node) {
 func (ns *NodeSet) Remove(n ddp.Node) {
 	ns[n>>3] &= ^uint8(1 << (n & 0x7))
 }
+
+// Nodes returns the members of the NodeSet in ascending order.
+func (ns NodeSet) Nodes() []ddp.Node {
+	var nodes []ddp.Node
+	for n := 0; n < 256; n++ {
+		if ns.IsSet(ddp.Node(n)) {
+			nodes = append(nodes, ddp.Node(n))
+		}
+	}
+	return nodes
+}
+
+// String returns the members of the NodeSet, separated by commas.
+func (ns NodeSet) String() string {
+	var s []string
+	for _, n := range ns.Nodes() {
+		s = append(s, strconv.Itoa(int(n)))
+	}
+	return strings.Join(s, ",")
+}
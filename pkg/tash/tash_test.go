@@ -29,10 +29,13 @@ package tash
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"strconv"
+	"strings"
 	"testing"
 
+	"github.com/sfiera/multitalk/pkg/ddp"
 	"github.com/sfiera/multitalk/pkg/llap"
 	"github.com/stretchr/testify/assert"
 )
@@ -291,6 +294,56 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestDecoderStats(t *testing.T) {
+	assert := assert.New(t)
+	buf := bytes.NewBuffer(unhex(`020181eaea00fd` + `0201812dff00fd` + `020181eaea00fd`))
+	d := NewDecoder(buf)
+	pak := llap.Packet{}
+	assert.NoError(d.Decode(&pak))
+	assert.Equal(DecoderStats{BadCRC: 1}, d.Stats())
+	assert.Equal(io.EOF, d.Decode(&pak))
+	assert.Equal(DecoderStats{BadCRC: 2}, d.Stats())
+}
+
+func TestDecoderDrops(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDecoder(bytes.NewBuffer(unhex(
+		`020181eaea00fd` + // bad CRC
+			`010200fa` + // aborted
+			`020100fe` + // framing error
+			`01f1e100fd` + // too short
+			`0201812dff00fd`)))
+	type drop struct {
+		reason error
+		frame  string
+	}
+	var drops []drop
+	d.SetDropFunc(func(reason error, frame []byte) {
+		drops = append(drops, drop{reason, fmt.Sprintf("%x", frame)})
+	})
+	pak := llap.Packet{}
+	assert.NoError(d.Decode(&pak))
+	assert.Equal([]drop{
+		{ErrBadCRC, "020181eaea"},
+		{ErrFrameAborted, "0102"},
+		{ErrFramingError, "0201"},
+		{ErrMalformed, "01f1e1"},
+	}, drops)
+	assert.Equal(DecoderStats{FramingErrors: 1, Aborts: 1, BadCRC: 1, Malformed: 1}, d.Stats())
+}
+
+func TestDecoderReset(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDecoder(bytes.NewBuffer(unhex(`020181eaea00fd` + `0201`)))
+	pak := llap.Packet{}
+	assert.Equal(io.EOF, d.Decode(&pak))
+	d.Reset(bytes.NewBuffer(unhex(`010282ba0800fd`)))
+	if assert.NoError(d.Decode(&pak)) {
+		assert.Equal(llap.Header{DstNode: 1, SrcNode: 2, Kind: llap.TypeAck}, pak.Header)
+	}
+	assert.Equal(DecoderStats{BadCRC: 1}, d.Stats())
+}
+
 const reset = `0000000000000000000000000000000000000000000000000000000000000000` +
 	`0000000000000000000000000000000000000000000000000000000000000000` +
 	`0000000000000000000000000000000000000000000000000000000000000000` +
@@ -339,6 +392,14 @@ func TestEncode(t *testing.T) {
 			},
 		}},
 		want: reset + `010201812dff`,
+	}, {
+		name:    "rts-packet",
+		packets: []llap.Packet{*llap.RTS(2, 1)},
+		want:    reset + `0102018480a8`,
+	}, {
+		name:    "cts-packet",
+		packets: []llap.Packet{*llap.CTS(2, 1)},
+		want:    reset + `0102018509b9`,
 	}, {
 		name: "small_data-packet",
 		packets: []llap.Packet{{
@@ -528,6 +589,17 @@ func TestEncodeBadPackets(t *testing.T) {
 			Payload: []byte{0x00, 0x02},
 		},
 		wantErr: `control frame packet with payload`,
+	}, {
+		name: "non-empty-rts",
+		packet: llap.Packet{
+			Header: llap.Header{
+				DstNode: 2,
+				SrcNode: 1,
+				Kind:    llap.TypeRTS,
+			},
+			Payload: []byte{0x00, 0x02},
+		},
+		wantErr: `control frame packet with payload`,
 	}, {
 		name: "length-mismatch",
 		packet: llap.Packet{
@@ -566,6 +638,88 @@ func TestSetNodeIDs(t *testing.T) {
 	}
 }
 
+func TestNodeSet(t *testing.T) {
+	assert := assert.New(t)
+	ns := NewNodeSet(254, 1, 2)
+	ns.Add(8)
+	ns.Remove(2)
+	assert.Equal([]ddp.Node{1, 8, 254}, ns.Nodes())
+	assert.Equal("1,8,254", ns.String())
+	assert.Equal("", NodeSet{}.String())
+}
+
+func TestSetFeatures(t *testing.T) {
+	assert := assert.New(t)
+	buf := bytes.Buffer{}
+	e := NewEncoder(&buf)
+	assert.NoError(e.SetFeatures(FeatureCRCCalculation | FeatureCRCChecking))
+	assert.NoError(e.Encode(llap.Packet{Header: llap.Header{DstNode: 2, SrcNode: 1, Kind: llap.TypeEnq}}))
+	assert.NoError(e.SetFeatures(0))
+	assert.NoError(e.Encode(llap.Packet{Header: llap.Header{DstNode: 2, SrcNode: 1, Kind: llap.TypeEnq}}))
+	assert.Equal(unhex(reset+`03c0`+`01020181`+`0300`+`010201812dff`), buf.Bytes())
+}
+
+func TestDecodeFeatures(t *testing.T) {
+	enq := `0201812dff00fd`
+	badEnq := `020181eaea00fd`
+	firmwareBadEnq := `020181eaea00fc`
+	for _, tt := range []struct {
+		name          string
+		data          string
+		want          int
+		wantBadCRC    uint64
+		wantFeatures  Features
+		wantConfirmed bool
+	}{{
+		name:          "firmware-bad-crc",
+		data:          enq + firmwareBadEnq + enq,
+		want:          2,
+		wantBadCRC:    1,
+		wantFeatures:  FeatureCRCChecking,
+		wantConfirmed: true,
+	}, {
+		name:         "unconfirmed",
+		data:         enq + badEnq,
+		want:         1,
+		wantBadCRC:   1,
+		wantFeatures: 0,
+	}, {
+		name:          "trusted",
+		data:          firmwareBadEnq + strings.Repeat(badEnq, verifyInterval-1),
+		want:          verifyInterval - 1,
+		wantBadCRC:    1,
+		wantFeatures:  FeatureCRCChecking,
+		wantConfirmed: true,
+	}, {
+		name:          "unsupported",
+		data:          firmwareBadEnq + strings.Repeat(badEnq, verifyInterval+1),
+		want:          verifyInterval - 1,
+		wantBadCRC:    3,
+		wantFeatures:  0,
+		wantConfirmed: true,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			d := NewDecoder(bytes.NewBuffer(unhex(tt.data)))
+			d.SetFeatures(FeatureCRCChecking)
+			n := 0
+			for {
+				pak := llap.Packet{}
+				if err := d.Decode(&pak); err == io.EOF {
+					break
+				} else if err != nil {
+					panic(err)
+				}
+				n++
+			}
+			assert.Equal(tt.want, n)
+			assert.Equal(tt.wantBadCRC, d.Stats().BadCRC)
+			assert.Equal(tt.wantFeatures, d.Features())
+			assert.Equal(tt.wantConfirmed, d.Confirmed())
+		})
+	}
+}
+
 func unhex(s string) []byte {
 	data := []byte{}
 	for i := 0; i < len(s); i += 2 {
@@ -0,0 +1,284 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Package tashtest provides a simulated TashTalk device, for testing code
+// that talks to TashTalk without the hardware.
+package tashtest
+
+import (
+	"bufio"
+	"io"
+	"sync"
+
+	"github.com/sfiera/multitalk/pkg/llap"
+	"github.com/sfiera/multitalk/pkg/localtalk"
+	"github.com/sfiera/multitalk/pkg/tash"
+)
+
+const (
+	commandNoop     = byte(0x00)
+	commandFrame    = byte(0x01)
+	commandNodeIDs  = byte(0x02)
+	commandFeatures = byte(0x03)
+)
+
+// A Device behaves like a TashTalk unit: it accepts commands on its port,
+// transmits frames onto a simulated LocalTalk wire, and passes frames from
+// the wire back to the port, escaped and with a CRC.
+//
+// Like the firmware, a Device answers ENQ and RTS frames for nodes in the
+// mask most recently set by the host.
+type Device struct {
+	supported tash.Features
+
+	port     *port
+	cmdR     *io.PipeReader // commands from the host
+	frameW   *io.PipeWriter // frames to the host
+	frameMu  sync.Mutex
+	features tash.Features
+	nodes    tash.NodeSet
+	mu       sync.Mutex
+
+	wire       chan llap.Packet
+	wireClosed bool
+	wireMu     sync.Mutex
+}
+
+type port struct {
+	*io.PipeReader
+	*io.PipeWriter
+}
+
+func (p *port) Close() error {
+	p.PipeReader.Close()
+	return p.PipeWriter.Close()
+}
+
+// NewDevice returns a running Device, which supports the given features.
+// With no supported features, it ignores the command to set them,
+// like older firmware.
+func NewDevice(supported tash.Features) *Device {
+	cmdR, cmdW := io.Pipe()
+	frameR, frameW := io.Pipe()
+	d := &Device{
+		supported: supported,
+		port:      &port{frameR, cmdW},
+		cmdR:      cmdR,
+		frameW:    frameW,
+		wire:      make(chan llap.Packet, 16),
+	}
+	go d.run()
+	return d
+}
+
+// Port returns the host’s end of the serial connection.
+func (d *Device) Port() io.ReadWriteCloser {
+	return d.port
+}
+
+// Wire returns frames which the Device has transmitted, either at the
+// host’s command or in answer to ENQ and RTS frames. It must be drained,
+// or the Device blocks. It is closed when the Device is closed.
+func (d *Device) Wire() <-chan llap.Packet {
+	return d.wire
+}
+
+// Nodes returns the node ID mask most recently set by the host.
+func (d *Device) Nodes() tash.NodeSet {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.nodes
+}
+
+// Features returns the features enabled by the host.
+func (d *Device) Features() tash.Features {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.features
+}
+
+// Receive simulates a frame arriving from the wire.
+// If it is an ENQ or RTS to a node in the mask, it is answered.
+// It blocks until the host has read the frame.
+func (d *Device) Receive(pak llap.Packet) error {
+	if d.Nodes().IsSet(pak.DstNode) {
+		switch pak.Kind {
+		case llap.TypeEnq:
+			d.send(*llap.Ack(pak.SrcNode, pak.DstNode))
+		case llap.TypeRTS:
+			d.send(*llap.CTS(pak.SrcNode, pak.DstNode))
+		}
+	}
+
+	data, err := llap.Marshal(pak)
+	if err != nil {
+		return err
+	}
+	fcs := localtalk.SumCRC(data)
+	return d.ReceiveFrame(append(data, byte(fcs), byte(fcs>>8)))
+}
+
+// ReceiveFrame simulates raw frame data, including the CRC, arriving from
+// the wire. With tash.FeatureCRCChecking, a frame with a bad CRC is
+// reported to the host as such.
+func (d *Device) ReceiveFrame(frame []byte) error {
+	done := []byte{0x00, 0xfd}
+	if d.Features()&tash.FeatureCRCChecking != 0 && localtalk.SumCRC(frame) != localtalk.ValidCRC {
+		done = []byte{0x00, 0xfc}
+	}
+	return d.write(append(escape(frame), done...))
+}
+
+// Abort simulates a frame from the wire that is cut off after the given data.
+func (d *Device) Abort(partial []byte) error {
+	return d.write(append(escape(partial), 0x00, 0xfa))
+}
+
+// Puts pak on the wire, unless the Device is closed.
+func (d *Device) send(pak llap.Packet) {
+	d.wireMu.Lock()
+	defer d.wireMu.Unlock()
+	if !d.wireClosed {
+		d.wire <- pak
+	}
+}
+
+func (d *Device) write(data []byte) error {
+	d.frameMu.Lock()
+	defer d.frameMu.Unlock()
+	_, err := d.frameW.Write(data)
+	return err
+}
+
+// Close disconnects the Device, as if it were unplugged.
+func (d *Device) Close() error {
+	d.cmdR.Close()
+	return d.frameW.Close()
+}
+
+func escape(data []byte) []byte {
+	var escaped []byte
+	for _, b := range data {
+		if b == 0x00 {
+			escaped = append(escaped, 0x00, 0xff)
+		} else {
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+// Reads and executes commands until the port is closed.
+func (d *Device) run() {
+	defer func() {
+		d.Close()
+		d.wireMu.Lock()
+		d.wireClosed = true
+		close(d.wire)
+		d.wireMu.Unlock()
+	}()
+	r := bufio.NewReader(d.cmdR)
+	for {
+		cmd, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		switch cmd {
+		case commandNoop:
+		case commandFrame:
+			err = d.transmit(r)
+		case commandNodeIDs:
+			nodes := tash.NodeSet{}
+			_, err = io.ReadFull(r, nodes[:])
+			d.mu.Lock()
+			d.nodes = nodes
+			d.mu.Unlock()
+		case commandFeatures:
+			if d.supported == 0 {
+				break // treated as unknown
+			}
+			var f byte
+			f, err = r.ReadByte()
+			d.mu.Lock()
+			d.features = tash.Features(f) & d.supported
+			d.mu.Unlock()
+		default:
+			// Unknown commands are ignored.
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Reads a frame from the host and puts it on the wire.
+// Frames with a bad CRC are not transmitted.
+func (d *Device) transmit(r io.Reader) error {
+	frame := make([]byte, 3)
+	_, err := io.ReadFull(r, frame)
+	if err != nil {
+		return err
+	}
+
+	// Like TashTalk, infer the length of data frames from the DDP header.
+	if !llap.Type(frame[2]).IsControl() {
+		length := make([]byte, 2)
+		_, err = io.ReadFull(r, length)
+		if err != nil {
+			return err
+		}
+		n := int(length[0]&0x03)<<8 | int(length[1])
+		if n < 2 {
+			n = 2
+		}
+		rest := make([]byte, n-2)
+		_, err = io.ReadFull(r, rest)
+		if err != nil {
+			return err
+		}
+		frame = append(append(frame, length...), rest...)
+	}
+
+	if d.Features()&tash.FeatureCRCCalculation == 0 {
+		fcs := make([]byte, 2)
+		_, err = io.ReadFull(r, fcs)
+		if err != nil {
+			return err
+		}
+		if localtalk.SumCRC(append(frame, fcs...)) != localtalk.ValidCRC {
+			return nil
+		}
+	}
+
+	pak := llap.Packet{}
+	err = llap.Unmarshal(frame, &pak)
+	if err != nil {
+		return nil
+	}
+	d.send(pak)
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2009-2023 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package tashtest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+	"github.com/sfiera/multitalk/pkg/llap"
+	"github.com/sfiera/multitalk/pkg/tash"
+	"github.com/stretchr/testify/assert"
+)
+
+var ddpPacket = llap.Packet{
+	Header:  llap.Header{DstNode: 0xff, SrcNode: 0x01, Kind: llap.TypeDDP},
+	Payload: []byte{0x00, 0x08, 0x02, 0x02, 0x02, 0x00, 0xaa, 0xbb},
+}
+
+func TestTransmit(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		features tash.Features
+	}{
+		{"crc", 0},
+		{"no-crc", tash.FeatureCRCCalculation},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			d := NewDevice(tash.FeatureCRCCalculation)
+			defer d.Close()
+			enc := tash.NewEncoder(d.Port())
+
+			assert.NoError(enc.SetFeatures(tt.features))
+			assert.NoError(enc.SetNodeIDs(tash.NewNodeSet(3, 4)))
+			assert.NoError(enc.Encode(*llap.Enq(0x05, 0x05)))
+			assert.NoError(enc.Encode(ddpPacket))
+
+			assert.Equal(*llap.Enq(0x05, 0x05), <-d.Wire())
+			assert.Equal(ddpPacket, <-d.Wire())
+			assert.Equal(tash.NewNodeSet(3, 4), d.Nodes())
+			assert.Equal(tt.features, d.Features())
+		})
+	}
+}
+
+func TestReceive(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDevice(0)
+	defer d.Close()
+	enc := tash.NewEncoder(d.Port())
+	dec := tash.NewDecoder(d.Port())
+
+	assert.NoError(enc.SetNodeIDs(tash.NewNodeSet(7)))
+	assert.Eventually(func() bool {
+		return d.Nodes().IsSet(7)
+	}, time.Second, time.Millisecond)
+
+	go func() {
+		d.Receive(*llap.Enq(0x06, 0x06))
+		d.Receive(*llap.Enq(0x07, 0x07))
+		d.Receive(*llap.RTS(0x07, 0x01))
+		d.Receive(ddpPacket)
+	}()
+
+	pak := llap.Packet{}
+	for _, want := range []llap.Packet{
+		*llap.Enq(0x06, 0x06),
+		*llap.Enq(0x07, 0x07),
+		*llap.RTS(0x07, 0x01),
+		ddpPacket,
+	} {
+		assert.NoError(dec.Decode(&pak))
+		assert.Equal(want, pak)
+	}
+	assert.Equal(*llap.Ack(0x07, 0x07), <-d.Wire())
+	assert.Equal(*llap.CTS(0x01, 0x07), <-d.Wire())
+}
+
+func TestReceiveErrors(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDevice(tash.FeatureCRCChecking)
+	defer d.Close()
+	enc := tash.NewEncoder(d.Port())
+	dec := tash.NewDecoder(d.Port())
+	assert.NoError(enc.SetFeatures(tash.FeatureCRCChecking))
+	assert.Eventually(func() bool {
+		return d.Features() == tash.FeatureCRCChecking
+	}, time.Second, time.Millisecond)
+	dec.SetFeatures(tash.FeatureCRCChecking)
+
+	go func() {
+		d.ReceiveFrame([]byte{0x02, 0x01, 0x81, 0xea, 0xea})
+		d.Abort([]byte{0x02, 0x01})
+		d.Receive(*llap.Enq(0x02, 0x01))
+	}()
+	pak := llap.Packet{}
+	assert.NoError(dec.Decode(&pak))
+	assert.Equal(*llap.Enq(0x02, 0x01), pak)
+	assert.Equal(tash.DecoderStats{Aborts: 1, BadCRC: 1}, dec.Stats())
+}
+
+func TestLegacyFeatures(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDevice(0)
+	defer d.Close()
+	enc := tash.NewEncoder(d.Port())
+	assert.NoError(enc.SetFeatures(tash.FeatureCRCCalculation | tash.FeatureCRCChecking))
+	assert.NoError(enc.SetNodeIDs(tash.NewNodeSet(ddp.Node(9))))
+	assert.Eventually(func() bool {
+		return d.Nodes().IsSet(9)
+	}, time.Second, time.Millisecond)
+	assert.Equal(tash.Features(0), d.Features())
+}
+
+func TestClose(t *testing.T) {
+	assert := assert.New(t)
+	d := NewDevice(0)
+	dec := tash.NewDecoder(d.Port())
+	assert.NoError(d.Close())
+	assert.Error(dec.Decode(&llap.Packet{}))
+	_, ok := <-d.Wire()
+	assert.False(ok)
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+// Encodes and decodes ZIP (Zone Information Protocol) packets, as
+// carried by DDP. ZIP requests carried by ATP are not supported.
+package zip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+// Socket is the socket of the ZIP process in routers.
+const Socket = ddp.Socket(6)
+
+type Function uint8
+
+const (
+	FunctionQuery    = Function(1) // for the zones of networks
+	FunctionReply    = Function(2) // zones of non-extended networks
+	FunctionExtReply = Function(8) // zones of an extended network
+)
+
+// A Tuple names a zone of a network.
+type Tuple struct {
+	Network ddp.Network
+	Zone    string
+}
+
+// UnmarshalQuery decodes the networks requested by a ZIP Query.
+func UnmarshalQuery(data []byte) ([]ddp.Network, error) {
+	if len(data) < 2 {
+		return nil, fmt.Errorf("read zip query: %s", io.ErrUnexpectedEOF.Error())
+	} else if Function(data[0]) != FunctionQuery {
+		return nil, fmt.Errorf("read zip query: unexpected function %d", data[0])
+	} else if len(data) != 2+2*int(data[1]) {
+		return nil, fmt.Errorf("read zip query: wrong length for %d networks", data[1])
+	}
+	nets := make([]ddp.Network, data[1])
+	_ = binary.Read(bytes.NewReader(data[2:]), binary.BigEndian, nets)
+	return nets, nil
+}
+
+// MarshalQuery encodes a ZIP Query for the zones of nets.
+func MarshalQuery(nets []ddp.Network) ([]byte, error) {
+	if len(nets) > 0xff {
+		return nil, fmt.Errorf("write zip query: too many networks")
+	}
+	w := bytes.NewBuffer([]byte{byte(FunctionQuery), byte(len(nets))})
+	_ = binary.Write(w, binary.BigEndian, nets)
+	return w.Bytes(), nil
+}
+
+// UnmarshalReply decodes the zone tuples of a ZIP Reply or Extended
+// Reply, and returns which it was.
+func UnmarshalReply(data []byte) (Function, []Tuple, error) {
+	if len(data) < 2 {
+		return 0, nil, fmt.Errorf("read zip reply: %s", io.ErrUnexpectedEOF.Error())
+	}
+	fn := Function(data[0])
+	if fn != FunctionReply && fn != FunctionExtReply {
+		return 0, nil, fmt.Errorf("read zip reply: unexpected function %d", fn)
+	}
+	r := bytes.NewReader(data[2:])
+	var tuples []Tuple
+	for r.Len() > 0 {
+		t := Tuple{}
+		err := binary.Read(r, binary.BigEndian, &t.Network)
+		if err == nil {
+			t.Zone, err = readString(r)
+		}
+		if err != nil {
+			return 0, nil, fmt.Errorf("read zip tuple: %s", err.Error())
+		}
+		tuples = append(tuples, t)
+	}
+	return fn, tuples, nil
+}
+
+// Reads a Pascal string: a length byte, then the characters.
+func readString(r *bytes.Reader) (string, error) {
+	n, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	s := make([]byte, n)
+	_, err = io.ReadFull(r, s)
+	if err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
+
+// MarshalReply encodes a ZIP Reply, for the zones of non-extended
+// networks, or an Extended Reply, for the zones of one extended network.
+// The count is of networks in a Reply, and of zones in an Extended Reply.
+func MarshalReply(fn Function, tuples []Tuple) ([]byte, error) {
+	count := len(tuples)
+	if fn == FunctionReply {
+		nets := map[ddp.Network]bool{}
+		for _, t := range tuples {
+			nets[t.Network] = true
+		}
+		count = len(nets)
+	} else if fn != FunctionExtReply {
+		return nil, fmt.Errorf("write zip reply: unexpected function %d", fn)
+	}
+	if count > 0xff {
+		return nil, fmt.Errorf("write zip reply: too many tuples")
+	}
+	w := bytes.NewBuffer([]byte{byte(fn), byte(count)})
+	for _, t := range tuples {
+		if len(t.Zone) > 32 {
+			return nil, fmt.Errorf("write zip tuple: zone name too long: %q", t.Zone)
+		}
+		_ = binary.Write(w, binary.BigEndian, t.Network)
+		w.WriteByte(byte(len(t.Zone)))
+		w.WriteString(t.Zone)
+	}
+	return w.Bytes(), nil
+}
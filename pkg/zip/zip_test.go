@@ -0,0 +1,120 @@
+// Copyright (c) 2009-2020 Rob Braun <bbraun@synack.net> and others
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions
+// are met:
+// 1. Redistributions of source code must retain the above copyright
+//    notice, this list of conditions and the following disclaimer.
+// 2. Redistributions in binary form must reproduce the above copyright
+//    notice, this list of conditions and the following disclaimer in the
+//    documentation and/or other materials provided with the distribution.
+// 3. Neither the name of Rob Braun nor the names of his contributors
+//    may be used to endorse or promote products derived from this software
+//    without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+// ARE DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT OWNER OR CONTRIBUTORS BE
+// LIABLE FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR
+// CONSEQUENTIAL DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF
+// SUBSTITUTE GOODS OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS
+// INTERRUPTION) HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN
+// CONTRACT, STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE)
+// ARISING IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+// POSSIBILITY OF SUCH DAMAGE.
+
+package zip
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/sfiera/multitalk/pkg/ddp"
+)
+
+func unhex(s string) []byte {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestQuery(t *testing.T) {
+	assert := assert.New(t)
+	data, err := MarshalQuery([]ddp.Network{20, 1000})
+	if assert.NoError(err) {
+		assert.Equal(unhex("0102001403e8"), data)
+	}
+	nets, err := UnmarshalQuery(unhex("0102001403e8"))
+	if assert.NoError(err) {
+		assert.Equal([]ddp.Network{20, 1000}, nets)
+	}
+}
+
+func TestReply(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		fn     Function
+		tuples []Tuple
+		hex    string
+	}{{
+		name:   "reply",
+		fn:     FunctionReply,
+		tuples: []Tuple{{20, "There"}, {30, "Elsewhere"}},
+		hex:    "0202" + "0014055468657265" + "001e09456c736577686572" + "65",
+	}, {
+		name:   "ext-reply",
+		fn:     FunctionExtReply,
+		tuples: []Tuple{{1000, "There"}, {1000, "Elsewhere"}},
+		hex:    "0802" + "03e8055468657265" + "03e809456c736577686572" + "65",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			assert := assert.New(t)
+			data, err := MarshalReply(tt.fn, tt.tuples)
+			if assert.NoError(err) {
+				assert.Equal(unhex(tt.hex), data)
+			}
+			fn, tuples, err := UnmarshalReply(unhex(tt.hex))
+			if assert.NoError(err) {
+				assert.Equal(tt.fn, fn)
+				assert.Equal(tt.tuples, tuples)
+			}
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	for _, tt := range []struct {
+		name, hex, err string
+		unmarshal      func([]byte) error
+	}{
+		{"query-empty", "", "read zip query: unexpected EOF", query},
+		{"query-function", "0200", "read zip query: unexpected function 2", query},
+		{"query-length", "01020014", "read zip query: wrong length for 2 networks", query},
+		{"reply-empty", "02", "read zip reply: unexpected EOF", reply},
+		{"reply-function", "0100", "read zip reply: unexpected function 1", reply},
+		{"reply-tuple", "020100140554", "read zip tuple: unexpected EOF", reply},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.unmarshal(unhex(tt.hex))
+			if assert.Error(t, err) {
+				assert.Equal(t, tt.err, err.Error())
+			}
+		})
+	}
+}
+
+func query(data []byte) error {
+	_, err := UnmarshalQuery(data)
+	return err
+}
+
+func reply(data []byte) error {
+	_, _, err := UnmarshalReply(data)
+	return err
+}